@@ -8,10 +8,13 @@ require (
 	github.com/gorilla/websocket v1.5.0
 	github.com/isobit/cli v0.11.1-0.20240207065020-f91febcb7277
 	github.com/jackc/pgx/v5 v5.4.3
+	github.com/klauspost/compress v1.17.9
 	github.com/miekg/dns v1.1.59
 	github.com/sourcegraph/conc v0.3.0
 	github.com/stretchr/testify v1.8.1
 	github.com/tinylib/msgp v1.1.8
+	golang.org/x/sys v0.18.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -23,11 +26,11 @@ require (
 	github.com/kr/text v0.2.0 // indirect
 	github.com/philhofer/fwd v1.1.2 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
+	go.uber.org/atomic v1.7.0 // indirect
+	go.uber.org/multierr v1.9.0 // indirect
 	golang.org/x/crypto v0.21.0 // indirect
 	golang.org/x/mod v0.16.0 // indirect
 	golang.org/x/net v0.22.0 // indirect
-	golang.org/x/sys v0.18.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
 	golang.org/x/tools v0.19.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,449 @@
+package ndog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/tinylib/msgp/msgp"
+)
+
+// Transform returns a WriteCloser which transforms data written to it and
+// writes the result to w. Closing it flushes any buffered data, but does not
+// close w.
+type Transform func(w io.Writer) io.WriteCloser
+
+// Codec is a pair of transforms to and from some representation of data.
+// Either may be nil if unsupported.
+type Codec struct {
+	Encode Transform
+	Decode Transform
+}
+
+var Codecs = map[string]Codec{
+	"base64": {
+		Encode: func(w io.Writer) io.WriteCloser {
+			return base64.NewEncoder(base64.StdEncoding, w)
+		},
+		Decode: copyTransform(func(dst io.Writer, src io.Reader) error {
+			_, err := io.Copy(dst, base64.NewDecoder(base64.StdEncoding, src))
+			return err
+		}),
+	},
+	"hex": {
+		Encode: func(w io.Writer) io.WriteCloser {
+			return NopWriteCloser(hex.NewEncoder(w))
+		},
+		Decode: copyTransform(func(dst io.Writer, src io.Reader) error {
+			_, err := io.Copy(dst, hex.NewDecoder(skipSpaceReader{src}))
+			return err
+		}),
+	},
+	"url": {
+		Encode: func(w io.Writer) io.WriteCloser {
+			return NopWriteCloser(writerFunc(func(p []byte) (int, error) {
+				if _, err := io.WriteString(w, url.QueryEscape(string(p))); err != nil {
+					return 0, err
+				}
+				return len(p), nil
+			}))
+		},
+		Decode: func(w io.Writer) io.WriteCloser {
+			return &unescapeWriter{w: w, unescape: unescapeURL}
+		},
+	},
+	"escape": {
+		Encode: func(w io.Writer) io.WriteCloser {
+			return NopWriteCloser(writerFunc(func(p []byte) (int, error) {
+				if _, err := w.Write(escape(p)); err != nil {
+					return 0, err
+				}
+				return len(p), nil
+			}))
+		},
+		Decode: func(w io.Writer) io.WriteCloser {
+			return &unescapeWriter{w: w, unescape: unescapeBackslash}
+		},
+	},
+	"gzip": {
+		Encode: func(w io.Writer) io.WriteCloser {
+			return flushingWriter{gzip.NewWriter(w)}
+		},
+		Decode: copyTransform(func(dst io.Writer, src io.Reader) error {
+			r, err := gzip.NewReader(src)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(dst, r)
+			return err
+		}),
+	},
+	"zstd": {
+		Encode: func(w io.Writer) io.WriteCloser {
+			enc, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+			if err != nil {
+				// Only returned for invalid options.
+				panic(err)
+			}
+			return flushingWriter{enc}
+		},
+		Decode: copyTransform(func(dst io.Writer, src io.Reader) error {
+			dec, err := zstd.NewReader(src, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return err
+			}
+			defer dec.Close()
+			_, err = io.Copy(dst, dec)
+			return err
+		}),
+	},
+	"msgpack": {
+		Decode: copyTransform(func(dst io.Writer, src io.Reader) error {
+			_, err := msgp.CopyToJSON(dst, src)
+			return err
+		}),
+	},
+}
+
+// ParseCodec parses a codec spec of the form NAME[:encode|:decode], where the
+// direction defaults to decode.
+func ParseCodec(spec string) (Transform, error) {
+	name, dir, _ := strings.Cut(spec, ":")
+	codec, ok := Codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec: %s", name)
+	}
+	var t Transform
+	switch dir {
+	case "", "decode":
+		dir = "decode"
+		t = codec.Decode
+	case "encode":
+		t = codec.Encode
+	default:
+		return nil, fmt.Errorf("invalid codec direction: %s", dir)
+	}
+	if t == nil {
+		return nil, fmt.Errorf("codec %s does not support %s", name, dir)
+	}
+	return t, nil
+}
+
+// CodecStreamManager transforms the data of streams created by its delegate.
+// In is applied to data read from the delegate's streams, i.e. sent to the
+// remote, and Out to data written to them, i.e. received from the remote.
+// Each is a chain of transforms applied in order.
+type CodecStreamManager struct {
+	StreamManager
+	In  []Transform
+	Out []Transform
+}
+
+func (m *CodecStreamManager) NewStream(name string, meta StreamMetadata) (Stream, error) {
+	stream, err := m.StreamManager.NewStream(name, meta)
+	if err != nil {
+		return Stream{}, err
+	}
+	if len(m.In) > 0 {
+		stream.Reader = transformReader(stream.Reader, m.In)
+	}
+	if len(m.Out) > 0 {
+		stream.Writer = transformWriter(stream.Writer, m.Out)
+	}
+	return stream, nil
+}
+
+// NewMessageStream transforms each message independently, so that message
+// boundaries are preserved, e.g. each WebSocket message or datagram is
+// encoded or decoded as a whole.
+func (m *CodecStreamManager) NewMessageStream(name string, meta StreamMetadata, framing Framing) (MessageStream, error) {
+	stream, err := NewMessageStream(m.StreamManager, name, meta, framing)
+	if err != nil {
+		return MessageStream{}, err
+	}
+	if len(m.In) > 0 {
+		stream.Reader = transformMessageReader{stream.Reader, m.In}
+	}
+	if len(m.Out) > 0 {
+		stream.Writer = transformMessageWriter{stream.Writer, m.Out}
+	}
+	return stream, nil
+}
+
+// chain returns a writer which applies transforms in order before writing to
+// w, and a function to close each of them in order.
+func chain(w io.Writer, transforms []Transform) (io.Writer, func() error) {
+	writers := make([]io.WriteCloser, len(transforms))
+	for i := len(transforms) - 1; i >= 0; i-- {
+		writers[i] = transforms[i](w)
+		w = writers[i]
+	}
+	return w, func() error {
+		for _, wc := range writers {
+			if err := wc.Close(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func transformReader(r io.ReadCloser, transforms []Transform) io.ReadCloser {
+	pr, pw := io.Pipe()
+	w, closeChain := chain(pw, transforms)
+	go func() {
+		_, err := io.Copy(w, r)
+		if err == nil {
+			err = closeChain()
+		}
+		pw.CloseWithError(err)
+	}()
+	return FuncReadCloser(pr, func() error {
+		pr.Close()
+		return r.Close()
+	})
+}
+
+func transformWriter(wc io.WriteCloser, transforms []Transform) io.WriteCloser {
+	w, closeChain := chain(wc, transforms)
+	return FuncWriteCloser(w, func() error {
+		err := closeChain()
+		wc.Close()
+		return err
+	})
+}
+
+// transformMessage applies transforms in order to a single message.
+func transformMessage(msg []byte, transforms []Transform) ([]byte, error) {
+	var buf bytes.Buffer
+	w, closeChain := chain(&buf, transforms)
+	if _, err := w.Write(msg); err != nil {
+		closeChain()
+		return nil, err
+	}
+	if err := closeChain(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type transformMessageReader struct {
+	MessageReadCloser
+	transforms []Transform
+}
+
+func (r transformMessageReader) ReadMessage() ([]byte, error) {
+	msg, err := r.MessageReadCloser.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	return transformMessage(msg, r.transforms)
+}
+
+type transformMessageWriter struct {
+	MessageWriteCloser
+	transforms []Transform
+}
+
+func (w transformMessageWriter) WriteMessage(msg []byte) error {
+	msg, err := transformMessage(msg, w.transforms)
+	if err != nil {
+		return err
+	}
+	return w.MessageWriteCloser.WriteMessage(msg)
+}
+
+// copyTransform returns a Transform which runs copy in a goroutine, with src
+// reading the data written to the transform.
+func copyTransform(copy func(dst io.Writer, src io.Reader) error) Transform {
+	return func(w io.Writer) io.WriteCloser {
+		pr, pw := io.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			err := copy(w, pr)
+			// Fail further writes, e.g. if the data was invalid.
+			pr.CloseWithError(err)
+			done <- err
+		}()
+		return FuncWriteCloser(pw, func() error {
+			pw.Close()
+			return <-done
+		})
+	}
+}
+
+type skipSpaceReader struct {
+	io.Reader
+}
+
+func (r skipSpaceReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.Reader.Read(p)
+		n = len(slices.DeleteFunc(p[:n], func(b byte) bool {
+			return b == ' ' || b == '\t' || b == '\r' || b == '\n'
+		}))
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// flushingWriter wraps a compressing writer such as gzip.Writer.
+type flushingWriter struct {
+	w interface {
+		io.WriteCloser
+		Flush() error
+	}
+}
+
+// Write flushes after every write so that compressed data is sent as soon as
+// possible, e.g. for interactive use.
+func (w flushingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, w.w.Flush()
+}
+
+func (w flushingWriter) Close() error {
+	return w.w.Close()
+}
+
+// unescapeWriter decodes escape sequences, holding back any incomplete
+// sequence at the end of a write until the next one.
+type unescapeWriter struct {
+	w io.Writer
+	// unescape decodes p, returning the number of bytes consumed, which is
+	// less than len(p) if p ends with an incomplete sequence.
+	unescape func(p []byte) ([]byte, int)
+	buf      []byte
+}
+
+func (w *unescapeWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	out, n := w.unescape(w.buf)
+	w.buf = w.buf[n:]
+	if _, err := w.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close writes any incomplete sequence as is.
+func (w *unescapeWriter) Close() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	_, err := w.w.Write(w.buf)
+	w.buf = nil
+	return err
+}
+
+// unescapeURL decodes %XX escapes and + as a space, passing through invalid
+// escapes as is.
+func unescapeURL(p []byte) ([]byte, int) {
+	out := make([]byte, 0, len(p))
+	i := 0
+	for i < len(p) {
+		switch p[i] {
+		case '+':
+			out = append(out, ' ')
+			i++
+			continue
+		case '%':
+			if i+3 > len(p) {
+				return out, i
+			}
+			var b [1]byte
+			if _, err := hex.Decode(b[:], p[i+1:i+3]); err == nil {
+				out = append(out, b[0])
+				i += 3
+				continue
+			}
+		}
+		out = append(out, p[i])
+		i++
+	}
+	return out, i
+}
+
+var backslashEscapes = map[byte]byte{
+	'0':  0,
+	'a':  '\a',
+	'b':  '\b',
+	'e':  0x1b,
+	'f':  '\f',
+	'n':  '\n',
+	'r':  '\r',
+	't':  '\t',
+	'v':  '\v',
+	'\\': '\\',
+}
+
+// unescapeBackslash decodes backslash escapes such as \n and \x00, passing
+// through unknown escapes as is.
+func unescapeBackslash(p []byte) ([]byte, int) {
+	out := make([]byte, 0, len(p))
+	i := 0
+	for i < len(p) {
+		if p[i] != '\\' {
+			out = append(out, p[i])
+			i++
+			continue
+		}
+		if i+1 >= len(p) {
+			break
+		}
+		if b, ok := backslashEscapes[p[i+1]]; ok {
+			out = append(out, b)
+			i += 2
+			continue
+		}
+		if p[i+1] == 'x' {
+			if i+4 > len(p) {
+				break
+			}
+			var b [1]byte
+			if _, err := hex.Decode(b[:], p[i+2:i+4]); err == nil {
+				out = append(out, b[0])
+				i += 4
+				continue
+			}
+		}
+		out = append(out, p[i])
+		i++
+	}
+	return out, i
+}
+
+// escape encodes p using backslash escapes for everything other than
+// printable ASCII.
+func escape(p []byte) []byte {
+	const hexDigits = "0123456789abcdef"
+	out := make([]byte, 0, len(p))
+	for _, b := range p {
+		switch {
+		case b == '\\':
+			out = append(out, '\\', '\\')
+		case b == '\n':
+			out = append(out, '\\', 'n')
+		case b == '\r':
+			out = append(out, '\\', 'r')
+		case b == '\t':
+			out = append(out, '\\', 't')
+		case b >= 0x20 && b < 0x7f:
+			out = append(out, b)
+		default:
+			out = append(out, '\\', 'x', hexDigits[b>>4], hexDigits[b&0xf])
+		}
+	}
+	return out
+}
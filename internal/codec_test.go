@@ -0,0 +1,132 @@
+package ndog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodecsRoundTrip(t *testing.T) {
+	data := []byte("hello\x00\x01\r\n\\ world%+&é")
+	for name, codec := range Codecs {
+		if codec.Encode == nil {
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			var decoded bytes.Buffer
+			w, closeChain := chain(&decoded, []Transform{codec.Encode, codec.Decode})
+			// Write one byte at a time to split sequences across writes.
+			for i := range data {
+				_, err := w.Write(data[i : i+1])
+				require.NoError(t, err)
+			}
+			require.NoError(t, closeChain())
+			assert.Equal(t, data, decoded.Bytes())
+		})
+	}
+}
+
+func TestCodecsDecodeInvalidEscapes(t *testing.T) {
+	for name, tt := range map[string]struct {
+		in, want string
+	}{
+		"url":    {"a%20b%zzc+d%2", "a b%zzc d%2"},
+		"escape": {`a\tb\qc\x4`, "a\tb\\qc\\x4"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var decoded bytes.Buffer
+			w := Codecs[name].Decode(&decoded)
+			// Only invalid escapes are kept as is; the rest are decoded.
+			_, err := io.WriteString(w, tt.in)
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+			assert.Equal(t, tt.want, decoded.String())
+		})
+	}
+}
+
+func TestParseCodec(t *testing.T) {
+	_, err := ParseCodec("base64:encode")
+	assert.NoError(t, err)
+	_, err = ParseCodec("bogus")
+	assert.Error(t, err)
+	_, err = ParseCodec("hex:sideways")
+	assert.Error(t, err)
+	_, err = ParseCodec("msgpack:encode")
+	assert.Error(t, err)
+}
+
+func TestCodecStreamManager(t *testing.T) {
+	var out bytes.Buffer
+	m := &CodecStreamManager{
+		StreamManager: fixedStreamManager{Stream{
+			Reader: io.NopCloser(strings.NewReader("68 69\n")),
+			Writer: NopWriteCloser(&out),
+		}},
+		In:  []Transform{Codecs["hex"].Decode, Codecs["base64"].Encode},
+		Out: []Transform{Codecs["escape"].Decode},
+	}
+	stream, err := m.NewStream("test", StreamMetadata{})
+	require.NoError(t, err)
+
+	sent, err := io.ReadAll(stream.Reader)
+	require.NoError(t, err)
+	assert.Equal(t, "aGk=", string(sent))
+
+	stream.Writer.Write([]byte(`a\x0`))
+	stream.Writer.Write([]byte(`0\n\`))
+	stream.Writer.Close()
+	assert.Equal(t, "a\x00\n\\", out.String())
+}
+
+type fixedMessageStreamManager struct {
+	stream MessageStream
+}
+
+func (m fixedMessageStreamManager) NewStream(name string, meta StreamMetadata) (Stream, error) {
+	return Stream{}, fmt.Errorf("byte streams not supported")
+}
+
+func (m fixedMessageStreamManager) NewMessageStream(name string, meta StreamMetadata, framing Framing) (MessageStream, error) {
+	return m.stream, nil
+}
+
+func TestCodecStreamManagerMessages(t *testing.T) {
+	r, w := MessagePipe()
+	outR, outW := MessagePipe()
+	m := &CodecStreamManager{
+		StreamManager: fixedMessageStreamManager{MessageStream{Reader: r, Writer: outW}},
+		In:            []Transform{Codecs["base64"].Encode},
+		Out:           []Transform{Codecs["gzip"].Decode},
+	}
+	stream, err := m.NewMessageStream("test", StreamMetadata{}, RawFraming)
+	require.NoError(t, err)
+
+	go func() {
+		w.WriteMessage([]byte("a"))
+		w.WriteMessage([]byte("bc"))
+		w.Close()
+	}()
+	for _, want := range []string{"YQ==", "YmM="} {
+		msg, err := stream.Reader.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, want, string(msg))
+	}
+
+	for _, s := range []string{"hello", "world"} {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		gw.Write([]byte(s))
+		gw.Close()
+		go stream.Writer.WriteMessage(buf.Bytes())
+		msg, err := outR.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, s, string(msg))
+	}
+}
@@ -0,0 +1,111 @@
+package ndog
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Completer provides completions for input typed in interactive mode.
+type Completer interface {
+	// Complete returns candidate replacements for line, which is the input
+	// before the cursor.
+	Complete(line string) []string
+}
+
+type CompleterFunc func(line string) []string
+
+func (f CompleterFunc) Complete(line string) []string {
+	return f(line)
+}
+
+// LastWord returns the word at the end of line, which is the part replaced by
+// word completion.
+func LastWord(line string) string {
+	i := strings.LastIndexFunc(line, func(r rune) bool {
+		return unicode.IsSpace(r) || strings.ContainsRune("(),;=", r)
+	})
+	return line[i+1:]
+}
+
+// CompleteWords completes the last word of line using words which have it as
+// a case-insensitive prefix. If the word is entirely lowercase, candidates are
+// lowercased to match, e.g. so that SQL keywords can be typed in either case.
+func CompleteWords(line string, words []string) []string {
+	word := LastWord(line)
+	if word == "" {
+		return nil
+	}
+	base := line[:len(line)-len(word)]
+	lower := strings.ToLower(word) == word
+	candidates := []string{}
+	for _, w := range words {
+		if len(w) < len(word) || !strings.EqualFold(w[:len(word)], word) {
+			continue
+		}
+		if lower {
+			w = strings.ToLower(w)
+		}
+		candidates = append(candidates, base+w)
+	}
+	slices.Sort(candidates)
+	return slices.Compact(candidates)
+}
+
+// WordCompleter is a Completer which completes words from a list which can be
+// updated concurrently.
+type WordCompleter struct {
+	mu    sync.Mutex
+	words []string
+}
+
+func NewWordCompleter(words ...string) *WordCompleter {
+	return &WordCompleter{words: words}
+}
+
+func (c *WordCompleter) Complete(line string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CompleteWords(line, c.words)
+}
+
+// SetWords replaces the list of words.
+func (c *WordCompleter) SetWords(words []string) {
+	c.mu.Lock()
+	c.words = words
+	c.mu.Unlock()
+}
+
+// HistoryCompleter is a Completer which completes whole lines from previously
+// added ones, most recent first.
+type HistoryCompleter struct {
+	mu      sync.Mutex
+	history []string
+}
+
+const maxCompleterHistory = 1000
+
+func (c *HistoryCompleter) Add(line string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.history = slices.DeleteFunc(c.history, func(s string) bool {
+		return s == line
+	})
+	c.history = append(c.history, line)
+	if len(c.history) > maxCompleterHistory {
+		c.history = c.history[len(c.history)-maxCompleterHistory:]
+	}
+}
+
+func (c *HistoryCompleter) Complete(line string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	candidates := []string{}
+	for i := len(c.history) - 1; i >= 0; i-- {
+		if strings.HasPrefix(c.history[i], line) && c.history[i] != line {
+			candidates = append(candidates, c.history[i])
+		}
+	}
+	return candidates
+}
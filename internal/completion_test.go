@@ -0,0 +1,26 @@
+package ndog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompleteWords(t *testing.T) {
+	words := []string{"SELECT", "SET", "users", "Content-Type"}
+	assert.Equal(t, []string{"select", "set"}, CompleteWords("se", words))
+	assert.Equal(t, []string{"SELECT"}, CompleteWords("SEL", words))
+	assert.Equal(t, []string{"select * from users"}, CompleteWords("select * from us", words))
+	assert.Equal(t, []string{"count(users"}, CompleteWords("count(u", words))
+	assert.Equal(t, []string{"Content-Type"}, CompleteWords("Con", words))
+	assert.Empty(t, CompleteWords("select ", words))
+}
+
+func TestHistoryCompleter(t *testing.T) {
+	c := HistoryCompleter{}
+	c.Add("hello")
+	c.Add("help")
+	c.Add("hello")
+	assert.Equal(t, []string{"hello", "help"}, c.Complete("he"))
+	assert.Empty(t, c.Complete("hello"))
+}
@@ -0,0 +1,92 @@
+package ndog
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/isobit/ndog/internal/netutil"
+	ndog_tls "github.com/isobit/ndog/internal/tls"
+)
+
+// ConfigFile describes listeners and connectors which are all run in one
+// process, e.g. to mock an environment of several services.
+type ConfigFile struct {
+	Entries []ConfigEntry `yaml:"entries"`
+}
+
+// ConfigEntry is a listener if only Listen is set, a connector if only Connect
+// is set, and a proxy if both are set. Streams are handled by the Exec
+// command if set, or STDIN/STDOUT otherwise, using Data instead of STDIN if it
+// is set.
+type ConfigEntry struct {
+	Name    string          `yaml:"name"`
+	Listen  string          `yaml:"listen"`
+	Connect string          `yaml:"connect"`
+	Options Options         `yaml:"options"`
+	TLS     ndog_tls.Config `yaml:"tls"`
+	Net     netutil.Config  `yaml:"net"`
+	Exec    string          `yaml:"exec"`
+	Data    *string         `yaml:"data"`
+
+	ListenURL  *url.URL `yaml:"-"`
+	ConnectURL *url.URL `yaml:"-"`
+}
+
+// ParseConfigFile parses and validates a YAML config file. Unknown keys are
+// rejected so that typos don't go unnoticed.
+func ParseConfigFile(r io.Reader) (*ConfigFile, error) {
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	var f ConfigFile
+	if err := dec.Decode(&f); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("invalid config file: %w", err)
+	}
+	if len(f.Entries) == 0 {
+		return nil, fmt.Errorf("invalid config file: no entries")
+	}
+	names := map[string]bool{}
+	for i := range f.Entries {
+		e := &f.Entries[i]
+		if err := e.parse(); err != nil {
+			return nil, fmt.Errorf("invalid config file: entry %d: %w", i+1, err)
+		}
+		if names[e.Name] {
+			return nil, fmt.Errorf("invalid config file: duplicate entry name: %s", e.Name)
+		}
+		names[e.Name] = true
+	}
+	return &f, nil
+}
+
+func (e *ConfigEntry) parse() error {
+	var err error
+	if e.Listen != "" {
+		if e.ListenURL, err = url.Parse(e.Listen); err != nil {
+			return fmt.Errorf("invalid listen URL: %w", err)
+		}
+	}
+	if e.Connect != "" {
+		if e.ConnectURL, err = url.Parse(e.Connect); err != nil {
+			return fmt.Errorf("invalid connect URL: %w", err)
+		}
+	}
+	switch {
+	case e.ListenURL == nil && e.ConnectURL == nil:
+		return fmt.Errorf("at least one of listen or connect must be specified")
+	case e.ListenURL != nil && e.ConnectURL != nil && (e.Exec != "" || e.Data != nil):
+		return fmt.Errorf("exec and data can't be used when proxying")
+	case e.Exec != "" && e.Data != nil:
+		return fmt.Errorf("exec and data are mutually exclusive")
+	}
+	if e.Name == "" {
+		e.Name = e.Listen
+		if e.Name == "" {
+			e.Name = e.Connect
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package ndog
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConfigFile(t *testing.T) {
+	f, err := ParseConfigFile(strings.NewReader(`
+entries:
+  - name: api
+    listen: http://localhost:8080
+    exec: ./handler.sh
+    options:
+      status: 201
+    net:
+      idle_timeout: 5s
+  - listen: tcp://localhost:9000
+    connect: tcp://backend:9000
+    tls:
+      skip_verify: true
+`))
+	require.NoError(t, err)
+	require.Len(t, f.Entries, 2)
+
+	api := f.Entries[0]
+	assert.Equal(t, "api", api.Name)
+	assert.Equal(t, "localhost:8080", api.ListenURL.Host)
+	assert.Nil(t, api.ConnectURL)
+	assert.Equal(t, Options{"status": "201"}, api.Options)
+	assert.Equal(t, 5*time.Second, api.Net.IdleTimeout)
+
+	proxy := f.Entries[1]
+	assert.Equal(t, "tcp://localhost:9000", proxy.Name)
+	assert.Equal(t, "backend:9000", proxy.ConnectURL.Host)
+	assert.True(t, proxy.TLS.TLSSkipVerify)
+
+	for _, s := range []string{
+		``,
+		`entries: [{exec: cat}]`,
+		`entries: [{listen: "tcp://a:1", typo: 1}]`,
+		`entries: [{listen: "tcp://a:1", connect: "tcp://b:1", exec: cat}]`,
+		`entries: [{listen: "tcp://a:1"}, {listen: "tcp://a:1"}]`,
+	} {
+		_, err := ParseConfigFile(strings.NewReader(s))
+		assert.Error(t, err, s)
+	}
+}
@@ -3,46 +3,248 @@ package ndog
 import (
 	"bufio"
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"maps"
+	"os"
 	"os/exec"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/isobit/ndog/internal/log"
 )
 
+const execTerminateTimeout = 10 * time.Second
+
+// ExecPolicy determines how new streams are handled once the maximum number of
+// concurrent processes has been reached.
+type ExecPolicy string
+
+const (
+	// ExecPolicyQueue waits for a running process to exit.
+	ExecPolicyQueue ExecPolicy = "queue"
+	// ExecPolicyReject fails new streams immediately.
+	ExecPolicyReject ExecPolicy = "reject"
+	// ExecPolicyShed terminates the oldest running process to make room.
+	ExecPolicyShed ExecPolicy = "shed"
+)
+
+func ParseExecPolicy(s string) (ExecPolicy, error) {
+	switch policy := ExecPolicy(s); policy {
+	case ExecPolicyQueue, ExecPolicyReject, ExecPolicyShed:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown exec policy: %s", s)
+	}
+}
+
+var (
+	ErrExecLimit        = errors.New("exec process limit reached")
+	ErrExecQueueTimeout = errors.New("timed out waiting for exec process slot")
+	ErrExecShutdown     = errors.New("exec is shutting down")
+)
+
+// ExecExitError is the error of a process which exited unsuccessfully.
+type ExecExitError struct {
+	Name string
+	Code int
+}
+
+func (e *ExecExitError) Error() string {
+	return fmt.Sprintf("exec: %s: exit status %d", e.Name, e.Code)
+}
+
+func (e *ExecExitError) ExitCode() int {
+	return e.Code
+}
+
 type ExecStreamManager struct {
 	Args      []string
 	TeeWriter io.Writer
+
+	// MaxProcs limits the number of concurrently running processes if it is
+	// greater than zero, in which case Policy determines what happens to
+	// new streams once the limit has been reached. Queued streams wait for
+	// at most QueueTimeout, or forever if it is zero.
+	MaxProcs     int
+	Policy       ExecPolicy
+	QueueTimeout time.Duration
+
+	mu       sync.Mutex
+	procs    map[*exec.Cmd]*execProc
+	running  int
+	queued   int
+	released chan struct{}
+	exitErr  error
+	// draining is closed by Drain, after which no new processes are
+	// started.
+	draining   chan struct{}
+	isDraining bool
+	isShutDown bool
+}
+
+type execProc struct {
+	started time.Time
+	exited  chan struct{}
+	stream  Stream
+	shed    bool
 }
 
 func NewExecStreamManager(args []string) *ExecStreamManager {
 	return &ExecStreamManager{
-		Args: args,
+		Args:     args,
+		Policy:   ExecPolicyQueue,
+		procs:    map[*exec.Cmd]*execProc{},
+		released: make(chan struct{}),
+		draining: make(chan struct{}),
+	}
+}
+
+func (f *ExecStreamManager) NewStream(name string, meta StreamMetadata) (Stream, error) {
+	if err := f.acquire(name); err != nil {
+		return Stream{}, err
+	}
+	stream, err := f.start(name, meta)
+	if err != nil {
+		f.release()
+		return Stream{}, err
+	}
+	return stream, nil
+}
+
+// acquire reserves a process slot, handling the case where none are free
+// according to the policy.
+func (f *ExecStreamManager) acquire(name string) error {
+	if f.MaxProcs <= 0 {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.isDraining {
+			return ErrExecShutdown
+		}
+		return nil
+	}
+
+	var timeout <-chan time.Time
+	if f.QueueTimeout > 0 {
+		timer := time.NewTimer(f.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	queued := false
+	for {
+		if f.isDraining {
+			return ErrExecShutdown
+		}
+		if f.running < f.MaxProcs {
+			break
+		}
+		switch f.Policy {
+		case ExecPolicyReject:
+			log.Logf(0, "exec: limit of %d reached, rejecting: %s", f.MaxProcs, name)
+			return ErrExecLimit
+		case ExecPolicyShed:
+			f.shedOldest()
+		}
+		if !queued {
+			queued = true
+			f.queued++
+			log.Logf(0, "exec: limit of %d reached, queueing: %s (queue depth %d)", f.MaxProcs, name, f.queued)
+			defer func() {
+				f.queued--
+				log.Logf(1, "exec: dequeued: %s (queue depth %d)", name, f.queued)
+			}()
+		}
+
+		released := f.released
+		f.mu.Unlock()
+		select {
+		case <-released:
+			f.mu.Lock()
+		case <-timeout:
+			f.mu.Lock()
+			return ErrExecQueueTimeout
+		case <-f.draining:
+			f.mu.Lock()
+		}
 	}
+	f.running++
+	return nil
 }
 
-func (f *ExecStreamManager) NewStream(name string) Stream {
+func (f *ExecStreamManager) release() {
+	if f.MaxProcs <= 0 {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.running--
+	close(f.released)
+	f.released = make(chan struct{})
+}
+
+// shedOldest closes the stream of the oldest running process which is not
+// already being shed and terminates it. It must be called with f.mu held.
+func (f *ExecStreamManager) shedOldest() {
+	var oldestCmd *exec.Cmd
+	var oldest *execProc
+	for cmd, proc := range f.procs {
+		if proc.shed {
+			continue
+		}
+		if oldest == nil || proc.started.Before(oldest.started) {
+			oldestCmd, oldest = cmd, proc
+		}
+	}
+	if oldest == nil {
+		return
+	}
+	oldest.shed = true
+
+	log.Logf(0, "exec: limit of %d reached, shedding oldest: %d", f.MaxProcs, oldestCmd.Process.Pid)
+	oldest.stream.Close()
+	oldestCmd.Process.Signal(syscall.SIGTERM)
+	go func() {
+		select {
+		case <-oldest.exited:
+		case <-time.After(execTerminateTimeout):
+			log.Logf(-1, "exec: termination timed out, killing: %d", oldestCmd.Process.Pid)
+			oldestCmd.Process.Kill()
+		}
+	}()
+}
+
+func (f *ExecStreamManager) start(name string, meta StreamMetadata) (Stream, error) {
 	cmd := exec.Command(f.Args[0], f.Args[1:]...)
+	cmd.Env = append(os.Environ(), meta.Env()...)
+	cmd.Env = append(cmd.Env, "NDOG_STREAM="+name)
 
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
-		panic(err)
+		return Stream{}, fmt.Errorf("error creating stdin pipe: %w", err)
 	}
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		panic(err)
+		stdin.Close()
+		return Stream{}, fmt.Errorf("error creating stdout pipe: %w", err)
 	}
 
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
-		panic(err)
+		stdin.Close()
+		stdout.Close()
+		return Stream{}, fmt.Errorf("error creating stderr pipe: %w", err)
 	}
 
 	log.Logf(10, "exec: starting: %s", cmd)
 	if err := cmd.Start(); err != nil {
-		panic(err)
+		return Stream{}, fmt.Errorf("error starting command: %w", err)
 	}
 	log.Logf(10, "exec: started: %d", cmd.Process.Pid)
 
@@ -62,6 +264,34 @@ func (f *ExecStreamManager) NewStream(name string) Stream {
 
 	stdinClosed := make(chan bool)
 	stdoutClosed := make(chan bool)
+	stream := Stream{
+		Reader: FuncReadCloser(stdout, func() error {
+			close(stdoutClosed)
+			log.Logf(10, "exec: closing stdout: %d", cmd.Process.Pid)
+			err := stdout.Close()
+			return err
+		}),
+		Writer: FuncWriteCloser(w, func() error {
+			close(stdinClosed)
+			log.Logf(10, "exec: closing stdin: %d", cmd.Process.Pid)
+			return w.Close()
+		}),
+	}
+
+	exited := make(chan struct{})
+	f.mu.Lock()
+	f.procs[cmd] = &execProc{
+		started: time.Now(),
+		exited:  exited,
+		stream:  stream,
+	}
+	if f.isShutDown {
+		// Shutdown may have missed this process if it started
+		// concurrently.
+		cmd.Process.Signal(syscall.SIGTERM)
+	}
+	f.mu.Unlock()
+
 	go func() {
 		// Wait for reader and writer to be closed.
 		// Must wait for reader/stdin to be closed first or else we'll
@@ -74,7 +304,7 @@ func (f *ExecStreamManager) NewStream(name string) Stream {
 
 		go func() {
 			select {
-			case <-time.After(10 * time.Second):
+			case <-time.After(execTerminateTimeout):
 				log.Logf(10, "exec: terminating: %d", cmd.Process.Pid)
 				cmd.Process.Signal(syscall.SIGTERM)
 			case <-ctx.Done():
@@ -82,7 +312,7 @@ func (f *ExecStreamManager) NewStream(name string) Stream {
 			}
 
 			select {
-			case <-time.After(10 * time.Second):
+			case <-time.After(execTerminateTimeout):
 				log.Logf(-1, "exec: termination timed out, killing: %d", cmd.Process.Pid)
 				cmd.Process.Kill()
 			case <-ctx.Done():
@@ -93,20 +323,95 @@ func (f *ExecStreamManager) NewStream(name string) Stream {
 		log.Logf(10, "exec: waiting: %d", cmd.Process.Pid)
 		cmd.Wait()
 		log.Logf(10, "exec: exited: %d", cmd.Process.Pid)
+
+		f.mu.Lock()
+		delete(f.procs, cmd)
+		if state := cmd.ProcessState; state != nil && !state.Success() {
+			f.exitErr = &ExecExitError{Name: name, Code: exitCode(state)}
+		}
+		f.mu.Unlock()
+		close(exited)
+		f.release()
 	}()
 
-	return Stream{
-		Reader: FuncReadCloser(stdout, func() error {
-			close(stdoutClosed)
-			log.Logf(10, "exec: closing stdout: %d", cmd.Process.Pid)
-			err := stdout.Close()
-			return err
-		}),
-		Writer: FuncWriteCloser(w, func() error {
-			close(stdinClosed)
-			log.Logf(10, "exec: closing stdin: %d", cmd.Process.Pid)
-			return w.Close()
-		}),
+	return stream, nil
+}
+
+// exitCode returns the exit code of a process, or 128 plus the signal number
+// if it was killed by a signal, like shells do.
+func exitCode(state *os.ProcessState) int {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return state.ExitCode()
+}
+
+// Wait waits for all running commands to exit by themselves, which they are
+// made to do once their streams are closed.
+func (f *ExecStreamManager) Wait() {
+	f.mu.Lock()
+	procs := maps.Clone(f.procs)
+	f.mu.Unlock()
+	for _, proc := range procs {
+		<-proc.exited
+	}
+}
+
+// Err returns an ExecExitError for the last command which exited
+// unsuccessfully, if any.
+func (f *ExecStreamManager) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.exitErr
+}
+
+// Drain fails queued and new streams, leaving running commands to finish.
+func (f *ExecStreamManager) Drain() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.isDraining {
+		f.isDraining = true
+		close(f.draining)
+	}
+}
+
+// Shutdown drains, then terminates all running commands with SIGTERM, and then
+// kills any which have not exited within the termination timeout.
+func (f *ExecStreamManager) Shutdown() {
+	f.Drain()
+	f.mu.Lock()
+	f.isShutDown = true
+	procs := maps.Clone(f.procs)
+	f.mu.Unlock()
+
+	if len(procs) == 0 {
+		return
+	}
+
+	for cmd := range procs {
+		log.Logf(10, "exec: terminating: %d", cmd.Process.Pid)
+		cmd.Process.Signal(syscall.SIGTERM)
+	}
+
+	allExited := make(chan struct{})
+	go func() {
+		defer close(allExited)
+		for _, proc := range procs {
+			<-proc.exited
+		}
+	}()
+
+	select {
+	case <-allExited:
+	case <-time.After(execTerminateTimeout):
+		for cmd, proc := range procs {
+			select {
+			case <-proc.exited:
+			default:
+				log.Logf(-1, "exec: termination timed out, killing: %d", cmd.Process.Pid)
+				cmd.Process.Kill()
+			}
+		}
 	}
 }
 
@@ -122,5 +427,5 @@ func (f *ExecStreamManager) NewStream(name string) Stream {
 // 	}
 // }
 
-// func (f *ExecTemplateStreamManager) NewStream(name string) Stream {
+// func (f *ExecTemplateStreamManager) NewStream(name string, meta StreamMetadata) (Stream, error) {
 // }
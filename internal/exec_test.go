@@ -0,0 +1,84 @@
+package ndog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExecStreamManagerLimit(t *testing.T) {
+	newManager := func(policy ExecPolicy) *ExecStreamManager {
+		m := NewExecStreamManager([]string{"cat"})
+		m.MaxProcs = 1
+		m.Policy = policy
+		m.QueueTimeout = 100 * time.Millisecond
+		return m
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		m := newManager(ExecPolicyReject)
+		stream, err := m.NewStream("first", StreamMetadata{})
+		require.NoError(t, err)
+		defer stream.Close()
+
+		_, err = m.NewStream("second", StreamMetadata{})
+		assert.ErrorIs(t, err, ErrExecLimit)
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		m := newManager(ExecPolicyQueue)
+		stream, err := m.NewStream("first", StreamMetadata{})
+		require.NoError(t, err)
+
+		_, err = m.NewStream("second", StreamMetadata{})
+		assert.ErrorIs(t, err, ErrExecQueueTimeout)
+
+		stream.Close()
+		m.QueueTimeout = 0
+		second, err := m.NewStream("second", StreamMetadata{})
+		require.NoError(t, err)
+		second.Close()
+	})
+
+	t.Run("shutdown", func(t *testing.T) {
+		m := newManager(ExecPolicyQueue)
+		m.QueueTimeout = 0
+		stream, err := m.NewStream("first", StreamMetadata{})
+		require.NoError(t, err)
+
+		queued := make(chan error)
+		go func() {
+			_, err := m.NewStream("second", StreamMetadata{})
+			queued <- err
+		}()
+		time.Sleep(50 * time.Millisecond)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			m.Shutdown()
+		}()
+		assert.ErrorIs(t, <-queued, ErrExecShutdown)
+
+		_, err = m.NewStream("third", StreamMetadata{})
+		assert.ErrorIs(t, err, ErrExecShutdown)
+		stream.Close()
+		<-done
+	})
+
+	t.Run("shed", func(t *testing.T) {
+		m := newManager(ExecPolicyShed)
+		m.QueueTimeout = 0
+		first, err := m.NewStream("first", StreamMetadata{})
+		require.NoError(t, err)
+		defer first.Close()
+
+		second, err := m.NewStream("second", StreamMetadata{})
+		require.NoError(t, err)
+		defer second.Close()
+
+		_, err = first.Reader.Read(make([]byte, 1))
+		assert.Error(t, err)
+	})
+}
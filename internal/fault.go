@@ -0,0 +1,369 @@
+package ndog
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/isobit/ndog/internal/log"
+)
+
+// ErrStreamReset is returned by streams to abort them. Schemes which support
+// it should reset the connection, e.g. with a TCP RST, rather than closing it
+// gracefully.
+var ErrStreamReset = errors.New("stream reset")
+
+// ErrStreamRefused is returned by FaultStreamManager for refused streams.
+var ErrStreamRefused = errors.New("stream refused by fault injection")
+
+type FaultKind string
+
+const (
+	// FaultRefuse fails the creation of new streams.
+	FaultRefuse FaultKind = "refuse"
+	// FaultDrop closes the stream.
+	FaultDrop FaultKind = "drop"
+	// FaultReset aborts the stream with ErrStreamReset.
+	FaultReset FaultKind = "reset"
+	// FaultCorrupt flips a random bit in a chunk of data.
+	FaultCorrupt FaultKind = "corrupt"
+	// FaultStall stops data in the direction from flowing until the stream
+	// is closed.
+	FaultStall FaultKind = "stall"
+)
+
+// Fault is a fault to inject into streams.
+type Fault struct {
+	Kind FaultKind
+	// Probability is the chance of the fault being triggered for each
+	// chunk of data, or each new stream for FaultRefuse.
+	Probability float64
+	// After is the number of bytes in a direction after which the fault
+	// may be triggered.
+	After int64
+	// Send and Recv are the directions the fault applies to.
+	Send bool
+	Recv bool
+}
+
+// ParseFault parses a fault spec of the form KIND[:KEY=VALUE,...], with keys p
+// (probability, e.g. 0.1 or 10%; default 1), after (bytes, with k and m
+// suffixes) and dir (send, recv or both; default both).
+func ParseFault(spec string) (Fault, error) {
+	kind, params, _ := strings.Cut(spec, ":")
+	f := Fault{
+		Kind:        FaultKind(kind),
+		Probability: 1,
+		Send:        true,
+		Recv:        true,
+	}
+	switch f.Kind {
+	case FaultRefuse, FaultDrop, FaultReset, FaultCorrupt, FaultStall:
+	default:
+		return f, fmt.Errorf("unknown fault: %s", kind)
+	}
+	if params == "" {
+		return f, nil
+	}
+	for _, kv := range strings.Split(params, ",") {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok {
+			return f, fmt.Errorf("invalid fault %s: expected KEY=VALUE: %s", kind, kv)
+		}
+		var err error
+		switch {
+		case key == "p":
+			f.Probability, err = parseProbability(value)
+		case key == "after" && f.Kind != FaultRefuse:
+			f.After, err = parseSize(value)
+		case key == "dir" && f.Kind != FaultRefuse:
+			switch value {
+			case "send":
+				f.Send, f.Recv = true, false
+			case "recv":
+				f.Send, f.Recv = false, true
+			case "both":
+				f.Send, f.Recv = true, true
+			default:
+				err = fmt.Errorf("expected send, recv or both")
+			}
+		default:
+			return f, fmt.Errorf("invalid fault %s: unknown key: %s", kind, key)
+		}
+		if err != nil {
+			return f, fmt.Errorf("invalid fault %s %s: %w", kind, key, err)
+		}
+	}
+	return f, nil
+}
+
+func parseProbability(s string) (float64, error) {
+	percent := strings.HasSuffix(s, "%")
+	p, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil {
+		return 0, err
+	}
+	if percent {
+		p /= 100
+	}
+	if p < 0 || p > 1 {
+		return 0, fmt.Errorf("must be between 0 and 1")
+	}
+	return p, nil
+}
+
+// FaultStreamManager injects faults into streams created by its delegate, for
+// testing how remotes handle them. Every triggered fault is logged.
+type FaultStreamManager struct {
+	StreamManager
+	Faults []Fault
+}
+
+func (m *FaultStreamManager) NewStream(name string, meta StreamMetadata) (Stream, error) {
+	if m.refuse(name) {
+		return Stream{}, ErrStreamRefused
+	}
+	stream, err := m.StreamManager.NewStream(name, meta)
+	if err != nil {
+		return Stream{}, err
+	}
+	s := &faultStream{
+		name:   name,
+		stream: stream,
+		closed: make(chan struct{}),
+	}
+	return Stream{
+		Reader: &faultReader{
+			faultDirection: s.direction(m.Faults, Send),
+			r:              stream.Reader,
+		},
+		Writer: &faultWriter{
+			faultDirection: s.direction(m.Faults, Recv),
+			w:              stream.Writer,
+		},
+	}, nil
+}
+
+// NewMessageStream injects faults into each message, with probabilities
+// applying per message. Messages are never split, so a message which would
+// be cut short by a drop, reset or stall is discarded as a whole.
+func (m *FaultStreamManager) NewMessageStream(name string, meta StreamMetadata, framing Framing) (MessageStream, error) {
+	if m.refuse(name) {
+		return MessageStream{}, ErrStreamRefused
+	}
+	stream, err := NewMessageStream(m.StreamManager, name, meta, framing)
+	if err != nil {
+		return MessageStream{}, err
+	}
+	s := &faultStream{
+		name:   name,
+		stream: stream,
+		closed: make(chan struct{}),
+	}
+	return MessageStream{
+		Reader: &faultMessageReader{
+			faultDirection: s.direction(m.Faults, Send),
+			r:              stream.Reader,
+		},
+		Writer: &faultMessageWriter{
+			faultDirection: s.direction(m.Faults, Recv),
+			w:              stream.Writer,
+		},
+	}, nil
+}
+
+func (m *FaultStreamManager) refuse(name string) bool {
+	for _, f := range m.Faults {
+		if f.Kind == FaultRefuse && rand.Float64() < f.Probability {
+			log.Logf(0, "fault: refused %s", name)
+			return true
+		}
+	}
+	return false
+}
+
+type faultStream struct {
+	name string
+	// stream is the Stream or MessageStream faults are injected into.
+	stream io.Closer
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (s *faultStream) direction(faults []Fault, dir Direction) *faultDirection {
+	d := &faultDirection{
+		stream: s,
+		dir:    dir,
+	}
+	for _, f := range faults {
+		if f.Kind != FaultRefuse && ((dir == Send && f.Send) || (dir == Recv && f.Recv)) {
+			d.faults = append(d.faults, f)
+		}
+	}
+	return d
+}
+
+func (s *faultStream) close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.stream.Close()
+	})
+}
+
+// faultDirection injects faults into data flowing in one direction.
+type faultDirection struct {
+	stream *faultStream
+	dir    Direction
+	faults []Fault
+	count  int64
+	// err is returned once a fault has been triggered.
+	err error
+}
+
+// apply returns the data of p to pass through, which may be corrupted, and an
+// error to return afterwards if a fault was triggered.
+func (d *faultDirection) apply(p []byte) ([]byte, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	start := d.count
+	d.count += int64(len(p))
+	for _, f := range d.faults {
+		if d.count <= f.After || rand.Float64() >= f.Probability {
+			continue
+		}
+		// Data before the After threshold is unaffected.
+		cut := max(0, int(f.After-start))
+		if f.Kind == FaultCorrupt {
+			log.Logf(0, "fault: corrupt %s%s after %d bytes", d.dir.Arrow(), d.stream.name, start+int64(cut))
+			p = corrupt(p, cut)
+			continue
+		}
+		d.err = d.trigger(f.Kind, start+int64(cut))
+		return p[:cut], d.err
+	}
+	return p, nil
+}
+
+func (d *faultDirection) trigger(kind FaultKind, offset int64) error {
+	log.Logf(0, "fault: %s %s%s after %d bytes", kind, d.dir.Arrow(), d.stream.name, offset)
+	switch kind {
+	case FaultReset:
+		// Leave closing to the scheme, so that the stream isn't closed
+		// gracefully first.
+		return ErrStreamReset
+	case FaultStall:
+		<-d.stream.closed
+		return io.ErrClosedPipe
+	default:
+		d.stream.close()
+		return io.ErrClosedPipe
+	}
+}
+
+// corrupt returns a copy of p with a random bit flipped at or after start.
+func corrupt(p []byte, start int) []byte {
+	if start >= len(p) {
+		return p
+	}
+	p = append([]byte(nil), p...)
+	i := start + rand.IntN(len(p)-start)
+	p[i] ^= 1 << rand.IntN(8)
+	return p
+}
+
+type faultReader struct {
+	*faultDirection
+	r       io.Reader
+	pending error
+}
+
+func (r *faultReader) Read(p []byte) (int, error) {
+	if r.pending != nil {
+		return 0, r.pending
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		out, ferr := r.apply(p[:n])
+		n = copy(p, out)
+		if ferr != nil {
+			if n > 0 {
+				r.pending = ferr
+				return n, nil
+			}
+			return 0, ferr
+		}
+	}
+	return n, err
+}
+
+func (r *faultReader) Close() error {
+	r.stream.close()
+	return nil
+}
+
+type faultWriter struct {
+	*faultDirection
+	w io.WriteCloser
+}
+
+func (w *faultWriter) Write(p []byte) (int, error) {
+	out, ferr := w.apply(p)
+	if len(out) > 0 {
+		if _, err := w.w.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	if ferr != nil {
+		return len(out), ferr
+	}
+	return len(p), nil
+}
+
+func (w *faultWriter) Close() error {
+	return w.w.Close()
+}
+
+type faultMessageReader struct {
+	*faultDirection
+	r MessageReader
+}
+
+func (r *faultMessageReader) ReadMessage() ([]byte, error) {
+	msg, err := r.r.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	out, ferr := r.apply(msg)
+	if ferr != nil {
+		return nil, ferr
+	}
+	return out, nil
+}
+
+func (r *faultMessageReader) Close() error {
+	r.stream.close()
+	return nil
+}
+
+type faultMessageWriter struct {
+	*faultDirection
+	w MessageWriteCloser
+}
+
+func (w *faultMessageWriter) WriteMessage(msg []byte) error {
+	out, ferr := w.apply(msg)
+	if ferr != nil {
+		return ferr
+	}
+	return w.w.WriteMessage(out)
+}
+
+func (w *faultMessageWriter) Close() error {
+	return w.w.Close()
+}
@@ -0,0 +1,97 @@
+package ndog
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFault(t *testing.T) {
+	f, err := ParseFault("reset:p=10%,after=1k,dir=recv")
+	require.NoError(t, err)
+	assert.Equal(t, Fault{Kind: FaultReset, Probability: 0.1, After: 1024, Recv: true}, f)
+
+	f, err = ParseFault("stall")
+	require.NoError(t, err)
+	assert.Equal(t, Fault{Kind: FaultStall, Probability: 1, Send: true, Recv: true}, f)
+
+	for _, spec := range []string{"explode", "drop:p=2", "drop:dir=up", "refuse:after=1", "drop:after"} {
+		_, err := ParseFault(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestFaultStreamManager(t *testing.T) {
+	newStream := func(faults ...Fault) (Stream, *bytes.Buffer) {
+		var out bytes.Buffer
+		m := &FaultStreamManager{
+			StreamManager: fixedStreamManager{Stream{
+				Reader: io.NopCloser(strings.NewReader("0123456789")),
+				Writer: NopWriteCloser(&out),
+			}},
+			Faults: faults,
+		}
+		stream, err := m.NewStream("test", StreamMetadata{})
+		require.NoError(t, err)
+		return stream, &out
+	}
+
+	stream, _ := newStream(Fault{Kind: FaultReset, Probability: 1, After: 4, Send: true})
+	sent, err := io.ReadAll(stream.Reader)
+	assert.ErrorIs(t, err, ErrStreamReset)
+	assert.Equal(t, "0123", string(sent))
+
+	stream, out := newStream(Fault{Kind: FaultDrop, Probability: 1, After: 3, Recv: true})
+	n, err := stream.Writer.Write([]byte("abcdef"))
+	assert.Equal(t, 3, n)
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+	assert.Equal(t, "abc", out.String())
+
+	stream, out = newStream(Fault{Kind: FaultCorrupt, Probability: 1, After: 2, Recv: true})
+	stream.Writer.Write([]byte("abcdef"))
+	assert.Equal(t, "ab", out.String()[:2])
+	assert.NotEqual(t, "abcdef", out.String())
+
+	_, err = (&FaultStreamManager{
+		Faults: []Fault{{Kind: FaultRefuse, Probability: 1}},
+	}).NewStream("test", StreamMetadata{})
+	assert.ErrorIs(t, err, ErrStreamRefused)
+}
+
+func TestFaultStreamManagerMessages(t *testing.T) {
+	r, w := MessagePipe()
+	outR, outW := MessagePipe()
+	m := &FaultStreamManager{
+		StreamManager: fixedMessageStreamManager{MessageStream{Reader: r, Writer: outW}},
+		Faults: []Fault{
+			{Kind: FaultCorrupt, Probability: 1, After: 2, Send: true},
+			{Kind: FaultDrop, Probability: 1, After: 3, Recv: true},
+		},
+	}
+	stream, err := m.NewMessageStream("test", StreamMetadata{}, LineFraming)
+	require.NoError(t, err)
+
+	go w.WriteMessage([]byte("ab"))
+	msg, err := stream.Reader.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "ab", string(msg))
+	go w.WriteMessage([]byte("cd"))
+	msg, err = stream.Reader.ReadMessage()
+	require.NoError(t, err)
+	assert.NotEqual(t, "cd", string(msg))
+
+	go func() {
+		msg, err := outR.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, "ab", string(msg))
+	}()
+	require.NoError(t, stream.Writer.WriteMessage([]byte("ab")))
+	// The message crossing the threshold is discarded rather than cut short.
+	assert.ErrorIs(t, stream.Writer.WriteMessage([]byte("cdef")), io.ErrClosedPipe)
+	_, err = outR.ReadMessage()
+	assert.ErrorIs(t, err, io.EOF)
+}
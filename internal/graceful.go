@@ -0,0 +1,87 @@
+package ndog
+
+import (
+	"io"
+	"sync"
+
+	"github.com/isobit/ndog/internal/log"
+)
+
+// GracefulStreamManager keeps track of open streams created by its delegate
+// so that they can all be forcibly closed once a shutdown grace period has
+// elapsed.
+type GracefulStreamManager struct {
+	StreamManager
+
+	mu      sync.Mutex
+	nextID  int
+	streams map[int]io.Closer
+}
+
+func NewGracefulStreamManager(delegate StreamManager) *GracefulStreamManager {
+	return &GracefulStreamManager{
+		StreamManager: delegate,
+		streams:       map[int]io.Closer{},
+	}
+}
+
+func (m *GracefulStreamManager) NewStream(name string, meta StreamMetadata) (Stream, error) {
+	stream, err := m.StreamManager.NewStream(name, meta)
+	if err != nil {
+		return Stream{}, err
+	}
+	untrack := m.track(stream)
+	return Stream{
+		Reader: FuncReadCloser(stream.Reader, func() error {
+			untrack()
+			return stream.Reader.Close()
+		}),
+		Writer: stream.Writer,
+	}, nil
+}
+
+func (m *GracefulStreamManager) NewMessageStream(name string, meta StreamMetadata, framing Framing) (MessageStream, error) {
+	stream, err := NewMessageStream(m.StreamManager, name, meta, framing)
+	if err != nil {
+		return MessageStream{}, err
+	}
+	untrack := m.track(stream)
+	return MessageStream{
+		Reader: messageReadCloser{
+			MessageReader: stream.Reader,
+			Closer: closerFunc(func() error {
+				untrack()
+				return stream.Reader.Close()
+			}),
+		},
+		Writer: stream.Writer,
+	}, nil
+}
+
+func (m *GracefulStreamManager) track(stream io.Closer) (untrack func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := m.nextID
+	m.nextID++
+	m.streams[id] = stream
+	return func() {
+		m.mu.Lock()
+		delete(m.streams, id)
+		m.mu.Unlock()
+	}
+}
+
+// CloseAll closes every stream which is still open and returns how many there
+// were.
+func (m *GracefulStreamManager) CloseAll() int {
+	m.mu.Lock()
+	streams := m.streams
+	m.streams = map[int]io.Closer{}
+	m.mu.Unlock()
+
+	for _, stream := range streams {
+		stream.Close()
+	}
+	log.Logf(10, "closed %d stream(s)", len(streams))
+	return len(streams)
+}
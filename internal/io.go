@@ -184,6 +184,19 @@ func MultiWriteCloser(writerClosers ...io.WriteCloser) io.WriteCloser {
 		return nil
 	})
 }
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
 func NopWriteCloser(w io.Writer) io.WriteCloser {
 	return nopWriteCloser{Writer: w}
 }
@@ -0,0 +1,91 @@
+package ndog
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrStreamLimit is returned for new streams once a LimitStreamManager's limit
+// has been reached.
+var ErrStreamLimit = errors.New("stream limit reached")
+
+// LimitStreamManager creates at most Max streams with its delegate, and calls
+// Done once all of them have been closed.
+type LimitStreamManager struct {
+	StreamManager
+	Max  int
+	Done func()
+
+	mu      sync.Mutex
+	created int
+	closed  int
+}
+
+func (m *LimitStreamManager) NewStream(name string, meta StreamMetadata) (Stream, error) {
+	if err := m.acquire(); err != nil {
+		return Stream{}, err
+	}
+	stream, err := m.StreamManager.NewStream(name, meta)
+	if err != nil {
+		m.cancel()
+		return Stream{}, err
+	}
+	var once sync.Once
+	return Stream{
+		Reader: FuncReadCloser(stream.Reader, func() error {
+			defer once.Do(m.release)
+			return stream.Reader.Close()
+		}),
+		Writer: stream.Writer,
+	}, nil
+}
+
+func (m *LimitStreamManager) NewMessageStream(name string, meta StreamMetadata, framing Framing) (MessageStream, error) {
+	if err := m.acquire(); err != nil {
+		return MessageStream{}, err
+	}
+	stream, err := NewMessageStream(m.StreamManager, name, meta, framing)
+	if err != nil {
+		m.cancel()
+		return MessageStream{}, err
+	}
+	var once sync.Once
+	return MessageStream{
+		Reader: messageReadCloser{
+			MessageReader: stream.Reader,
+			Closer: closerFunc(func() error {
+				defer once.Do(m.release)
+				return stream.Reader.Close()
+			}),
+		},
+		Writer: stream.Writer,
+	}, nil
+}
+
+func (m *LimitStreamManager) acquire() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.created >= m.Max {
+		return ErrStreamLimit
+	}
+	m.created++
+	return nil
+}
+
+// cancel undoes acquire if creating the stream failed, so that it doesn't count
+// towards the limit.
+func (m *LimitStreamManager) cancel() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.created--
+}
+
+func (m *LimitStreamManager) release() {
+	m.mu.Lock()
+	m.closed++
+	done := m.created == m.Max && m.closed == m.created
+	m.mu.Unlock()
+	if done && m.Done != nil {
+		m.Done()
+	}
+}
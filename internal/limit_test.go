@@ -0,0 +1,38 @@
+package ndog
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimitStreamManager(t *testing.T) {
+	done := 0
+	m := &LimitStreamManager{
+		StreamManager: fixedStreamManager{Stream{
+			Reader: io.NopCloser(strings.NewReader("")),
+			Writer: NopWriteCloser(&bytes.Buffer{}),
+		}},
+		Max: 2,
+		Done: func() {
+			done++
+		},
+	}
+
+	first, err := m.NewStream("first", StreamMetadata{})
+	require.NoError(t, err)
+	second, err := m.NewMessageStream("second", StreamMetadata{}, LineFraming)
+	require.NoError(t, err)
+	_, err = m.NewStream("third", StreamMetadata{})
+	assert.ErrorIs(t, err, ErrStreamLimit)
+
+	first.Close()
+	first.Close()
+	assert.Equal(t, 0, done)
+	second.Close()
+	assert.Equal(t, 1, done)
+}
@@ -1,30 +1,155 @@
 package log
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 )
 
+// Format determines how log lines are written.
+type Format string
+
+const (
+	// FormatText writes just the message; fields are omitted.
+	FormatText Format = "text"
+	// FormatJSON writes a JSON object per line, with time, level and msg keys
+	// followed by the fields.
+	FormatJSON Format = "json"
+)
+
+func ParseFormat(s string) (Format, error) {
+	switch format := Format(s); format {
+	case FormatText, FormatJSON:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown log format: %s", s)
+	}
+}
+
 var Log io.Writer = os.Stderr
 var LogLevel int = 0
 var LogColor bool = false
+var LogFormat Format = FormatText
 
 var Logf func(int, string, ...interface{}) (int, error) = defaultLogf
 
 func defaultLogf(level int, format string, v ...interface{}) (int, error) {
+	return Logger{}.Logf(level, format, v...)
+}
+
+// Logger logs with fields attached, such as the scheme and stream a message
+// relates to.
+type Logger struct {
+	// fields are alternating keys and values.
+	fields []any
+}
+
+// With returns a Logger with the given alternating keys and values as fields.
+func With(kv ...any) Logger {
+	return Logger{}.With(kv...)
+}
+
+// With returns a copy of l with the given alternating keys and values added to
+// its fields.
+func (l Logger) With(kv ...any) Logger {
+	return Logger{fields: append(slices.Clip(l.fields), kv...)}
+}
+
+func (l Logger) Logf(level int, format string, v ...interface{}) (int, error) {
 	if level > LogLevel {
 		return 0, nil
 	}
+	msg := format
+	if len(v) > 0 {
+		msg = fmt.Sprintf(format, v...)
+	}
+	msg = strings.TrimSuffix(msg, "\n")
+
+	var buf bytes.Buffer
+	if LogFormat == FormatJSON {
+		writeJSON(&buf, level, msg, l.fields)
+	} else {
+		writeText(&buf, level, msg)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return Log.Write(buf.Bytes())
+}
+
+// mu serializes writes so that lines from concurrent streams don't interleave.
+var mu sync.Mutex
+
+func levelName(level int) string {
+	switch {
+	case level < 0:
+		return "error"
+	case level == 0:
+		return "info"
+	default:
+		return "debug"
+	}
+}
+
+func writeText(buf *bytes.Buffer, level int, msg string) {
 	if LogColor {
 		if level >= 0 {
-			format = "\u001b[30;1m" + format + "\u001b[0m"
+			buf.WriteString("\u001b[30;1m")
 		} else {
-			format = "\u001b[31;1m" + format + "\u001b[0m"
+			buf.WriteString("\u001b[31;1m")
 		}
 	}
-	if len(format) > 0 && format[len(format)-1] != '\n' {
-		format = format + "\n"
+	buf.WriteString(msg)
+	if LogColor {
+		buf.WriteString("\u001b[0m")
+	}
+	buf.WriteByte('\n')
+}
+
+func writeJSON(buf *bytes.Buffer, level int, msg string, fields []any) {
+	buf.WriteString(`{"time":`)
+	writeJSONValue(buf, time.Now().Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSONValue(buf, levelName(level))
+	buf.WriteString(`,"msg":`)
+	writeJSONValue(buf, msg)
+	for i := 0; i < len(fields); i += 2 {
+		buf.WriteByte(',')
+		writeJSONValue(buf, fmt.Sprint(fields[i]))
+		buf.WriteByte(':')
+		writeJSONValue(buf, fieldValue(fields, i+1))
+	}
+	buf.WriteString("}\n")
+}
+
+func writeJSONValue(buf *bytes.Buffer, v any) {
+	switch x := v.(type) {
+	case error:
+		v = x.Error()
+	case fmt.Stringer:
+		v = x.String()
+	}
+	var data bytes.Buffer
+	enc := json.NewEncoder(&data)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		data.Reset()
+		enc.Encode(fmt.Sprint(v))
+	}
+	// Encode terminates values with a newline.
+	buf.Write(bytes.TrimSuffix(data.Bytes(), []byte{'\n'}))
+}
+
+// fieldValue returns the value at index i, or nil if a key is missing its
+// value.
+func fieldValue(fields []any, i int) any {
+	if i < len(fields) {
+		return fields[i]
 	}
-	return fmt.Fprintf(Log, format, v...)
+	return nil
 }
@@ -0,0 +1,72 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func capture(t *testing.T, format Format) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	prevLog, prevLevel, prevColor, prevFormat := Log, LogLevel, LogColor, LogFormat
+	Log, LogLevel, LogColor, LogFormat = buf, 0, false, format
+	t.Cleanup(func() {
+		Log, LogLevel, LogColor, LogFormat = prevLog, prevLevel, prevColor, prevFormat
+	})
+	return buf
+}
+
+func TestLoggerText(t *testing.T) {
+	buf := capture(t, FormatText)
+
+	logger := With("scheme", "tcp", "stream", "127.0.0.1:1234")
+	logger.With("bytes", 5, "err", errors.New("broken pipe")).Logf(-1, "closed: %s", "127.0.0.1:1234")
+	logger.Logf(1, "not logged")
+	Logf(0, "plain\n")
+
+	// Fields are only written in JSON, so that text lines are unchanged.
+	assert.Equal(t, "closed: 127.0.0.1:1234\nplain\n", buf.String())
+}
+
+func TestLoggerJSON(t *testing.T) {
+	buf := capture(t, FormatJSON)
+
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	With("scheme", "tcp", "remote_addr", addr, "bytes", 5).Logf(0, "<-connected: %s", addr)
+
+	var line map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.NotEmpty(t, line["time"])
+	delete(line, "time")
+	assert.Equal(t, map[string]any{
+		"level":       "info",
+		"msg":         "<-connected: 127.0.0.1:1234",
+		"scheme":      "tcp",
+		"remote_addr": "127.0.0.1:1234",
+		"bytes":       float64(5),
+	}, line)
+}
+
+func TestLoggerWithDoesNotShareFields(t *testing.T) {
+	buf := capture(t, FormatJSON)
+
+	base := With("a", 1)
+	base.With("b", 2).Logf(0, "one")
+	base.With("c", 3).Logf(0, "two")
+
+	dec := json.NewDecoder(buf)
+	for _, want := range []map[string]any{
+		{"level": "info", "msg": "one", "a": float64(1), "b": float64(2)},
+		{"level": "info", "msg": "two", "a": float64(1), "c": float64(3)},
+	} {
+		var line map[string]any
+		require.NoError(t, dec.Decode(&line))
+		delete(line, "time")
+		assert.Equal(t, want, line)
+	}
+}
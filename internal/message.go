@@ -0,0 +1,311 @@
+package ndog
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+)
+
+type MessageReader interface {
+	ReadMessage() ([]byte, error)
+}
+
+// MessageWriter writes whole messages. Implementations may retain the message
+// after WriteMessage returns, so callers must not modify it afterwards.
+type MessageWriter interface {
+	WriteMessage([]byte) error
+}
+
+type MessageReadCloser interface {
+	MessageReader
+	io.Closer
+}
+
+type MessageWriteCloser interface {
+	MessageWriter
+	io.Closer
+}
+
+// MessageStream is like Stream, but reads and writes whole messages so that
+// message boundaries are preserved, e.g. for datagrams or WebSocket messages.
+type MessageStream struct {
+	Reader MessageReadCloser
+	Writer MessageWriteCloser
+}
+
+func (stream MessageStream) Close() error {
+	stream.Reader.Close()
+	stream.Writer.Close()
+	return nil
+}
+
+// CloseWrite half-closes the stream by closing only its writer; see
+// Stream.CloseWrite.
+func (stream MessageStream) CloseWrite() error {
+	return stream.Writer.Close()
+}
+
+// MessageStreamManager is implemented by stream managers which can handle
+// message streams natively instead of having them adapted to byte streams.
+// The framing is used if the stream ends up being adapted anyway, e.g. by a
+// wrapping stream manager whose delegate does not support messages.
+type MessageStreamManager interface {
+	NewMessageStream(name string, meta StreamMetadata, framing Framing) (MessageStream, error)
+}
+
+// NewMessageStream creates a new message stream using the stream manager,
+// natively if it implements MessageStreamManager, or otherwise by adapting a
+// byte stream using the given framing.
+func NewMessageStream(m StreamManager, name string, meta StreamMetadata, framing Framing) (MessageStream, error) {
+	if mm, ok := m.(MessageStreamManager); ok {
+		return mm.NewMessageStream(name, meta, framing)
+	}
+	stream, err := m.NewStream(name, meta)
+	if err != nil {
+		return MessageStream{}, err
+	}
+	return StreamMessages(stream, framing), nil
+}
+
+// Framing determines how message boundaries are represented when adapting
+// between message streams and byte streams.
+type Framing int
+
+const (
+	// LineFraming delimits messages with newlines.
+	LineFraming Framing = iota
+	// RawFraming does not delimit messages at all; each read from the byte
+	// stream is treated as a message, and messages are written as-is.
+	RawFraming
+)
+
+// maxRawMessageSize is the buffer size used to read raw framed messages; it is
+// the maximum possible UDP packet size.
+const maxRawMessageSize = 65535
+
+// StreamMessages adapts a byte stream into a message stream.
+func StreamMessages(stream Stream, framing Framing) MessageStream {
+	var r MessageReader
+	var w MessageWriter
+	switch framing {
+	case RawFraming:
+		r = &rawMessageReader{r: stream.Reader, buf: make([]byte, maxRawMessageSize)}
+		w = rawMessageWriter{w: stream.Writer}
+	default:
+		r = lineMessageReader{r: bufio.NewReader(stream.Reader)}
+		w = lineMessageWriter{w: stream.Writer}
+	}
+	return MessageStream{
+		Reader: messageReadCloser{MessageReader: r, Closer: stream.Reader},
+		Writer: messageWriteCloser{MessageWriter: w, Closer: stream.Writer},
+	}
+}
+
+// MessageStreamBytes adapts a message stream into a byte stream.
+func MessageStreamBytes(stream MessageStream, framing Framing) Stream {
+	return Stream{
+		Reader: &messageByteReader{r: stream.Reader, framing: framing},
+		Writer: &messageByteWriter{w: stream.Writer, framing: framing},
+	}
+}
+
+type messageReadCloser struct {
+	MessageReader
+	io.Closer
+}
+
+type messageWriteCloser struct {
+	MessageWriter
+	io.Closer
+}
+
+type lineMessageReader struct {
+	r *bufio.Reader
+}
+
+func (lr lineMessageReader) ReadMessage() ([]byte, error) {
+	line, err := lr.r.ReadBytes('\n')
+	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			return line, nil
+		}
+		return nil, err
+	}
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte{'\r'})
+	return line, nil
+}
+
+type lineMessageWriter struct {
+	w io.Writer
+}
+
+func (lw lineMessageWriter) WriteMessage(msg []byte) error {
+	_, err := lw.w.Write(append(msg[:len(msg):len(msg)], '\n'))
+	return err
+}
+
+type rawMessageReader struct {
+	r   io.Reader
+	buf []byte
+}
+
+func (rr *rawMessageReader) ReadMessage() ([]byte, error) {
+	n, err := rr.r.Read(rr.buf)
+	if n > 0 {
+		return bytes.Clone(rr.buf[:n]), nil
+	}
+	return nil, err
+}
+
+type rawMessageWriter struct {
+	w io.Writer
+}
+
+func (rw rawMessageWriter) WriteMessage(msg []byte) error {
+	_, err := rw.w.Write(msg)
+	return err
+}
+
+type messageByteReader struct {
+	r       MessageReadCloser
+	framing Framing
+	buf     []byte
+}
+
+func (br *messageByteReader) Read(p []byte) (int, error) {
+	for len(br.buf) == 0 {
+		msg, err := br.r.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		if br.framing == LineFraming {
+			msg = append(msg[:len(msg):len(msg)], '\n')
+		}
+		br.buf = msg
+	}
+	n := copy(p, br.buf)
+	br.buf = br.buf[n:]
+	return n, nil
+}
+
+func (br *messageByteReader) Close() error {
+	return br.r.Close()
+}
+
+type messageByteWriter struct {
+	w       MessageWriteCloser
+	framing Framing
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (bw *messageByteWriter) Write(p []byte) (int, error) {
+	if bw.framing == RawFraming {
+		if err := bw.w.WriteMessage(bytes.Clone(p)); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	bw.buf = append(bw.buf, p...)
+	for {
+		i := bytes.IndexByte(bw.buf, '\n')
+		if i < 0 {
+			break
+		}
+		msg := bytes.TrimSuffix(bw.buf[:i], []byte{'\r'})
+		if err := bw.w.WriteMessage(bytes.Clone(msg)); err != nil {
+			return 0, err
+		}
+		bw.buf = bw.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Close flushes any incomplete trailing line as a final message before
+// closing the underlying writer.
+func (bw *messageByteWriter) Close() error {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	if len(bw.buf) > 0 {
+		msg := bw.buf
+		bw.buf = nil
+		if err := bw.w.WriteMessage(msg); err != nil && !IsIOClosedErr(err) {
+			bw.w.Close()
+			return err
+		}
+	}
+	return bw.w.Close()
+}
+
+// MessagePipe creates a synchronous in-memory message pipe, analogous to
+// io.Pipe. Each write blocks until the message is read or the pipe is closed.
+func MessagePipe() (MessageReadCloser, MessageWriteCloser) {
+	p := &messagePipe{
+		ch:         make(chan []byte),
+		readerDone: make(chan struct{}),
+		writerDone: make(chan struct{}),
+	}
+	return messagePipeReader{p}, messagePipeWriter{p}
+}
+
+type messagePipe struct {
+	ch         chan []byte
+	readerDone chan struct{}
+	writerDone chan struct{}
+	readerOnce sync.Once
+	writerOnce sync.Once
+}
+
+type messagePipeReader struct {
+	p *messagePipe
+}
+
+func (r messagePipeReader) ReadMessage() ([]byte, error) {
+	select {
+	case msg := <-r.p.ch:
+		return msg, nil
+	case <-r.p.readerDone:
+		return nil, io.ErrClosedPipe
+	case <-r.p.writerDone:
+		return nil, io.EOF
+	}
+}
+
+func (r messagePipeReader) Close() error {
+	r.p.readerOnce.Do(func() {
+		close(r.p.readerDone)
+	})
+	return nil
+}
+
+type messagePipeWriter struct {
+	p *messagePipe
+}
+
+func (w messagePipeWriter) WriteMessage(msg []byte) error {
+	select {
+	case <-w.p.writerDone:
+		return io.ErrClosedPipe
+	default:
+	}
+	select {
+	case w.p.ch <- msg:
+		return nil
+	case <-w.p.readerDone:
+		return io.ErrClosedPipe
+	case <-w.p.writerDone:
+		return io.ErrClosedPipe
+	}
+}
+
+func (w messagePipeWriter) Close() error {
+	w.p.writerOnce.Do(func() {
+		close(w.p.writerDone)
+	})
+	return nil
+}
@@ -0,0 +1,59 @@
+package ndog
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamMessagesLineFraming(t *testing.T) {
+	var out bytes.Buffer
+	stream := StreamMessages(Stream{
+		Reader: io.NopCloser(bytes.NewBufferString("one\r\ntwo\nthree")),
+		Writer: NopWriteCloser(&out),
+	}, LineFraming)
+
+	for _, expected := range []string{"one", "two", "three"} {
+		msg, err := stream.Reader.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(msg))
+	}
+	_, err := stream.Reader.ReadMessage()
+	assert.Equal(t, io.EOF, err)
+
+	require.NoError(t, stream.Writer.WriteMessage([]byte("hello")))
+	assert.Equal(t, "hello\n", out.String())
+}
+
+func TestMessageStreamBytes(t *testing.T) {
+	listenReader, listenWriter := MessagePipe()
+	connectReader, connectWriter := MessagePipe()
+	stream := MessageStreamBytes(MessageStream{
+		Reader: connectReader,
+		Writer: listenWriter,
+	}, LineFraming)
+
+	go func() {
+		connectWriter.WriteMessage([]byte("a"))
+		connectWriter.WriteMessage([]byte("b"))
+		connectWriter.Close()
+	}()
+	data, err := io.ReadAll(stream.Reader)
+	require.NoError(t, err)
+	assert.Equal(t, "a\nb\n", string(data))
+
+	go func() {
+		stream.Writer.Write([]byte("x\ny"))
+		stream.Writer.Close()
+	}()
+	for _, expected := range []string{"x", "y"} {
+		msg, err := listenReader.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(msg))
+	}
+	_, err = listenReader.ReadMessage()
+	assert.Equal(t, io.EOF, err)
+}
@@ -0,0 +1,149 @@
+package ndog
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// StreamMetadata describes the origin of a stream. Schemes fill in whichever
+// fields are relevant to them.
+type StreamMetadata struct {
+	Scheme     string `json:"scheme,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	LocalAddr  string `json:"local_addr,omitempty"`
+
+	TLS  *TLSMetadata  `json:"tls,omitempty"`
+	HTTP *HTTPMetadata `json:"http,omitempty"`
+	SSH  *SSHMetadata  `json:"ssh,omitempty"`
+	DNS  *DNSMetadata  `json:"dns,omitempty"`
+}
+
+type TLSMetadata struct {
+	Version        string `json:"version,omitempty"`
+	CipherSuite    string `json:"cipher_suite,omitempty"`
+	ServerName     string `json:"server_name,omitempty"`
+	PeerCommonName string `json:"peer_common_name,omitempty"`
+}
+
+func NewTLSMetadata(state tls.ConnectionState) *TLSMetadata {
+	m := &TLSMetadata{
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ServerName:  state.ServerName,
+	}
+	if len(state.PeerCertificates) > 0 {
+		m.PeerCommonName = state.PeerCertificates[0].Subject.CommonName
+	}
+	return m
+}
+
+type HTTPMetadata struct {
+	Method string      `json:"method,omitempty"`
+	URI    string      `json:"uri,omitempty"`
+	Path   string      `json:"path,omitempty"`
+	Query  string      `json:"query,omitempty"`
+	Proto  string      `json:"proto,omitempty"`
+	Host   string      `json:"host,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+}
+
+func NewHTTPMetadata(r *http.Request) *HTTPMetadata {
+	return &HTTPMetadata{
+		Method: r.Method,
+		URI:    r.RequestURI,
+		Path:   r.URL.Path,
+		Query:  r.URL.RawQuery,
+		Proto:  r.Proto,
+		Host:   r.Host,
+		Header: r.Header,
+	}
+}
+
+// NewHTTPStreamMetadata returns metadata for a stream handling an HTTP
+// request received by a server.
+func NewHTTPStreamMetadata(scheme string, r *http.Request) StreamMetadata {
+	meta := StreamMetadata{
+		Scheme:     scheme,
+		RemoteAddr: r.RemoteAddr,
+		HTTP:       NewHTTPMetadata(r),
+	}
+	if localAddr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		meta.LocalAddr = localAddr.String()
+	}
+	if r.TLS != nil {
+		meta.TLS = NewTLSMetadata(*r.TLS)
+	}
+	return meta
+}
+
+type SSHMetadata struct {
+	User    string `json:"user,omitempty"`
+	Command string `json:"command,omitempty"`
+}
+
+type DNSMetadata struct {
+	ID    uint16 `json:"id"`
+	Name  string `json:"name,omitempty"`
+	Class string `json:"class,omitempty"`
+	Type  string `json:"type,omitempty"`
+}
+
+// Env returns the metadata as CGI-style environment variables, e.g.
+// NDOG_REMOTE_ADDR and NDOG_HTTP_METHOD. Unset fields are omitted. HTTP
+// headers are included as NDOG_HTTP_HEADER_<NAME>, with the name uppercased
+// and dashes replaced with underscores.
+func (m StreamMetadata) Env() []string {
+	env := []string{}
+	add := func(key string, value string) {
+		if value != "" {
+			env = append(env, fmt.Sprintf("NDOG_%s=%s", key, value))
+		}
+	}
+
+	add("SCHEME", m.Scheme)
+	add("REMOTE_ADDR", m.RemoteAddr)
+	add("LOCAL_ADDR", m.LocalAddr)
+
+	if m.TLS != nil {
+		add("TLS_VERSION", m.TLS.Version)
+		add("TLS_CIPHER_SUITE", m.TLS.CipherSuite)
+		add("TLS_SERVER_NAME", m.TLS.ServerName)
+		add("TLS_PEER_COMMON_NAME", m.TLS.PeerCommonName)
+	}
+
+	if m.HTTP != nil {
+		add("HTTP_METHOD", m.HTTP.Method)
+		add("HTTP_URI", m.HTTP.URI)
+		add("HTTP_PATH", m.HTTP.Path)
+		add("HTTP_QUERY", m.HTTP.Query)
+		add("HTTP_PROTO", m.HTTP.Proto)
+		add("HTTP_HOST", m.HTTP.Host)
+		keys := make([]string, 0, len(m.HTTP.Header))
+		for key := range m.HTTP.Header {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			name := strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+			add("HTTP_HEADER_"+name, strings.Join(m.HTTP.Header[key], ", "))
+		}
+	}
+
+	if m.SSH != nil {
+		add("SSH_USER", m.SSH.User)
+		add("SSH_COMMAND", m.SSH.Command)
+	}
+
+	if m.DNS != nil {
+		add("DNS_ID", fmt.Sprintf("%d", m.DNS.ID))
+		add("DNS_NAME", m.DNS.Name)
+		add("DNS_CLASS", m.DNS.Class)
+		add("DNS_TYPE", m.DNS.Type)
+	}
+
+	return env
+}
@@ -0,0 +1,31 @@
+package ndog
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamMetadataEnv(t *testing.T) {
+	meta := StreamMetadata{
+		Scheme:     "http",
+		RemoteAddr: "127.0.0.1:5555",
+		HTTP: &HTTPMetadata{
+			Method: "POST",
+			Path:   "/x",
+			Header: http.Header{
+				"Content-Type": []string{"text/plain"},
+				"X-Multi":      []string{"a", "b"},
+			},
+		},
+	}
+	assert.Equal(t, []string{
+		"NDOG_SCHEME=http",
+		"NDOG_REMOTE_ADDR=127.0.0.1:5555",
+		"NDOG_HTTP_METHOD=POST",
+		"NDOG_HTTP_PATH=/x",
+		"NDOG_HTTP_HEADER_CONTENT_TYPE=text/plain",
+		"NDOG_HTTP_HEADER_X_MULTI=a, b",
+	}, meta.Env())
+}
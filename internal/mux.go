@@ -0,0 +1,324 @@
+package ndog
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/isobit/ndog/internal/log"
+)
+
+const (
+	EnvelopeOpen  = "open"
+	EnvelopeData  = "data"
+	EnvelopeClose = "close"
+)
+
+// Envelope is a single event for a stream multiplexed by a MuxStreamManager.
+// Data is base64 encoded when marshaled as JSON.
+type Envelope struct {
+	Stream string          `json:"stream"`
+	Event  string          `json:"event"`
+	Data   []byte          `json:"data,omitempty"`
+	Meta   *StreamMetadata `json:"meta,omitempty"`
+	TS     *time.Time      `json:"ts,omitempty"`
+}
+
+// MuxStreamManager multiplexes all of its streams over a single pair of byte
+// streams as JSON lines envelopes. Each stream is identified by its name,
+// suffixed with a number if the name is already in use.
+//
+// An "open" envelope (including the stream metadata) is written when a stream
+// is created, followed by a "data" envelope for each write to the stream and a
+// "close" envelope once the stream is done writing. Envelopes read by Route
+// are handled the same way in reverse: "data" is read from the stream, and
+// "close" ends it.
+type MuxStreamManager struct {
+	writeMu sync.Mutex
+	enc     *json.Encoder
+
+	mu       sync.Mutex
+	streams  map[string]*muxStream
+	closed   bool
+	closeErr error
+}
+
+// ErrMuxStreamBehind ends streams which have fallen too far behind in reading
+// the data routed to them.
+var ErrMuxStreamBehind = errors.New("stream fell behind")
+
+// muxQueueSize is the number of envelopes which may be queued for a stream.
+const muxQueueSize = 256
+
+// muxStream queues data routed to a stream, so that a stream which is slow to
+// read it doesn't hold up routing to the others.
+type muxStream struct {
+	id         string
+	write      func([]byte) error
+	closeWrite func() error
+	abort      func()
+
+	mu     sync.Mutex
+	queue  chan []byte
+	closed bool
+}
+
+func newMuxStream(write func([]byte) error, closeWrite func() error, abort func()) *muxStream {
+	return &muxStream{
+		write:      write,
+		closeWrite: closeWrite,
+		abort:      abort,
+		queue:      make(chan []byte, muxQueueSize),
+	}
+}
+
+func (s *muxStream) run() {
+	var err error
+	for p := range s.queue {
+		// Anything after an error is discarded.
+		if err == nil {
+			if err = s.write(p); err != nil {
+				log.Logf(1, "mux: %s: %s", s.id, err)
+			}
+		}
+	}
+	if err == nil {
+		s.closeWrite()
+	}
+}
+
+// enqueue returns false if the queue is full. It never blocks, so that
+// routing is never held up.
+func (s *muxStream) enqueue(p []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return true
+	}
+	select {
+	case s.queue <- p:
+		return true
+	default:
+		return false
+	}
+}
+
+// close ends the stream once the data queued so far has been written.
+func (s *muxStream) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+}
+
+func NewMuxStreamManager(w io.Writer) *MuxStreamManager {
+	return &MuxStreamManager{
+		enc:     json.NewEncoder(w),
+		streams: map[string]*muxStream{},
+	}
+}
+
+func (m *MuxStreamManager) NewStream(name string, meta StreamMetadata) (Stream, error) {
+	pr, pw := io.Pipe()
+	id, err := m.open(name, meta, newMuxStream(func(p []byte) error {
+		_, err := pw.Write(p)
+		return err
+	}, pw.Close, func() {
+		pw.CloseWithError(ErrMuxStreamBehind)
+	}))
+	if err != nil {
+		return Stream{}, err
+	}
+	closeWrite := m.closeWriteFunc(id)
+	return Stream{
+		Reader: FuncReadCloser(pr, func() error {
+			m.remove(id)
+			closeWrite()
+			return pr.Close()
+		}),
+		Writer: FuncWriteCloser(muxWriter{m: m, id: id}, closeWrite),
+	}, nil
+}
+
+func (m *MuxStreamManager) NewMessageStream(name string, meta StreamMetadata, framing Framing) (MessageStream, error) {
+	pr, pw := MessagePipe()
+	id, err := m.open(name, meta, newMuxStream(pw.WriteMessage, pw.Close, func() {
+		pr.Close()
+	}))
+	if err != nil {
+		return MessageStream{}, err
+	}
+	closeWrite := m.closeWriteFunc(id)
+	return MessageStream{
+		Reader: messageReadCloser{
+			MessageReader: pr,
+			Closer: closerFunc(func() error {
+				m.remove(id)
+				closeWrite()
+				return pr.Close()
+			}),
+		},
+		Writer: messageWriteCloser{
+			MessageWriter: muxMessageWriter{m: m, id: id},
+			Closer:        closerFunc(closeWrite),
+		},
+	}, nil
+}
+
+func (m *MuxStreamManager) open(name string, meta StreamMetadata, s *muxStream) (string, error) {
+	m.mu.Lock()
+	if m.closed && m.closeErr != nil {
+		m.mu.Unlock()
+		return "", m.closeErr
+	}
+	id := name
+	for i := 2; m.streams[id] != nil; i++ {
+		id = fmt.Sprintf("%s#%d", name, i)
+	}
+	s.id = id
+	go s.run()
+	if m.closed {
+		s.close()
+	} else {
+		m.streams[id] = s
+	}
+	m.mu.Unlock()
+
+	if err := m.send(Envelope{Stream: id, Event: EnvelopeOpen, Meta: &meta}); err != nil {
+		m.remove(id)
+		return "", err
+	}
+	return id, nil
+}
+
+func (m *MuxStreamManager) remove(id string) {
+	m.mu.Lock()
+	delete(m.streams, id)
+	m.mu.Unlock()
+}
+
+// closeWriteFunc returns a function which sends a close envelope for the
+// stream the first time it is called.
+func (m *MuxStreamManager) closeWriteFunc(id string) func() error {
+	return sync.OnceValue(func() error {
+		err := m.send(Envelope{Stream: id, Event: EnvelopeClose})
+		if err != nil && IsIOClosedErr(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+func (m *MuxStreamManager) send(env Envelope) error {
+	ts := time.Now()
+	env.TS = &ts
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	return m.enc.Encode(env)
+}
+
+// Route reads envelopes from r and routes them to their streams until r is
+// done. Envelopes without a stream are broadcast to all open streams.
+// Malformed envelopes and envelopes for unknown streams are logged and
+// skipped. Data is queued for each stream, and streams which fall too far
+// behind in reading it are ended with ErrMuxStreamBehind rather than holding up
+// the others.
+func (m *MuxStreamManager) Route(r io.Reader) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			var env Envelope
+			if err := json.Unmarshal(line, &env); err != nil {
+				log.Logf(-1, "mux: invalid envelope: %s", err)
+			} else {
+				m.route(env)
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func (m *MuxStreamManager) route(env Envelope) {
+	if env.Stream == "" {
+		m.mu.Lock()
+		streams := maps.Clone(m.streams)
+		m.mu.Unlock()
+		for id := range streams {
+			env.Stream = id
+			m.route(env)
+		}
+		return
+	}
+
+	m.mu.Lock()
+	s, ok := m.streams[env.Stream]
+	m.mu.Unlock()
+	if !ok {
+		log.Logf(1, "mux: unknown stream: %s", env.Stream)
+		return
+	}
+
+	switch env.Event {
+	case EnvelopeData, "":
+		if !s.enqueue(env.Data) {
+			log.Logf(-1, "mux: %s: %s, closing", env.Stream, ErrMuxStreamBehind)
+			m.remove(env.Stream)
+			s.abort()
+			s.close()
+		}
+	case EnvelopeClose:
+		s.close()
+	default:
+		log.Logf(-1, "mux: unknown event: %s: %s", env.Stream, env.Event)
+	}
+}
+
+// Close ends all streams as if a close envelope had been routed to each of
+// them. If err is nil, any new streams are ended immediately, otherwise
+// creating new streams fails with err.
+func (m *MuxStreamManager) Close(err error) {
+	m.mu.Lock()
+	streams := m.streams
+	m.streams = map[string]*muxStream{}
+	m.closed = true
+	m.closeErr = err
+	m.mu.Unlock()
+
+	for _, s := range streams {
+		s.close()
+	}
+}
+
+type muxWriter struct {
+	m  *MuxStreamManager
+	id string
+}
+
+func (w muxWriter) Write(p []byte) (int, error) {
+	if err := w.m.send(Envelope{Stream: w.id, Event: EnvelopeData, Data: p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+type muxMessageWriter struct {
+	m  *MuxStreamManager
+	id string
+}
+
+func (w muxMessageWriter) WriteMessage(msg []byte) error {
+	return w.m.send(Envelope{Stream: w.id, Event: EnvelopeData, Data: msg})
+}
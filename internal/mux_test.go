@@ -0,0 +1,106 @@
+package ndog
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/conc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMuxStreamManager(t *testing.T) {
+	out, outW := io.Pipe()
+	m := NewMuxStreamManager(outW)
+	envelopes := bufio.NewScanner(out)
+	next := func() Envelope {
+		require.True(t, envelopes.Scan())
+		var env Envelope
+		require.NoError(t, json.Unmarshal(envelopes.Bytes(), &env))
+		return env
+	}
+
+	var first, second Stream
+	go func() {
+		var err error
+		first, err = m.NewStream("client", StreamMetadata{Scheme: "tcp"})
+		assert.NoError(t, err)
+		second, err = m.NewStream("client", StreamMetadata{})
+		assert.NoError(t, err)
+		first.Writer.Write([]byte("hello"))
+		first.Writer.Close()
+	}()
+
+	env := next()
+	assert.Equal(t, "client", env.Stream)
+	assert.Equal(t, EnvelopeOpen, env.Event)
+	assert.Equal(t, "tcp", env.Meta.Scheme)
+	assert.Equal(t, "client#2", next().Stream)
+	env = next()
+	assert.Equal(t, EnvelopeData, env.Event)
+	assert.Equal(t, "hello", string(env.Data))
+	assert.Equal(t, EnvelopeClose, next().Event)
+
+	go m.Route(strings.NewReader(
+		`{"stream":"client#2","event":"data","data":"aGk="}` + "\n" +
+			`{"stream":"client#2","event":"close"}` + "\n",
+	))
+	data, err := io.ReadAll(second.Reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hi", string(data))
+}
+
+func TestMuxStreamManagerBroadcast(t *testing.T) {
+	m := NewMuxStreamManager(io.Discard)
+	first, err := m.NewStream("first", StreamMetadata{})
+	require.NoError(t, err)
+	second, err := m.NewStream("second", StreamMetadata{})
+	require.NoError(t, err)
+
+	go m.Route(strings.NewReader(`{"data":"aGk="}` + "\n" + `{"event":"close"}` + "\n"))
+	wg := conc.WaitGroup{}
+	for _, stream := range []Stream{first, second} {
+		wg.Go(func() {
+			data, err := io.ReadAll(stream.Reader)
+			assert.NoError(t, err)
+			assert.Equal(t, "hi", string(data))
+		})
+	}
+	wg.Wait()
+}
+
+func TestMuxStreamManagerSlowStream(t *testing.T) {
+	m := NewMuxStreamManager(io.Discard)
+	stuck, err := m.NewStream("stuck", StreamMetadata{})
+	require.NoError(t, err)
+	defer stuck.Close()
+	other, err := m.NewStream("other", StreamMetadata{})
+	require.NoError(t, err)
+
+	// The stuck stream is never read, which mustn't hold up the other one,
+	// so it is ended as soon as its queue is full.
+	var input strings.Builder
+	for i := 0; i < 2*muxQueueSize; i++ {
+		input.WriteString(`{"stream":"stuck","data":"aGk="}` + "\n")
+	}
+	input.WriteString(`{"stream":"other","data":"aGk="}` + "\n")
+	input.WriteString(`{"stream":"other","event":"close"}` + "\n")
+	routed := make(chan error, 1)
+	go func() { routed <- m.Route(strings.NewReader(input.String())) }()
+
+	select {
+	case err := <-routed:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("routing was held up by the stuck stream")
+	}
+	data, err := io.ReadAll(other.Reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hi", string(data))
+	_, err = io.ReadAll(stuck.Reader)
+	assert.ErrorIs(t, err, ErrMuxStreamBehind)
+}
@@ -2,12 +2,31 @@ package netutil
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net"
 	"syscall"
+	"time"
+)
+
+var (
+	// ErrConnectTimeout is returned when a connection isn't established
+	// within the ConnectTimeout.
+	ErrConnectTimeout = errors.New("connect timeout")
+	// ErrIdleTimeout is returned when no data is sent or received on a
+	// stream within the IdleTimeout.
+	ErrIdleTimeout = errors.New("idle timeout")
+	// ErrTimeout is returned when a stream is open for longer than the
+	// Timeout.
+	ErrTimeout = errors.New("timeout")
 )
 
 type Config struct {
-	ReusePort bool `cli:"name=reuseport"`
+	ReusePort bool `cli:"name=reuseport" yaml:"reuseport"`
+
+	ConnectTimeout time.Duration `cli:"help=maximum time to wait for a connection to be established; 0 waits forever" yaml:"connect_timeout"`
+	IdleTimeout    time.Duration `cli:"help=close streams once no data has been sent or received for this long; 0 disables" yaml:"idle_timeout"`
+	Timeout        time.Duration `cli:"help=close streams once they have been open for this long; 0 disables" yaml:"timeout"`
 }
 
 func (cfg Config) ListenConfig() net.ListenConfig {
@@ -23,12 +42,35 @@ func (cfg Config) ListenConfig() net.ListenConfig {
 	}
 }
 
-func (cfg Config) Listen(network, address string) (net.Listener, error) {
+func (cfg Config) Listen(ctx context.Context, network, address string) (net.Listener, error) {
 	listenCfg := cfg.ListenConfig()
-	return listenCfg.Listen(context.Background(), network, address)
+	return listenCfg.Listen(ctx, network, address)
 }
 
-func (cfg Config) ListenPacket(network, address string) (net.PacketConn, error) {
+func (cfg Config) ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
 	listenCfg := cfg.ListenConfig()
-	return listenCfg.ListenPacket(context.Background(), network, address)
+	return listenCfg.ListenPacket(ctx, network, address)
+}
+
+// Connect calls connect with ctx limited by the ConnectTimeout, returning an
+// error wrapping ErrConnectTimeout if it is exceeded. The context passed to
+// connect must only be used to establish the connection.
+func Connect[T any](ctx context.Context, cfg Config, connect func(context.Context) (T, error)) (T, error) {
+	if cfg.ConnectTimeout <= 0 {
+		return connect(ctx)
+	}
+	ctx, cancel := context.WithTimeoutCause(ctx, cfg.ConnectTimeout, ErrConnectTimeout)
+	defer cancel()
+	v, err := connect(ctx)
+	if err != nil && errors.Is(context.Cause(ctx), ErrConnectTimeout) {
+		return v, fmt.Errorf("%w after %s", ErrConnectTimeout, cfg.ConnectTimeout)
+	}
+	return v, err
+}
+
+func (cfg Config) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return Connect(ctx, cfg, func(ctx context.Context) (net.Conn, error) {
+		dialer := net.Dialer{}
+		return dialer.DialContext(ctx, network, address)
+	})
 }
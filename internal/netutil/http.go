@@ -0,0 +1,45 @@
+package netutil
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/isobit/ndog/internal/log"
+)
+
+// ServeHTTP listens on the server's address and serves requests until ctx is
+// cancelled, at which point the server stops accepting new connections and
+// waits for in-flight requests to complete before returning. TLS is used if
+// the server has a TLSConfig.
+func (cfg Config) ServeHTTP(ctx context.Context, s *http.Server) error {
+	listener, err := cfg.Listen(ctx, "tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	log.With("addr", listener.Addr()).Logf(0, "listening: %s", listener.Addr())
+	if s.IdleTimeout == 0 {
+		s.IdleTimeout = cfg.IdleTimeout
+	}
+
+	shutdownDone := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(shutdownDone)
+		log.Logf(1, "shutting down: %s", listener.Addr())
+		if err := s.Shutdown(context.Background()); err != nil {
+			log.Logf(-1, "shutdown error: %s", err)
+		}
+	})
+	defer stop()
+
+	if s.TLSConfig != nil {
+		err = s.ServeTLS(listener, "", "")
+	} else {
+		err = s.Serve(listener)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		<-shutdownDone
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,16 @@
+package ndog
+
+// PrefixStreamManager prefixes the names of new streams with Prefix, e.g. to
+// tell apart the streams of several listeners sharing a stream manager.
+type PrefixStreamManager struct {
+	StreamManager
+	Prefix string
+}
+
+func (m PrefixStreamManager) NewStream(name string, meta StreamMetadata) (Stream, error) {
+	return m.StreamManager.NewStream(m.Prefix+name, meta)
+}
+
+func (m PrefixStreamManager) NewMessageStream(name string, meta StreamMetadata, framing Framing) (MessageStream, error) {
+	return NewMessageStream(m.StreamManager, m.Prefix+name, meta, framing)
+}
@@ -0,0 +1,36 @@
+package ndog
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type namesStreamManager struct {
+	names *[]string
+}
+
+func (m namesStreamManager) NewStream(name string, meta StreamMetadata) (Stream, error) {
+	*m.names = append(*m.names, name)
+	return Stream{
+		Reader: io.NopCloser(strings.NewReader("")),
+		Writer: NopWriteCloser(&bytes.Buffer{}),
+	}, nil
+}
+
+func TestPrefixStreamManager(t *testing.T) {
+	var names []string
+	m := PrefixStreamManager{
+		StreamManager: namesStreamManager{&names},
+		Prefix:        "tcp://:8000|",
+	}
+	_, err := m.NewStream("127.0.0.1:1234", StreamMetadata{})
+	require.NoError(t, err)
+	_, err = m.NewMessageStream("127.0.0.1:5678", StreamMetadata{}, LineFraming)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"tcp://:8000|127.0.0.1:1234", "tcp://:8000|127.0.0.1:5678"}, names)
+}
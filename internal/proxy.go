@@ -1,6 +1,7 @@
 package ndog
 
 import (
+	"context"
 	"io"
 
 	"github.com/isobit/ndog/internal/log"
@@ -8,52 +9,87 @@ import (
 
 type ProxyStreamManager struct {
 	ConnectConfig Config
-	Connect       func(ConnectConfig) error
+	Connect       func(context.Context, ConnectConfig) error
 }
 
-func (f ProxyStreamManager) NewStream(name string) Stream {
+func (f ProxyStreamManager) NewStream(name string, meta StreamMetadata) (Stream, error) {
 	log.Logf(10, "creating proxy pipe: %s", name)
 
+	// Each side's writer is the other side's reader, so half-closing one side
+	// of the proxy propagates as EOF to the other.
 	listenReader, listenWriter := io.Pipe()
 	connectReader, connectWriter := io.Pipe()
 
+	// The connection is tied to the lifetime of the listen stream rather than
+	// to shutdown of the listener, so that it can be drained gracefully.
+	ctx, cancel := context.WithCancel(context.Background())
+
 	listenStream := Stream{
-		Reader: connectReader,
+		Reader: FuncReadCloser(connectReader, func() error {
+			cancel()
+			return connectReader.Close()
+		}),
 		Writer: listenWriter,
-		// CloseWriterFunc: listenWriter.Close,
-		// CloseFunc: func() error {
-		// 	Logf(10, "closing proxy listen stream: %s", name)
-		// 	return listenWriter.Close()
-		// },
 	}
 	connectStream := Stream{
 		Reader: listenReader,
 		Writer: connectWriter,
-		// CloseWriterFunc: connectWriter.Close,
-		// CloseFunc: func() error {
-		// 	Logf(10, "closing proxy connect stream: %s", name)
-		// 	return connectWriter.Close()
-		// },
 	}
 
-	go func() {
-		defer connectWriter.Close()
-		cfg := ConnectConfig{
-			Config: f.ConnectConfig,
-			Stream: connectStream,
-		}
-		if err := f.Connect(cfg); err != nil {
-			log.Logf(-1, "connect error: %s", err)
-		}
-	}()
-
-	return listenStream
+	go f.connect(ctx, cancel, ConnectConfig{
+		Config: f.ConnectConfig,
+		Stream: connectStream,
+	})
+
+	return listenStream, nil
+}
+
+func (f ProxyStreamManager) NewMessageStream(name string, meta StreamMetadata, framing Framing) (MessageStream, error) {
+	log.Logf(10, "creating proxy message pipe: %s", name)
+
+	listenReader, listenWriter := MessagePipe()
+	connectReader, connectWriter := MessagePipe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	listenStream := MessageStream{
+		Reader: messageReadCloser{
+			MessageReader: connectReader,
+			Closer: closerFunc(func() error {
+				cancel()
+				return connectReader.Close()
+			}),
+		},
+		Writer: listenWriter,
+	}
+	connectStream := MessageStream{
+		Reader: listenReader,
+		Writer: connectWriter,
+	}
+
+	// Schemes which only deal in bytes can still use the connect stream, but
+	// messages are passed through as-is to those which support them.
+	go f.connect(ctx, cancel, ConnectConfig{
+		Config:   f.ConnectConfig,
+		Stream:   MessageStreamBytes(connectStream, framing),
+		Messages: &connectStream,
+	})
+
+	return listenStream, nil
+}
+
+func (f ProxyStreamManager) connect(ctx context.Context, cancel context.CancelFunc, cfg ConnectConfig) {
+	defer cancel()
+	defer cfg.Stream.Writer.Close()
+	if err := f.Connect(ctx, cfg); err != nil && ctx.Err() == nil {
+		log.Logf(-1, "connect error: %s", err)
+	}
 }
 
 type proxyPipe struct {
 	stream Stream
 }
 
-func (p proxyPipe) NewStream(name string) Stream {
-	return p.stream
+func (p proxyPipe) NewStream(name string, meta StreamMetadata) (Stream, error) {
+	return p.stream, nil
 }
@@ -0,0 +1,175 @@
+package ndog
+
+import (
+	"context"
+	"io"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/isobit/ndog/internal/log"
+)
+
+// Backoff computes exponentially increasing delays between attempts.
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+
+	failures int
+}
+
+// Next returns the delay before the next attempt: Initial, doubled for each
+// consecutive failure after the first, capped at Max, less a random jitter of
+// up to half.
+func (b *Backoff) Next() time.Duration {
+	d := b.Initial << min(max(b.failures-1, 0), 32)
+	if d <= 0 || (b.Max > 0 && d > b.Max) {
+		d = b.Max
+	}
+	return d - rand.N(d/2+1)
+}
+
+func (b *Backoff) Failure() {
+	b.failures++
+}
+
+func (b *Backoff) Reset() {
+	b.failures = 0
+}
+
+// Reconnect calls connect repeatedly until ctx is cancelled, waiting between
+// attempts according to backoff, which is reset whenever connect returns
+// without an error, e.g. after a connection was established and later closed.
+// Each attempt is given a view of stream which shares its data, but which can
+// be closed without closing stream itself.
+func Reconnect(ctx context.Context, stream Stream, backoff *Backoff, connect func(context.Context, Stream) error) error {
+	shared := newSharedReader(stream.Reader)
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			log.With("attempt", attempt).Logf(0, "reconnecting: attempt %d", attempt)
+		}
+		view := shared.view()
+		err := connect(ctx, Stream{
+			Reader: view,
+			Writer: NopWriteCloser(stream.Writer),
+		})
+		view.Close()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			log.With("attempt", attempt).Logf(-1, "connect error: %s", err)
+			backoff.Failure()
+		} else {
+			backoff.Reset()
+		}
+
+		delay := backoff.Next()
+		log.With("delay", delay).Logf(0, "reconnecting in %s", delay.Round(time.Millisecond))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// sharedReader reads from r in the background, handing data to whichever
+// view is currently reading, so that no data is lost when a view is closed.
+type sharedReader struct {
+	chunks chan []byte
+	done   chan struct{}
+	err    error
+
+	mu      sync.Mutex
+	pending []byte
+}
+
+func newSharedReader(r io.Reader) *sharedReader {
+	s := &sharedReader{
+		chunks: make(chan []byte),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		for {
+			buf := make([]byte, 32*1024)
+			n, err := r.Read(buf)
+			if n > 0 {
+				s.chunks <- buf[:n]
+			}
+			if err != nil {
+				s.err = err
+				close(s.done)
+				return
+			}
+		}
+	}()
+	return s
+}
+
+func (s *sharedReader) view() *sharedReaderView {
+	return &sharedReaderView{
+		s:      s,
+		closed: make(chan struct{}),
+	}
+}
+
+type sharedReaderView struct {
+	s         *sharedReader
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (v *sharedReaderView) Read(p []byte) (int, error) {
+	select {
+	case <-v.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	if n := v.readPending(p); n > 0 {
+		return n, nil
+	}
+	select {
+	case chunk := <-v.s.chunks:
+		select {
+		case <-v.closed:
+			// Leave the data for the next view.
+			v.s.mu.Lock()
+			v.s.pending = append(chunk, v.s.pending...)
+			v.s.mu.Unlock()
+			return 0, io.ErrClosedPipe
+		default:
+		}
+		n := copy(p, chunk)
+		if n < len(chunk) {
+			v.s.mu.Lock()
+			v.s.pending = append(chunk[n:], v.s.pending...)
+			v.s.mu.Unlock()
+		}
+		return n, nil
+	case <-v.s.done:
+		// The background reader only finishes once its last chunk has
+		// been taken, but it may still be pending.
+		if n := v.readPending(p); n > 0 {
+			return n, nil
+		}
+		return 0, v.s.err
+	case <-v.closed:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+func (v *sharedReaderView) readPending(p []byte) int {
+	v.s.mu.Lock()
+	defer v.s.mu.Unlock()
+	n := copy(p, v.s.pending)
+	v.s.pending = v.s.pending[n:]
+	return n
+}
+
+func (v *sharedReaderView) Close() error {
+	v.closeOnce.Do(func() {
+		close(v.closed)
+	})
+	return nil
+}
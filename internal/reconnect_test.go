@@ -0,0 +1,62 @@
+package ndog
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	b := &Backoff{Initial: 100 * time.Millisecond, Max: time.Second}
+	for _, max := range []time.Duration{100, 100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		d := b.Next()
+		assert.LessOrEqual(t, d, max)
+		assert.GreaterOrEqual(t, d, max/2)
+		b.Failure()
+	}
+	b.Reset()
+	assert.LessOrEqual(t, b.Next(), 100*time.Millisecond)
+}
+
+func TestReconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var out bytes.Buffer
+	stream := Stream{
+		Reader: io.NopCloser(iotest.OneByteReader(strings.NewReader("one\ntwo\nthree\n"))),
+		Writer: NopWriteCloser(&out),
+	}
+	var lines []string
+	attempts := 0
+	err := Reconnect(ctx, stream, &Backoff{}, func(ctx context.Context, stream Stream) error {
+		defer stream.Close()
+		attempts++
+		if attempts == 2 {
+			return errors.New("refused")
+		}
+		// Read a single line per connection, leaving the rest of the
+		// data for later connections.
+		line, err := bufio.NewReaderSize(stream.Reader, 16).ReadString('\n')
+		if err != nil {
+			cancel()
+			return err
+		}
+		lines = append(lines, line)
+		stream.Writer.Write([]byte(line))
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 5, attempts)
+	assert.Equal(t, []string{"one\n", "two\n", "three\n"}, lines)
+	assert.Equal(t, "one\ntwo\nthree\n", out.String())
+}
@@ -0,0 +1,207 @@
+package ndog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/isobit/ndog/internal/log"
+)
+
+const (
+	// RecordOpen is recorded when a stream is created, with its metadata.
+	RecordOpen = "open"
+	// RecordRecv is recorded for data received from the remote, i.e.
+	// written to the stream.
+	RecordRecv = "recv"
+	// RecordSend is recorded for data sent to the remote, i.e. read from
+	// the stream.
+	RecordSend = "send"
+	// RecordEOF is recorded when the remote is done sending.
+	RecordEOF = "eof"
+	// RecordClose is recorded when the stream is closed.
+	RecordClose = "close"
+)
+
+// Record is a single entry of a recording, which is a file of JSON lines with
+// one Record each. Records for different streams are interleaved, and can be
+// told apart by their session and ID, since a recording may be appended to by
+// multiple sessions. Data is base64 encoded, and for message streams each
+// record contains exactly one message.
+type Record struct {
+	Time    int64           `json:"ts"`
+	Session int64           `json:"session"`
+	ID      int             `json:"id"`
+	Stream  string          `json:"stream"`
+	Event   string          `json:"event"`
+	Data    []byte          `json:"data,omitempty"`
+	Meta    *StreamMetadata `json:"meta,omitempty"`
+}
+
+// RecordStreamManager records all streams created by its delegate, see Record.
+type RecordStreamManager struct {
+	StreamManager
+
+	session int64
+
+	mu     sync.Mutex
+	enc    *json.Encoder
+	nextID int
+}
+
+func NewRecordStreamManager(delegate StreamManager, w io.Writer) *RecordStreamManager {
+	return &RecordStreamManager{
+		StreamManager: delegate,
+		session:       time.Now().UnixNano(),
+		enc:           json.NewEncoder(w),
+		nextID:        1,
+	}
+}
+
+func (m *RecordStreamManager) NewStream(name string, meta StreamMetadata) (Stream, error) {
+	stream, err := m.StreamManager.NewStream(name, meta)
+	if err != nil {
+		return Stream{}, err
+	}
+	record := m.open(name, meta)
+	return Stream{
+		Reader: &recordingReader{
+			ReadCloser: stream.Reader,
+			record:     record,
+		},
+		Writer: &recordingWriter{
+			WriteCloser: stream.Writer,
+			record:      record,
+		},
+	}, nil
+}
+
+func (m *RecordStreamManager) NewMessageStream(name string, meta StreamMetadata, framing Framing) (MessageStream, error) {
+	stream, err := NewMessageStream(m.StreamManager, name, meta, framing)
+	if err != nil {
+		return MessageStream{}, err
+	}
+	record := m.open(name, meta)
+	return MessageStream{
+		Reader: &recordingMessageReader{
+			MessageReadCloser: stream.Reader,
+			record:            record,
+		},
+		Writer: &recordingMessageWriter{
+			MessageWriteCloser: stream.Writer,
+			record:             record,
+		},
+	}, nil
+}
+
+// open records a new stream, and returns a function to record its events.
+func (m *RecordStreamManager) open(name string, meta StreamMetadata) func(event string, data []byte) {
+	m.mu.Lock()
+	id := m.nextID
+	m.nextID++
+	m.mu.Unlock()
+
+	record := func(event string, data []byte) {
+		r := Record{
+			Time:    time.Now().UnixNano(),
+			Session: m.session,
+			ID:      id,
+			Stream:  name,
+			Event:   event,
+			Data:    data,
+		}
+		if event == RecordOpen {
+			r.Meta = &meta
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if err := m.enc.Encode(r); err != nil {
+			log.Logf(-1, "record error: %s", err)
+		}
+	}
+	record(RecordOpen, nil)
+	return record
+}
+
+type recordingReader struct {
+	io.ReadCloser
+	record    func(string, []byte)
+	closeOnce sync.Once
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.record(RecordSend, bytes.Clone(p[:n]))
+	}
+	return n, err
+}
+
+func (r *recordingReader) Close() error {
+	r.closeOnce.Do(func() {
+		r.record(RecordClose, nil)
+	})
+	return r.ReadCloser.Close()
+}
+
+type recordingWriter struct {
+	io.WriteCloser
+	record    func(string, []byte)
+	closeOnce sync.Once
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	if n > 0 {
+		w.record(RecordRecv, bytes.Clone(p[:n]))
+	}
+	return n, err
+}
+
+func (w *recordingWriter) Close() error {
+	w.closeOnce.Do(func() {
+		w.record(RecordEOF, nil)
+	})
+	return w.WriteCloser.Close()
+}
+
+type recordingMessageReader struct {
+	MessageReadCloser
+	record    func(string, []byte)
+	closeOnce sync.Once
+}
+
+func (r *recordingMessageReader) ReadMessage() ([]byte, error) {
+	msg, err := r.MessageReadCloser.ReadMessage()
+	if err == nil {
+		r.record(RecordSend, msg)
+	}
+	return msg, err
+}
+
+func (r *recordingMessageReader) Close() error {
+	r.closeOnce.Do(func() {
+		r.record(RecordClose, nil)
+	})
+	return r.MessageReadCloser.Close()
+}
+
+type recordingMessageWriter struct {
+	MessageWriteCloser
+	record    func(string, []byte)
+	closeOnce sync.Once
+}
+
+func (w *recordingMessageWriter) WriteMessage(msg []byte) error {
+	w.record(RecordRecv, msg)
+	return w.MessageWriteCloser.WriteMessage(msg)
+}
+
+func (w *recordingMessageWriter) Close() error {
+	w.closeOnce.Do(func() {
+		w.record(RecordEOF, nil)
+	})
+	return w.MessageWriteCloser.Close()
+}
@@ -0,0 +1,50 @@
+package ndog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fixedStreamManager struct {
+	stream Stream
+}
+
+func (m fixedStreamManager) NewStream(name string, meta StreamMetadata) (Stream, error) {
+	return m.stream, nil
+}
+
+func TestRecordStreamManager(t *testing.T) {
+	var out, recording bytes.Buffer
+	m := NewRecordStreamManager(fixedStreamManager{Stream{
+		Reader: io.NopCloser(strings.NewReader("response")),
+		Writer: NopWriteCloser(&out),
+	}}, &recording)
+
+	stream, err := m.NewStream("client", StreamMetadata{Scheme: "tcp"})
+	require.NoError(t, err)
+	stream.Writer.Write([]byte("request"))
+	stream.Writer.Close()
+	io.ReadAll(stream.Reader)
+	stream.Reader.Close()
+	assert.Equal(t, "request", out.String())
+
+	events := []string{}
+	dec := json.NewDecoder(&recording)
+	for dec.More() {
+		var r Record
+		require.NoError(t, dec.Decode(&r))
+		assert.Equal(t, 1, r.ID)
+		assert.Equal(t, "client", r.Stream)
+		events = append(events, r.Event+":"+string(r.Data))
+		if r.Event == RecordOpen {
+			assert.Equal(t, "tcp", r.Meta.Scheme)
+		}
+	}
+	assert.Equal(t, []string{"open:", "recv:request", "eof:", "send:response", "close:"}, events)
+}
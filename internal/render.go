@@ -0,0 +1,149 @@
+package ndog
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Format determines how stream data is presented by a Renderer.
+type Format string
+
+const (
+	// FormatRaw presents data as is.
+	FormatRaw Format = "raw"
+	// FormatQuote presents each chunk as a quoted string on its own line,
+	// prefixed with its direction and stream name.
+	FormatQuote Format = "quote"
+	// FormatHex presents each chunk as an xxd style hexdump, with offsets
+	// relative to the start of the stream, under a header line with its
+	// direction, stream name and length.
+	FormatHex Format = "hex"
+)
+
+func ParseFormat(s string) (Format, error) {
+	switch format := Format(s); format {
+	case FormatRaw, FormatQuote, FormatHex:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown format: %s", s)
+	}
+}
+
+// Direction is the direction of data on a stream, from the perspective of
+// ndog.
+type Direction int
+
+const (
+	// Recv is data received from the remote, i.e. written to the stream.
+	Recv Direction = iota
+	// Send is data sent to the remote, i.e. read from the stream.
+	Send
+)
+
+func (d Direction) String() string {
+	if d == Send {
+		return "send"
+	}
+	return "recv"
+}
+
+func (d Direction) Arrow() string {
+	if d == Send {
+		return "->"
+	}
+	return "<-"
+}
+
+// Renderer formats chunks of stream data for display.
+type Renderer struct {
+	Format Format
+	// Timestamps, if set, prefixes each chunk with the time it was
+	// rendered and the delta since the previous chunk on the same stream.
+	// It has no effect on FormatRaw.
+	Timestamps bool
+}
+
+// Stream returns a StreamRenderer which keeps track of offsets and timing for
+// a single stream.
+func (r Renderer) Stream(name string) *StreamRenderer {
+	return &StreamRenderer{
+		Renderer: r,
+		name:     name,
+	}
+}
+
+type StreamRenderer struct {
+	Renderer
+	name string
+
+	mu      sync.Mutex
+	offsets [2]int64
+	last    time.Time
+}
+
+// Render returns p formatted according to the Format. All formats other than
+// FormatRaw end with a newline.
+func (r *StreamRenderer) Render(dir Direction, p []byte) []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	offset := r.offsets[dir]
+	r.offsets[dir] += int64(len(p))
+	if r.Format == FormatRaw {
+		return p
+	}
+
+	var buf bytes.Buffer
+	if r.Timestamps {
+		now := time.Now()
+		var delta time.Duration
+		if !r.last.IsZero() {
+			delta = now.Sub(r.last)
+		}
+		r.last = now
+		fmt.Fprintf(&buf, "%s +%s ", now.Format("15:04:05.000000"), delta)
+	}
+	buf.WriteString(dir.Arrow())
+	buf.WriteString(r.name)
+	switch r.Format {
+	case FormatHex:
+		fmt.Fprintf(&buf, " %d bytes\n", len(p))
+		writeHexdump(&buf, offset, p)
+	default:
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.Quote(string(p)))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// writeHexdump writes p in the format of xxd, with offsets starting at offset.
+func writeHexdump(buf *bytes.Buffer, offset int64, p []byte) {
+	const hexDigits = "0123456789abcdef"
+	for i := 0; i < len(p); i += 16 {
+		line := p[i:min(i+16, len(p))]
+		fmt.Fprintf(buf, "%08x: ", offset+int64(i))
+		for j := 0; j < 16; j++ {
+			if j < len(line) {
+				buf.WriteByte(hexDigits[line[j]>>4])
+				buf.WriteByte(hexDigits[line[j]&0xf])
+			} else {
+				buf.WriteString("  ")
+			}
+			if j%2 == 1 {
+				buf.WriteByte(' ')
+			}
+		}
+		buf.WriteByte(' ')
+		for _, b := range line {
+			if b >= 0x20 && b < 0x7f {
+				buf.WriteByte(b)
+			} else {
+				buf.WriteByte('.')
+			}
+		}
+		buf.WriteByte('\n')
+	}
+}
@@ -0,0 +1,29 @@
+package ndog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRendererHex(t *testing.T) {
+	r := Renderer{Format: FormatHex}.Stream("s")
+	r.Render(Recv, []byte("0123456789abcdef"))
+	assert.Equal(t,
+		"<-s 17 bytes\n"+
+			"00000010: 4865 6c6c 6f2c 2077 6f72 6c64 210a 0001  Hello, world!...\n"+
+			"00000020: 7f                                       .\n",
+		string(r.Render(Recv, []byte("Hello, world!\n\x00\x01\x7f"))),
+	)
+	assert.Equal(t, "->s 2 bytes\n00000000: 6869                                     hi\n", string(r.Render(Send, []byte("hi"))))
+}
+
+func TestRendererQuote(t *testing.T) {
+	r := Renderer{Format: FormatQuote}.Stream("s")
+	assert.Equal(t, "<-s \"a\\nb\"\n", string(r.Render(Recv, []byte("a\nb"))))
+	assert.Equal(t, "x", string(Renderer{Format: FormatRaw}.Stream("s").Render(Send, []byte("x"))))
+
+	r = Renderer{Format: FormatQuote, Timestamps: true}.Stream("s")
+	assert.Regexp(t, `^\d\d:\d\d:\d\d\.\d{6} \+0s ->s "a"\n$`, string(r.Render(Send, []byte("a"))))
+	assert.Regexp(t, `^\d\d:\d\d:\d\d\.\d{6} \+\d.*s <-s "b"\n$`, string(r.Render(Recv, []byte("b"))))
+}
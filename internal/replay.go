@@ -0,0 +1,423 @@
+package ndog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/isobit/ndog/internal/log"
+)
+
+// ReadRecords reads a recording written by RecordStreamManager. Since
+// recordings may be edited by hand, a record's data may also be given as
+// plain text in a "text" field instead of base64 encoded.
+func ReadRecords(r io.Reader) ([]Record, error) {
+	records := []Record{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16*1024*1024)
+	for i := 1; scanner.Scan(); i++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var record struct {
+			Record
+			Text *string `json:"text"`
+		}
+		if err := json.Unmarshal(line, &record); err != nil {
+			return nil, fmt.Errorf("invalid record on line %d: %w", i, err)
+		}
+		if record.Text != nil {
+			record.Data = []byte(*record.Text)
+		}
+		records = append(records, record.Record)
+	}
+	return records, scanner.Err()
+}
+
+// ReplayMatch determines how incoming requests are matched against recorded
+// ones. For HTTP, the method and path (e.g. "GET /users/1") are matched;
+// otherwise, the request data is.
+type ReplayMatch string
+
+const (
+	// ReplayMatchExact matches requests which are equal.
+	ReplayMatchExact ReplayMatch = "exact"
+	// ReplayMatchRegex treats recorded requests as regular expressions
+	// which must match the entire request.
+	ReplayMatchRegex ReplayMatch = "regex"
+	// ReplayMatchGlob treats recorded requests as glob patterns, see
+	// path.Match.
+	ReplayMatchGlob ReplayMatch = "glob"
+)
+
+func ParseReplayMatch(s string) (ReplayMatch, error) {
+	switch match := ReplayMatch(s); match {
+	case ReplayMatchExact, ReplayMatchRegex, ReplayMatchGlob:
+		return match, nil
+	default:
+		return "", fmt.Errorf("unknown replay match: %s", s)
+	}
+}
+
+// replayExchange is a recorded request and the response which followed it.
+type replayExchange struct {
+	http     bool
+	request  []byte
+	regex    *regexp.Regexp
+	response []replayChunk
+	uses     int
+}
+
+type replayChunk struct {
+	delay time.Duration
+	data  []byte
+}
+
+// ReplayStreamManager serves streams by replaying responses from a recording.
+// Each recorded stream is split into exchanges of received data (the
+// request) followed by sent data (the response). When incoming data matches a
+// recorded request, its response is sent; if multiple exchanges match, the
+// least used one is chosen. If a recorded stream starts with a response, i.e.
+// the server spoke first, it is sent as soon as a stream is opened.
+//
+// HTTP exchanges are matched by the method and path recorded by an HTTP
+// listener, and only their body is replayed; the status code and headers
+// aren't recorded. Recordings of HTTP connections lack the method and path,
+// so they are rejected.
+type ReplayStreamManager struct {
+	Match ReplayMatch
+	// Timing, if set, delays responses by the original delay between
+	// receiving the request and sending each part of the response.
+	Timing bool
+
+	mu        sync.Mutex
+	exchanges []*replayExchange
+	greeting  *replayExchange
+}
+
+func NewReplayStreamManager(records []Record, match ReplayMatch, timing bool) (*ReplayStreamManager, error) {
+	m := &ReplayStreamManager{
+		Match:  match,
+		Timing: timing,
+	}
+
+	type streamKey struct {
+		session int64
+		id      int
+	}
+	type streamState struct {
+		http     bool
+		current  *replayExchange
+		lastTime int64
+	}
+	states := map[streamKey]*streamState{}
+
+	for _, r := range records {
+		key := streamKey{r.Session, r.ID}
+		state := states[key]
+		if state == nil {
+			state = &streamState{lastTime: r.Time}
+			states[key] = state
+		}
+		switch r.Event {
+		case RecordOpen:
+			if r.Meta != nil && r.Meta.HTTP == nil && isHTTPScheme(r.Meta.Scheme) {
+				return nil, fmt.Errorf("cannot replay stream %s: only HTTP streams recorded with --listen can be replayed, since they are matched by method and path", strconv.Quote(r.Stream))
+			}
+			if r.Meta != nil && r.Meta.HTTP != nil {
+				state.http = true
+				state.current = &replayExchange{
+					http:    true,
+					request: []byte(r.Meta.HTTP.Method + " " + r.Meta.HTTP.Path),
+				}
+				m.exchanges = append(m.exchanges, state.current)
+			}
+		case RecordRecv:
+			if state.http {
+				break
+			}
+			if state.current == nil || len(state.current.response) > 0 {
+				state.current = &replayExchange{}
+				m.exchanges = append(m.exchanges, state.current)
+			}
+			state.current.request = append(state.current.request, r.Data...)
+		case RecordSend:
+			if state.current == nil {
+				// The server spoke first.
+				state.current = &replayExchange{}
+				if m.greeting == nil {
+					m.greeting = state.current
+				}
+			}
+			state.current.response = append(state.current.response, replayChunk{
+				delay: time.Duration(r.Time - state.lastTime),
+				data:  r.Data,
+			})
+		}
+		state.lastTime = r.Time
+	}
+
+	if match == ReplayMatchRegex {
+		for _, ex := range m.exchanges {
+			re, err := regexp.Compile(`^(?:` + string(ex.request) + `)$`)
+			if err != nil {
+				return nil, fmt.Errorf("invalid request pattern %s: %w", strconv.Quote(string(ex.request)), err)
+			}
+			ex.regex = re
+		}
+	}
+	log.Logf(1, "replay: loaded %d exchange(s)", len(m.exchanges))
+	return m, nil
+}
+
+// isHTTPScheme returns whether scheme is an HTTP scheme, e.g. http+post.
+func isHTTPScheme(scheme string) bool {
+	base, _, _ := strings.Cut(scheme, "+")
+	return base == "http" || base == "https"
+}
+
+// match returns the least used exchange whose request matches, or nil.
+func (m *ReplayStreamManager) match(http bool, request []byte) *replayExchange {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var best *replayExchange
+	for _, ex := range m.exchanges {
+		if ex.http != http || (best != nil && ex.uses >= best.uses) {
+			continue
+		}
+		var ok bool
+		switch m.Match {
+		case ReplayMatchRegex:
+			ok = ex.regex.Match(request)
+		case ReplayMatchGlob:
+			ok, _ = path.Match(string(ex.request), string(request))
+		default:
+			ok = bytes.Equal(ex.request, request)
+		}
+		if ok {
+			best = ex
+		}
+	}
+	if best != nil {
+		best.uses++
+	}
+	return best
+}
+
+func (m *ReplayStreamManager) NewStream(name string, meta StreamMetadata) (Stream, error) {
+	pr, pw := io.Pipe()
+	s := m.newReplayStream(name, meta, func(data []byte) error {
+		_, err := pw.Write(data)
+		return err
+	}, pw.Close)
+	return Stream{
+		Reader: pr,
+		Writer: FuncWriteCloser(replayStreamWriter{s}, s.closeWrite),
+	}, nil
+}
+
+func (m *ReplayStreamManager) NewMessageStream(name string, meta StreamMetadata, framing Framing) (MessageStream, error) {
+	pr, pw := MessagePipe()
+	s := m.newReplayStream(name, meta, pw.WriteMessage, pw.Close)
+	return MessageStream{
+		Reader: pr,
+		Writer: messageWriteCloser{
+			MessageWriter: replayMessageWriter{s},
+			Closer:        closerFunc(s.closeWrite),
+		},
+	}, nil
+}
+
+// replayStream matches data written to it against recorded requests, and
+// sends the corresponding responses in order.
+type replayStream struct {
+	m    *ReplayStreamManager
+	name string
+	http bool
+
+	mu     sync.Mutex
+	buf    []byte
+	queue  []*replayExchange
+	closed bool
+	// queued is signalled whenever the queue or closed changes.
+	queued chan struct{}
+}
+
+// maxReplayBuffer limits how much unmatched data is kept for byte streams.
+const maxReplayBuffer = 64 * 1024
+
+func (m *ReplayStreamManager) newReplayStream(name string, meta StreamMetadata, send func([]byte) error, closeSend func() error) *replayStream {
+	s := &replayStream{
+		m:      m,
+		name:   name,
+		http:   meta.HTTP != nil,
+		queued: make(chan struct{}, 1),
+	}
+	go func() {
+		defer closeSend()
+		for {
+			ex, ok := s.next()
+			if !ok {
+				return
+			}
+			for _, chunk := range ex.response {
+				if m.Timing {
+					time.Sleep(chunk.delay)
+				}
+				if err := send(chunk.data); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.http:
+		request := []byte(meta.HTTP.Method + " " + meta.HTTP.Path)
+		if !s.respond(request) {
+			log.Logf(0, "replay: no match for %s: %s", name, strconv.Quote(string(request)))
+		}
+		s.close()
+	case m.greeting != nil:
+		s.enqueue(m.greeting)
+	}
+	return s
+}
+
+// next waits for the next queued exchange, returning false once the stream is
+// closed and the queue is empty.
+func (s *replayStream) next() (*replayExchange, bool) {
+	for {
+		s.mu.Lock()
+		if len(s.queue) > 0 {
+			ex := s.queue[0]
+			s.queue = s.queue[1:]
+			s.mu.Unlock()
+			return ex, true
+		}
+		closed := s.closed
+		s.mu.Unlock()
+		if closed {
+			return nil, false
+		}
+		<-s.queued
+	}
+}
+
+// enqueue must be called with s.mu held. It never blocks, so that writers
+// aren't held up by responses which have yet to be read.
+func (s *replayStream) enqueue(ex *replayExchange) {
+	s.queue = append(s.queue, ex)
+	s.signal()
+}
+
+func (s *replayStream) signal() {
+	select {
+	case s.queued <- struct{}{}:
+	default:
+	}
+}
+
+// respond queues the response for the request, returning whether it matched.
+// It must be called with s.mu held.
+func (s *replayStream) respond(request []byte) bool {
+	ex := s.m.match(s.http, request)
+	if ex == nil {
+		return false
+	}
+	log.Logf(1, "replay: matched %s: %s", s.name, strconv.Quote(string(request)))
+	s.enqueue(ex)
+	return true
+}
+
+// write buffers data until the buffer, or the part of it after a newline,
+// matches a request. Data before the matched part is discarded as unmatched,
+// so that a request which doesn't match doesn't keep later ones from
+// matching.
+func (s *replayStream) write(data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.http {
+		return
+	}
+	s.buf = append(s.buf, data...)
+	for start := 0; start < len(s.buf); {
+		if s.respond(s.buf[start:]) {
+			if start > 0 {
+				log.Logf(0, "replay: no match for %s: %s", s.name, strconv.Quote(string(s.buf[:start])))
+			}
+			s.buf = nil
+			return
+		}
+		i := bytes.IndexByte(s.buf[start:], '\n')
+		if i < 0 {
+			break
+		}
+		start += i + 1
+	}
+	if len(s.buf) > maxReplayBuffer {
+		log.Logf(0, "replay: no match for %s, discarding %d bytes", s.name, len(s.buf))
+		s.buf = nil
+	}
+}
+
+func (s *replayStream) writeMessage(msg []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.http {
+		return
+	}
+	if !s.respond(msg) {
+		log.Logf(0, "replay: no match for %s: %s", s.name, strconv.Quote(string(msg)))
+	}
+}
+
+// closeWrite handles the remote being done sending, after which any queued
+// responses are sent and then the stream is ended.
+func (s *replayStream) closeWrite() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.buf) > 0 {
+		log.Logf(0, "replay: no match for %s: %s", s.name, strconv.Quote(string(s.buf)))
+		s.buf = nil
+	}
+	s.close()
+	return nil
+}
+
+// close must be called with s.mu held.
+func (s *replayStream) close() {
+	if !s.closed {
+		s.closed = true
+		s.signal()
+	}
+}
+
+type replayStreamWriter struct {
+	s *replayStream
+}
+
+func (w replayStreamWriter) Write(p []byte) (int, error) {
+	w.s.write(p)
+	return len(p), nil
+}
+
+type replayMessageWriter struct {
+	s *replayStream
+}
+
+func (w replayMessageWriter) WriteMessage(msg []byte) error {
+	w.s.writeMessage(msg)
+	return nil
+}
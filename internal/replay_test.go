@@ -0,0 +1,76 @@
+package ndog
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRecording = `
+{"ts":0,"session":1,"id":1,"stream":"a","event":"open","meta":{"scheme":"tcp"}}
+{"ts":1,"session":1,"id":1,"stream":"a","event":"recv","text":"ping\n"}
+{"ts":2,"session":1,"id":1,"stream":"a","event":"send","text":"pong\n"}
+{"ts":3,"session":1,"id":1,"stream":"a","event":"recv","text":"get 1\n"}
+{"ts":4,"session":1,"id":1,"stream":"a","event":"send","text":"one\n"}
+{"ts":5,"session":1,"id":2,"stream":"b","event":"open","meta":{"scheme":"http","http":{"method":"GET","path":"/users/1"}}}
+{"ts":6,"session":1,"id":2,"stream":"b","event":"send","text":"alice"}
+`
+
+func TestReplayStreamManager(t *testing.T) {
+	records, err := ReadRecords(strings.NewReader(testRecording))
+	require.NoError(t, err)
+
+	replay := func(m *ReplayStreamManager, meta StreamMetadata, requests ...string) string {
+		stream, err := m.NewStream("test", meta)
+		require.NoError(t, err)
+		for _, r := range requests {
+			stream.Writer.Write([]byte(r))
+		}
+		stream.Writer.Close()
+		out, err := io.ReadAll(stream.Reader)
+		require.NoError(t, err)
+		return string(out)
+	}
+
+	m, err := NewReplayStreamManager(records, ReplayMatchExact, false)
+	require.NoError(t, err)
+	assert.Equal(t, "pong\none\n", replay(m, StreamMetadata{}, "pi", "ng\n", "get 1\n"))
+	assert.Equal(t, "", replay(m, StreamMetadata{}, "get 2\n"))
+	// An unmatched request doesn't keep later ones from matching.
+	assert.Equal(t, "one\n", replay(m, StreamMetadata{}, "get 2\n", "get 1\n"))
+	// Writes don't block on responses which haven't been read yet.
+	many := make([]string, 100)
+	for i := range many {
+		many[i] = "ping\n"
+	}
+	assert.Equal(t, strings.Repeat("pong\n", 100), replay(m, StreamMetadata{}, many...))
+	assert.Equal(t, "alice", replay(m, StreamMetadata{
+		HTTP: &HTTPMetadata{Method: "GET", Path: "/users/1"},
+	}))
+
+	records[3].Data = []byte(`get \d+\n`)
+	m, err = NewReplayStreamManager(records, ReplayMatchRegex, false)
+	require.NoError(t, err)
+	assert.Equal(t, "one\n", replay(m, StreamMetadata{}, "get 2\n"))
+
+	records[5].Meta.HTTP.Path = "/users/*"
+	m, err = NewReplayStreamManager(records, ReplayMatchGlob, false)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", replay(m, StreamMetadata{
+		HTTP: &HTTPMetadata{Method: "GET", Path: "/users/2"},
+	}))
+}
+
+func TestReplayStreamManagerHTTPConnect(t *testing.T) {
+	// Recordings of HTTP connections lack the method and path to match on.
+	records, err := ReadRecords(strings.NewReader(`
+{"ts":0,"session":1,"id":1,"stream":"http://example.com/","event":"open","meta":{"scheme":"http+post","remote_addr":"example.com"}}
+{"ts":1,"session":1,"id":1,"stream":"http://example.com/","event":"recv","text":"hello"}
+`))
+	require.NoError(t, err)
+	_, err = NewReplayStreamManager(records, ReplayMatchExact, false)
+	assert.ErrorContains(t, err, "only HTTP streams recorded with --listen can be replayed")
+}
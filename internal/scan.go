@@ -0,0 +1,181 @@
+package ndog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/sourcegraph/conc/pool"
+)
+
+// PortState is the state of a port determined by probing it.
+type PortState string
+
+const (
+	PortOpen     PortState = "open"
+	PortClosed   PortState = "closed"
+	PortFiltered PortState = "filtered"
+	// PortOpenFiltered is reported when probes which can't tell open and
+	// filtered ports apart get no response, e.g. for UDP.
+	PortOpenFiltered PortState = "open|filtered"
+)
+
+// DialState returns the state of a port given the error from dialing it: open
+// if it succeeded, closed if the connection was refused, and filtered
+// otherwise, e.g. if it timed out.
+func DialState(err error) PortState {
+	switch {
+	case err == nil:
+		return PortOpen
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return PortClosed
+	default:
+		return PortFiltered
+	}
+}
+
+type ScanTarget struct {
+	Host string
+	Port int
+}
+
+type ScanResult struct {
+	Host  string    `json:"host"`
+	Port  int       `json:"port"`
+	State PortState `json:"state"`
+	Error string    `json:"error,omitempty"`
+}
+
+// ScanError is returned by Scan if none of the probed ports are open.
+type ScanError struct {
+	Probed int
+}
+
+func (e *ScanError) Error() string {
+	return fmt.Sprintf("no open ports out of %d probed", e.Probed)
+}
+
+// ExitCode is 1, like for nc -z.
+func (e *ScanError) ExitCode() int {
+	return 1
+}
+
+// ScanFormat is the format scan results are written in.
+type ScanFormat string
+
+const (
+	// ScanFormatText writes a table of results.
+	ScanFormatText ScanFormat = "text"
+	// ScanFormatJSON writes each result as a JSON object on its own line.
+	ScanFormatJSON ScanFormat = "json"
+)
+
+func ParseScanFormat(s string) (ScanFormat, error) {
+	switch format := ScanFormat(s); format {
+	case ScanFormatText, ScanFormatJSON:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown scan format: %s", s)
+	}
+}
+
+// ParseScanURL parses a URL whose host is a comma separated list of hosts and
+// whose port is a comma separated list of ports and port ranges, e.g.
+// tcp://host1,host2:80,8000-8100, returning the scheme and every combination
+// of host and port.
+func ParseScanURL(s string) (string, []ScanTarget, error) {
+	scheme, rest, ok := strings.Cut(s, "://")
+	if !ok || scheme == "" {
+		return "", nil, fmt.Errorf("invalid scan URL: missing scheme: %s", s)
+	}
+	rest, _, _ = strings.Cut(rest, "/")
+	i := strings.LastIndex(rest, ":")
+	if i < 0 || i < strings.LastIndex(rest, "]") {
+		return "", nil, fmt.Errorf("invalid scan URL: missing port: %s", s)
+	}
+
+	var ports []int
+	for _, spec := range strings.Split(rest[i+1:], ",") {
+		lo, hi, isRange := strings.Cut(spec, "-")
+		first, err := parsePort(lo)
+		if err != nil {
+			return "", nil, err
+		}
+		last := first
+		if isRange {
+			if last, err = parsePort(hi); err != nil {
+				return "", nil, err
+			}
+			if last < first {
+				return "", nil, fmt.Errorf("invalid port range: %s", spec)
+			}
+		}
+		for port := first; port <= last; port++ {
+			ports = append(ports, port)
+		}
+	}
+
+	var targets []ScanTarget
+	for _, host := range strings.Split(rest[:i], ",") {
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		if host == "" {
+			return "", nil, fmt.Errorf("invalid scan URL: empty host: %s", s)
+		}
+		for _, port := range ports {
+			targets = append(targets, ScanTarget{Host: host, Port: port})
+		}
+	}
+	return scheme, targets, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port: %q", s)
+	}
+	return port, nil
+}
+
+// Scan probes each target using the scheme's Probe function with at most
+// workers probes running concurrently. The config's URL is set to the scheme
+// and target of each probe. Results are in the order of the targets.
+func Scan(ctx context.Context, scheme string, probe func(context.Context, Config) (PortState, error), cfg Config, targets []ScanTarget, workers int) ([]ScanResult, error) {
+	results := make([]ScanResult, len(targets))
+	p := pool.New().WithMaxGoroutines(max(workers, 1))
+	for i, target := range targets {
+		if ctx.Err() != nil {
+			break
+		}
+		p.Go(func() {
+			cfg := cfg
+			cfg.URL = &url.URL{
+				Scheme: scheme,
+				Host:   net.JoinHostPort(target.Host, strconv.Itoa(target.Port)),
+			}
+			state, err := probe(ctx, cfg)
+			results[i] = ScanResult{
+				Host:  target.Host,
+				Port:  target.Port,
+				State: state,
+			}
+			if err != nil {
+				results[i].Error = err.Error()
+			}
+		})
+	}
+	p.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for _, result := range results {
+		if result.State == PortOpen {
+			return results, nil
+		}
+	}
+	return results, &ScanError{Probed: len(results)}
+}
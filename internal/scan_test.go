@@ -0,0 +1,66 @@
+package ndog
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseScanURL(t *testing.T) {
+	scheme, targets, err := ParseScanURL("tcp://a,[::1]:80,8000-8002")
+	require.NoError(t, err)
+	assert.Equal(t, "tcp", scheme)
+	assert.Equal(t, []ScanTarget{
+		{"a", 80}, {"a", 8000}, {"a", 8001}, {"a", 8002},
+		{"::1", 80}, {"::1", 8000}, {"::1", 8001}, {"::1", 8002},
+	}, targets)
+
+	for _, s := range []string{"tcp://a", "a:80", "tcp://a:0", "tcp://a:9-8", "tcp://a:x", "tcp://:80", "tcp://[::1]"} {
+		_, _, err := ParseScanURL(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestParseScanFormat(t *testing.T) {
+	format, err := ParseScanFormat("json")
+	require.NoError(t, err)
+	assert.Equal(t, ScanFormatJSON, format)
+	_, err = ParseScanFormat("xml")
+	assert.Error(t, err)
+}
+
+func TestScan(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	open := ln.Addr().(*net.TCPAddr).Port
+
+	probe := func(ctx context.Context, cfg Config) (PortState, error) {
+		conn, err := net.Dial("tcp", cfg.URL.Host)
+		if err != nil {
+			return DialState(err), err
+		}
+		conn.Close()
+		return PortOpen, nil
+	}
+
+	// Reuse the port of a closed listener for a closed port.
+	closedLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := closedLn.Addr().(*net.TCPAddr).Port
+	closedLn.Close()
+
+	targets := []ScanTarget{{"127.0.0.1", closed}, {"127.0.0.1", open}}
+	results, err := Scan(context.Background(), "tcp", probe, Config{}, targets, 2)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.Equal(t, PortClosed, results[0].State)
+	assert.NotEmpty(t, results[0].Error)
+	assert.Equal(t, ScanResult{Host: "127.0.0.1", Port: open, State: PortOpen}, results[1])
+
+	_, err = Scan(context.Background(), "tcp", probe, Config{}, targets[:1], 2)
+	assert.EqualError(t, err, "no open ports out of 1 probed")
+}
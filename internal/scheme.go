@@ -1,6 +1,7 @@
 package ndog
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"strings"
@@ -13,8 +14,22 @@ type Scheme struct {
 	Names       []string
 	HiddenNames []string
 
-	Listen  func(ListenConfig) error
-	Connect func(ConnectConfig) error
+	Listen  func(context.Context, ListenConfig) error
+	Connect func(context.Context, ConnectConfig) error
+
+	// NewCompleter optionally creates a completer for input typed in
+	// interactive mode. It is called before Listen or Connect, which receive
+	// the completer in their config so that they can feed it live state,
+	// e.g. names fetched from a connection.
+	NewCompleter func(Config) Completer
+
+	// Probe optionally determines the state of the port in the URL for
+	// scanning, using the same means of connecting as Connect.
+	Probe func(context.Context, Config) (PortState, error)
+
+	// Resets is set if the scheme aborts connections whose streams fail
+	// with ErrStreamReset, rather than closing them gracefully.
+	Resets bool
 
 	Description       string
 	ListenOptionHelp  OptionsHelp
@@ -26,6 +41,9 @@ type Config struct {
 	Options Options
 	TLS     ndog_tls.Config
 	Net     netutil.Config
+
+	// Completer is set in interactive mode if the scheme has NewCompleter.
+	Completer Completer
 }
 
 type ListenConfig struct {
@@ -36,6 +54,19 @@ type ListenConfig struct {
 type ConnectConfig struct {
 	Config
 	Stream Stream
+
+	// Messages is set if the stream was created natively as a message
+	// stream, in which case Stream is an adapter for it.
+	Messages *MessageStream
+}
+
+// MessageStream returns the stream to connect as a message stream, adapting
+// the byte stream using the given framing if it is not natively one.
+func (cfg ConnectConfig) MessageStream(framing Framing) MessageStream {
+	if cfg.Messages != nil {
+		return *cfg.Messages
+	}
+	return StreamMessages(cfg.Stream, framing)
 }
 
 type Options map[string]string
@@ -70,6 +101,21 @@ func (oh OptionsHelp) Add(name string, value string, description string) Options
 	return oh
 }
 
+// Has reports whether an option with the given key is described. Names ending
+// in a placeholder like "header.<NAME>" match any key with the same prefix.
+func (oh OptionsHelp) Has(key string) bool {
+	for _, h := range oh {
+		if prefix, ok := strings.CutSuffix(h.Name, "<NAME>"); ok {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		} else if h.Name == key {
+			return true
+		}
+	}
+	return false
+}
+
 type OptionHelp struct {
 	Name        string
 	Value       string
@@ -0,0 +1,17 @@
+package ndog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOptionsHelpHas(t *testing.T) {
+	oh := OptionsHelp{}.
+		Add("header.<NAME>", "<VALUE>", "extra headers").
+		Add("raw", "", "raw framing")
+	assert.True(t, oh.Has("raw"))
+	assert.True(t, oh.Has("header.X-Test"))
+	assert.False(t, oh.Has("header"))
+	assert.False(t, oh.Has("rawer"))
+}
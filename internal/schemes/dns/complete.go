@@ -0,0 +1,20 @@
+package dns
+
+import (
+	"github.com/miekg/dns"
+
+	"github.com/isobit/ndog/internal"
+)
+
+// newCompleter completes record types and classes, e.g. for typing zone
+// records in interactive mode.
+func newCompleter(cfg ndog.Config) ndog.Completer {
+	words := []string{}
+	for _, t := range dns.TypeToString {
+		words = append(words, t)
+	}
+	for _, c := range dns.ClassToString {
+		words = append(words, c)
+	}
+	return ndog.NewWordCompleter(words...)
+}
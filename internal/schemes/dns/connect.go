@@ -1,15 +1,16 @@
 package dns
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net"
 	"reflect"
 	"strings"
 
 	"github.com/isobit/ndog/internal"
 	"github.com/isobit/ndog/internal/log"
+	"github.com/isobit/ndog/internal/netutil"
 
 	"github.com/miekg/dns"
 )
@@ -37,7 +38,7 @@ func extractConnectOptions(opts ndog.Options) (connectOptions, error) {
 	return o, opts.Done()
 }
 
-func Connect(cfg ndog.ConnectConfig) error {
+func Connect(ctx context.Context, cfg ndog.ConnectConfig) error {
 	opts, err := extractConnectOptions(cfg.Options)
 	if err != nil {
 		return err
@@ -92,7 +93,10 @@ func Connect(cfg ndog.ConnectConfig) error {
 	log.Logf(1, "query:")
 	log.Logf(1, req.String())
 
-	res, _, err := client.Exchange(req, nameserver)
+	res, err := netutil.Connect(ctx, cfg.Net, func(ctx context.Context) (*dns.Msg, error) {
+		res, _, err := client.ExchangeContext(ctx, req, nameserver)
+		return res, err
+	})
 	if err != nil {
 		return err
 	}
@@ -104,14 +108,14 @@ func Connect(cfg ndog.ConnectConfig) error {
 		return fmt.Errorf("received unsuccessful response code: %s", dns.RcodeToString[res.Rcode])
 	}
 
+	stream := cfg.MessageStream(ndog.LineFraming)
+
 	if opts.JSON {
 		data, err := json.Marshal(res)
 		if err != nil {
 			return err
 		}
-		cfg.Stream.Writer.Write(data)
-		io.WriteString(cfg.Stream.Writer, "\n")
-		return nil
+		return stream.Writer.WriteMessage(data)
 	}
 
 	for _, answer := range res.Answer {
@@ -120,24 +124,28 @@ func Connect(cfg ndog.ConnectConfig) error {
 			log.Logf(10, "skipping answer type %s (does not match %s)", dns.TypeToString[hdr.Rrtype], dns.TypeToString[qtype])
 			continue
 		}
+		values := []string{}
 		switch ans := answer.(type) {
 		case *dns.A:
-			fmt.Fprintln(cfg.Stream.Writer, ans.A)
+			values = append(values, ans.A.String())
 		case *dns.AAAA:
-			fmt.Fprintln(cfg.Stream.Writer, ans.AAAA)
+			values = append(values, ans.AAAA.String())
 		case *dns.CNAME:
-			fmt.Fprintln(cfg.Stream.Writer, ans.Target)
+			values = append(values, ans.Target)
 		case *dns.TXT:
-			for _, txt := range ans.Txt {
-				fmt.Fprintln(cfg.Stream.Writer, txt)
-			}
+			values = append(values, ans.Txt...)
 		case *dns.MX:
-			fmt.Fprintln(cfg.Stream.Writer, ans.Mx)
+			values = append(values, ans.Mx)
 		case *dns.NS:
-			fmt.Fprintln(cfg.Stream.Writer, ans.Ns)
+			values = append(values, ans.Ns)
 		default:
 			return fmt.Errorf("unsupported answer type %s: %s", reflect.TypeOf(ans), ans)
 		}
+		for _, value := range values {
+			if err := stream.Writer.WriteMessage([]byte(value)); err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
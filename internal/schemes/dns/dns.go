@@ -10,6 +10,7 @@ var Scheme = &ndog.Scheme{
 	ConnectOptionHelp: connectOptionHelp,
 	Listen:            Listen,
 	ListenOptionHelp:  listenOptionHelp,
+	NewCompleter:      newCompleter,
 
 	Description: `
 Connect performs a DNS request against the nameserver host and port specified in the URL.
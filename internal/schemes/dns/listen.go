@@ -1,8 +1,10 @@
 package dns
 
 import (
-	"bufio"
+	"context"
 	"fmt"
+	"io"
+	"strings"
 
 	"github.com/isobit/ndog/internal"
 	"github.com/isobit/ndog/internal/log"
@@ -27,12 +29,12 @@ func extractListenOptions(opts ndog.Options) (listenOptions, error) {
 	return o, opts.Done()
 }
 
-func dnsHandler(f func(*dns.Msg) (dns.RR, error)) dns.Handler {
+func dnsHandler(f func(dns.ResponseWriter, *dns.Msg) (dns.RR, error)) dns.Handler {
 	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
 		m := &dns.Msg{}
 		m.SetReply(r)
 
-		rr, err := f(r)
+		rr, err := f(w, r)
 		if err != nil {
 			log.Logf(-1, "%s", err)
 			m.Rcode = dns.RcodeServerFailure
@@ -46,35 +48,68 @@ func dnsHandler(f func(*dns.Msg) (dns.RR, error)) dns.Handler {
 	})
 }
 
-func Listen(cfg ndog.ListenConfig) error {
+// readMessages reads all messages from r until EOF.
+func readMessages(r ndog.MessageReader) ([]string, error) {
+	values := []string{}
+	for {
+		msg, err := r.ReadMessage()
+		if err == io.EOF {
+			return values, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, string(msg))
+	}
+}
+
+func Listen(ctx context.Context, cfg ndog.ListenConfig) error {
 	opts, err := extractListenOptions(cfg.Options)
 	if err != nil {
 		return err
 	}
 
 	s := dns.Server{
-		Net:  "udp",
-		Addr: cfg.URL.Host,
-		Handler: dnsHandler(func(r *dns.Msg) (dns.RR, error) {
+		Handler: dnsHandler(func(w dns.ResponseWriter, r *dns.Msg) (dns.RR, error) {
 			if len(r.Question) != 1 {
 				return nil, fmt.Errorf("expected 1 question but got %d", len(r.Question))
 			}
 			q := r.Question[0]
 
-			stream := cfg.StreamManager.NewStream(fmt.Sprintf("%d", r.Id))
+			stream, err := ndog.NewMessageStream(cfg.StreamManager, fmt.Sprintf("%d", r.Id), ndog.StreamMetadata{
+				Scheme:     cfg.URL.Scheme,
+				RemoteAddr: w.RemoteAddr().String(),
+				LocalAddr:  w.LocalAddr().String(),
+				DNS: &ndog.DNSMetadata{
+					ID:    r.Id,
+					Name:  q.Name,
+					Class: dns.ClassToString[q.Qclass],
+					Type:  dns.TypeToString[q.Qtype],
+				},
+			}, ndog.LineFraming)
+			if err != nil {
+				return nil, fmt.Errorf("stream error: %w", err)
+			}
 			defer stream.Close()
 
-			fmt.Fprintf(
-				stream.Writer,
-				"%s %s %s\n",
+			question := fmt.Sprintf(
+				"%s %s %s",
 				q.Name,
 				dns.ClassToString[q.Qclass],
 				dns.TypeToString[q.Qtype],
 			)
-			stream.Writer.Close()
+			if err := stream.Writer.WriteMessage([]byte(question)); err != nil {
+				return nil, fmt.Errorf("error writing question to stream: %w", err)
+			}
+			stream.CloseWrite()
+
+			values, err := readMessages(stream.Reader)
+			if err != nil {
+				return nil, fmt.Errorf("error reading stream: %w", err)
+			}
 
 			if opts.Zone {
-				zp := dns.NewZoneParser(stream.Reader, q.Name, "")
+				zp := dns.NewZoneParser(strings.NewReader(strings.Join(values, "\n")), q.Name, "")
 				zp.SetDefaultTTL(0)
 				for {
 					rr, ok := zp.Next()
@@ -91,15 +126,6 @@ func Listen(cfg ndog.ListenConfig) error {
 				}
 				return nil, nil
 			} else {
-				values := []string{}
-				scanner := bufio.NewScanner(stream.Reader)
-				for scanner.Scan() {
-					values = append(values, scanner.Text())
-				}
-				if err := scanner.Err(); err != nil {
-					return nil, fmt.Errorf("error scanning stream reader: %w", err)
-				}
-
 				hdr := dns.RR_Header{
 					Name:   q.Name,
 					Rrtype: q.Qtype,
@@ -126,6 +152,30 @@ func Listen(cfg ndog.ListenConfig) error {
 			}
 		}),
 	}
-	log.Logf(0, "listening: %s", s.Addr)
-	return s.ListenAndServe()
+
+	conn, err := cfg.Net.ListenPacket(ctx, "udp", cfg.URL.Host)
+	if err != nil {
+		return err
+	}
+	s.PacketConn = conn
+	log.With("scheme", cfg.URL.Scheme, "addr", conn.LocalAddr()).Logf(0, "listening: %s", conn.LocalAddr())
+
+	// The server can only be shut down once it has started, so wait for that
+	// before reacting to cancellation.
+	shutdownDone := make(chan struct{})
+	s.NotifyStartedFunc = func() {
+		context.AfterFunc(ctx, func() {
+			defer close(shutdownDone)
+			log.Logf(1, "shutting down: %s", conn.LocalAddr())
+			if err := s.ShutdownContext(context.Background()); err != nil {
+				log.Logf(-1, "shutdown error: %s", err)
+			}
+		})
+	}
+
+	if err := s.ActivateAndServe(); err != nil {
+		return err
+	}
+	<-shutdownDone
+	return nil
 }
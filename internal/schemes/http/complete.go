@@ -0,0 +1,45 @@
+package http
+
+import (
+	"github.com/isobit/ndog/internal"
+)
+
+var headerNames = []string{
+	"Accept",
+	"Accept-Encoding",
+	"Accept-Language",
+	"Authorization",
+	"Cache-Control",
+	"Connection",
+	"Content-Encoding",
+	"Content-Length",
+	"Content-Type",
+	"Cookie",
+	"Date",
+	"ETag",
+	"Expires",
+	"Host",
+	"If-Match",
+	"If-Modified-Since",
+	"If-None-Match",
+	"Last-Modified",
+	"Location",
+	"Origin",
+	"Referer",
+	"Server",
+	"Set-Cookie",
+	"Transfer-Encoding",
+	"User-Agent",
+	"Vary",
+	"WWW-Authenticate",
+	"X-Forwarded-For",
+	"X-Forwarded-Proto",
+	"X-Request-Id",
+}
+
+// newCompleter completes HTTP methods and common header names.
+func newCompleter(cfg ndog.Config) ndog.Completer {
+	words := append([]string{}, methods...)
+	words = append(words, headerNames...)
+	return ndog.NewWordCompleter(words...)
+}
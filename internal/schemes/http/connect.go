@@ -2,6 +2,7 @@ package http
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -70,7 +71,7 @@ func extractConnectOptions(opts ndog.Options, subscheme string) (connectOptions,
 	return o, opts.Done()
 }
 
-func Connect(cfg ndog.ConnectConfig) error {
+func Connect(ctx context.Context, cfg ndog.ConnectConfig) error {
 	reqUrl, subscheme := ndog.SplitURLSubscheme(cfg.URL)
 
 	opts, err := extractConnectOptions(cfg.Options, subscheme)
@@ -108,7 +109,7 @@ func Connect(cfg ndog.ConnectConfig) error {
 	}
 
 	// Convert to HTTP request
-	httpReq, err := http.NewRequest(opts.Method, reqUrl.String(), body)
+	httpReq, err := http.NewRequestWithContext(ctx, opts.Method, reqUrl.String(), body)
 	if err != nil {
 		return err
 	}
@@ -126,6 +127,7 @@ func Connect(cfg ndog.ConnectConfig) error {
 	}
 
 	transport := &http.Transport{
+		DialContext:     cfg.Net.DialContext,
 		TLSClientConfig: tlsConfig,
 	}
 	client := &http.Client{
@@ -138,14 +140,15 @@ func Connect(cfg ndog.ConnectConfig) error {
 	}
 
 	// Do request
-	log.Logf(0, "request: %s %s", opts.Method, reqUrl.RequestURI())
+	logger := log.With("scheme", cfg.URL.Scheme, "stream", cfg.URL.Host, "method", opts.Method, "path", reqUrl.Path)
+	logger.Logf(0, "request: %s %s", opts.Method, reqUrl.RequestURI())
 	util.LogHeaders("request header: ", httpReq.Header)
 	resp, err := client.Do(httpReq)
 	if err != nil {
 		return err
 	}
 
-	log.Logf(0, "response: %s", resp.Status)
+	logger.With("status", resp.StatusCode).Logf(0, "response: %s", resp.Status)
 	util.LogHeaders("response header: ", resp.Header)
 
 	if opts.GraphQL {
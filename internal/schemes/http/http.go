@@ -11,8 +11,9 @@ var HTTPScheme = &ndog.Scheme{
 	Names:       []string{"http", "https"},
 	HiddenNames: []string{}, // will be initialized in init()
 
-	Connect: Connect,
-	Listen:  Listen,
+	Connect:      Connect,
+	Listen:       Listen,
+	NewCompleter: newCompleter,
 
 	Description: `
 Connect sends input as an HTTP request body to the specified URL.
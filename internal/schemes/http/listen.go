@@ -2,6 +2,7 @@ package http
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	stdlog "log"
@@ -9,8 +10,6 @@ import (
 	"path/filepath"
 	"strings"
 
-	"github.com/tinylib/msgp/msgp"
-
 	"github.com/isobit/ndog/internal"
 	"github.com/isobit/ndog/internal/log"
 	"github.com/isobit/ndog/internal/util"
@@ -71,7 +70,7 @@ func extractListenOptions(opts ndog.Options) (listenOptions, error) {
 	return o, opts.Done()
 }
 
-func Listen(cfg ndog.ListenConfig) error {
+func Listen(ctx context.Context, cfg ndog.ListenConfig) error {
 	opts, err := extractListenOptions(cfg.Options)
 	if err != nil {
 		return err
@@ -93,9 +92,11 @@ func Listen(cfg ndog.ListenConfig) error {
 		ErrorLog: stdlog.New(errLogWriter, "", 0),
 		Addr:     cfg.URL.Host,
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			log.Logf(0, "request: %s: %s %s", r.RemoteAddr, r.Method, r.URL)
+			name := fmt.Sprintf("%s|%s %s", r.RemoteAddr, r.Method, r.URL)
+			logger := log.With("scheme", cfg.URL.Scheme, "stream", name, "remote_addr", r.RemoteAddr, "method", r.Method, "path", r.URL.Path)
+			logger.Logf(0, "request: %s: %s %s", r.RemoteAddr, r.Method, r.URL)
 			if r.Host != cfg.URL.Host {
-				log.Logf(1, "request header: Host: %s", r.Host)
+				logger.Logf(1, "request header: Host: %s", r.Host)
 			}
 			util.LogHeaders("request header: ", r.Header)
 			if opts.ServeFile != "" {
@@ -107,42 +108,47 @@ func Listen(cfg ndog.ListenConfig) error {
 				return
 			}
 
-			stream := cfg.StreamManager.NewStream(fmt.Sprintf("%s|%s %s", r.RemoteAddr, r.Method, r.URL))
+			stream, err := cfg.StreamManager.NewStream(name, ndog.NewHTTPStreamMetadata(cfg.URL.Scheme, r))
+			if err != nil {
+				logger.Logf(-1, "stream error: %s", err)
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
 			defer stream.Close()
 
 			// Receive request.
+			// Unlike --out-codec msgpack, this only converts msgpack
+			// requests, and leaves the trailing newline undecoded.
+			body := io.Writer(stream.Writer)
+			closeBody := func() error { return nil }
 			contentType := r.Header.Get("Content-Type")
 			if opts.MsgpackToJSON && (contentType == "application/msgpack" || contentType == "application/x-msgpack") {
-				body, err := io.ReadAll(r.Body)
-				if err != nil {
-					log.Logf(-1, "error reading request body: %s", err)
-					return
-				}
-				if _, err := msgp.UnmarshalAsJSON(stream.Writer, body); err != nil {
-					log.Logf(-1, "error unmarshaling request body msgpack as JSON: %s", err)
-					return
-				}
-				stream.Writer.Write([]byte{'\n'})
-			} else {
-				if _, err := io.Copy(stream.Writer, r.Body); err != nil {
-					log.Logf(-1, "error reading request body: %s", err)
-					return
-				}
-				stream.Writer.Write([]byte{'\n'})
+				dec := ndog.Codecs["msgpack"].Decode(stream.Writer)
+				body, closeBody = dec, dec.Close
+			}
+			if _, err := io.Copy(body, r.Body); err != nil {
+				logger.Logf(-1, "error reading request body: %s", err)
+				return
+			}
+			if err := closeBody(); err != nil {
+				logger.Logf(-1, "error converting request body msgpack to JSON: %s", err)
+				return
 			}
-			stream.Writer.Close()
+			stream.Writer.Write([]byte{'\n'})
+			stream.CloseWrite()
 
 			// Send response.
 			for key, val := range opts.Headers {
 				w.Header().Add(key, val)
 			}
-			log.Logf(10, "writing status code %d", opts.StatusCode)
+			logger = logger.With("status", opts.StatusCode)
+			logger.Logf(10, "writing status code %d", opts.StatusCode)
 			w.WriteHeader(opts.StatusCode)
 			if _, err := io.Copy(w, stream.Reader); err != nil {
-				log.Logf(-1, "error writing response body: %s", err)
+				logger.Logf(-1, "error writing response body: %s", err)
 				return
 			}
-			log.Logf(10, "handler closed")
+			logger.Logf(10, "handler closed")
 		}),
 	}
 	if cfg.URL.Scheme == "https" {
@@ -151,11 +157,8 @@ func Listen(cfg ndog.ListenConfig) error {
 			return err
 		}
 		s.TLSConfig = tlsConfig
-		log.Logf(0, "listening: %s", s.Addr)
-		return s.ListenAndServeTLS("", "")
 	}
-	log.Logf(0, "listening: %s", s.Addr)
-	return s.ListenAndServe()
+	return cfg.Net.ServeHTTP(ctx, s)
 }
 
 func proxyPass(w http.ResponseWriter, r *http.Request, passUrl string) {
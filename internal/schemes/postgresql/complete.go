@@ -0,0 +1,65 @@
+package postgresql
+
+import (
+	"context"
+	"regexp"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/isobit/ndog/internal"
+	"github.com/isobit/ndog/internal/log"
+)
+
+var sqlKeywords = []string{
+	"ALTER", "AND", "AS", "ASC", "BEGIN", "BETWEEN", "BY", "CASE", "COMMIT",
+	"COUNT", "CREATE", "DATABASE", "DEFAULT", "DELETE", "DESC", "DISTINCT",
+	"DROP", "ELSE", "END", "EXISTS", "EXPLAIN", "FALSE", "FROM", "FULL",
+	"GROUP", "HAVING", "IN", "INDEX", "INNER", "INSERT", "INTO", "IS", "JOIN",
+	"LEFT", "LIKE", "LIMIT", "LISTEN", "NOT", "NOTIFY", "NULL", "OFFSET", "ON",
+	"OR", "ORDER", "OUTER", "PRIMARY", "KEY", "REFERENCES", "RETURNING",
+	"RIGHT", "ROLLBACK", "SCHEMA", "SELECT", "SET", "TABLE", "THEN", "TRUE",
+	"TRUNCATE", "UNION", "UNIQUE", "UPDATE", "USING", "VALUES", "VIEW",
+	"WHEN", "WHERE", "WITH",
+}
+
+func newCompleter(cfg ndog.Config) ndog.Completer {
+	return ndog.NewWordCompleter(sqlKeywords...)
+}
+
+// ddlPattern matches statements after which the names used for completion
+// need to be refreshed.
+var ddlPattern = regexp.MustCompile(`(?i)^\s*(create|alter|drop)\b`)
+
+const completionNamesQuery = `
+select distinct table_name, column_name
+from information_schema.columns
+where table_schema not in ('pg_catalog', 'information_schema')
+`
+
+// refreshCompletions updates the completer with SQL keywords and the table
+// and column names from the connection. It must not be called concurrently
+// with other queries on the connection.
+func refreshCompletions(ctx context.Context, conn *pgx.Conn, completer *ndog.WordCompleter) {
+	rows, err := conn.Query(ctx, completionNamesQuery)
+	if err != nil {
+		log.Logf(1, "error fetching names for completion: %s", err)
+		return
+	}
+	defer rows.Close()
+
+	words := append([]string{}, sqlKeywords...)
+	tables := map[string]bool{}
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			log.Logf(1, "error fetching names for completion: %s", err)
+			return
+		}
+		if !tables[table] {
+			tables[table] = true
+			words = append(words, table)
+		}
+		words = append(words, column)
+	}
+	completer.SetWords(words)
+}
@@ -5,13 +5,13 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"strings"
 
 	"github.com/jackc/pgx/v5"
 
 	"github.com/isobit/ndog/internal"
 	"github.com/isobit/ndog/internal/log"
+	"github.com/isobit/ndog/internal/netutil"
 )
 
 var ListenScheme = &ndog.Scheme{
@@ -28,7 +28,7 @@ Example: ndog -c 'postgres+listen://localhost#foo,bar'
 		Add("json", "", "use JSON representation for returned rows"),
 }
 
-func listenConnect(cfg ndog.ConnectConfig) error {
+func listenConnect(ctx context.Context, cfg ndog.ConnectConfig) error {
 	opts, err := extractOptions(cfg.Options)
 	if err != nil {
 		return err
@@ -42,18 +42,19 @@ func listenConnect(cfg ndog.ConnectConfig) error {
 	connUrl, _ := ndog.SplitURLSubscheme(cfg.URL)
 	connUrl.Fragment = ""
 
-	ctx := context.Background()
-	conn, err := pgx.Connect(ctx, connUrl.String())
+	conn, err := netutil.Connect(ctx, cfg.Net, func(ctx context.Context) (*pgx.Conn, error) {
+		return pgx.Connect(ctx, connUrl.String())
+	})
 	if err != nil {
 		return err
 	}
-	defer conn.Close(ctx)
+	defer conn.Close(context.Background())
 
 	cc := conn.Config()
 	name := fmt.Sprintf("%s:%d", cc.Host, cc.Port)
-	log.Logf(0, "connected: %s", name)
+	log.With("scheme", cfg.URL.Scheme, "stream", name, "remote_addr", name).Logf(0, "connected: %s", name)
 
-	stream := cfg.Stream
+	stream := cfg.MessageStream(ndog.LineFraming)
 
 	for _, channelName := range channelNames {
 		log.Logf(1, "exec: LISTEN %s", channelName)
@@ -65,19 +66,21 @@ func listenConnect(cfg ndog.ConnectConfig) error {
 	for {
 		notification, err := conn.WaitForNotification(ctx)
 		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
 			return err
 		}
 		log.Logf(1, "notification: %s", notification.Channel)
+		msg := []byte(notification.Payload)
 		if opts.JSON {
-			data, err := json.Marshal(notification)
+			msg, err = json.Marshal(notification)
 			if err != nil {
 				return err
 			}
-			stream.Writer.Write(data)
-			io.WriteString(stream.Writer, "\n")
-		} else {
-			io.WriteString(stream.Writer, notification.Payload)
-			io.WriteString(stream.Writer, "\n")
+		}
+		if err := stream.Writer.WriteMessage(msg); err != nil {
+			return err
 		}
 	}
 }
@@ -96,7 +99,7 @@ Example: ndog -c 'postgres+notify://localhost#foo' -d hello
 		Add("json", "", "use JSON representation for returned rows"),
 }
 
-func notifyConnect(cfg ndog.ConnectConfig) error {
+func notifyConnect(ctx context.Context, cfg ndog.ConnectConfig) error {
 	// JSON not supported yet
 	if err := cfg.Options.Done(); err != nil {
 		return err
@@ -110,16 +113,23 @@ func notifyConnect(cfg ndog.ConnectConfig) error {
 	connUrl, _ := ndog.SplitURLSubscheme(cfg.URL)
 	connUrl.Fragment = ""
 
-	ctx := context.Background()
-	conn, err := pgx.Connect(ctx, connUrl.String())
+	conn, err := netutil.Connect(ctx, cfg.Net, func(ctx context.Context) (*pgx.Conn, error) {
+		return pgx.Connect(ctx, connUrl.String())
+	})
 	if err != nil {
 		return err
 	}
-	defer conn.Close(ctx)
+	defer conn.Close(context.Background())
 
 	cc := conn.Config()
 	name := fmt.Sprintf("%s:%d", cc.Host, cc.Port)
-	log.Logf(0, "connected: %s", name)
+	log.With("scheme", cfg.URL.Scheme, "stream", name, "remote_addr", name).Logf(0, "connected: %s", name)
+
+	// Unblock reading payloads from the stream on cancellation.
+	stop := context.AfterFunc(ctx, func() {
+		cfg.Stream.Close()
+	})
+	defer stop()
 
 	scanner := bufio.NewScanner(cfg.Stream.Reader)
 	for scanner.Scan() {
@@ -12,12 +12,15 @@ import (
 
 	"github.com/isobit/ndog/internal"
 	"github.com/isobit/ndog/internal/log"
+	"github.com/isobit/ndog/internal/netutil"
 )
 
 var Scheme = &ndog.Scheme{
 	Names:   []string{"postgres"},
 	Connect: Connect,
 
+	NewCompleter: newCompleter,
+
 	Description: `
 Connect sends input to the specified PostgreSQL server and outputs the returned rows.
 
@@ -39,22 +42,34 @@ func extractOptions(opts ndog.Options) (Options, error) {
 	return o, opts.Done()
 }
 
-func Connect(cfg ndog.ConnectConfig) error {
+func Connect(ctx context.Context, cfg ndog.ConnectConfig) error {
 	opts, err := extractOptions(cfg.Options)
 	if err != nil {
 		return err
 	}
 
-	ctx := context.Background()
-	conn, err := pgx.Connect(ctx, cfg.URL.String())
+	conn, err := netutil.Connect(ctx, cfg.Net, func(ctx context.Context) (*pgx.Conn, error) {
+		return pgx.Connect(ctx, cfg.URL.String())
+	})
 	if err != nil {
 		return err
 	}
-	defer conn.Close(ctx)
+	defer conn.Close(context.Background())
+
+	// Unblock reading statements from the stream on cancellation.
+	stop := context.AfterFunc(ctx, func() {
+		cfg.Stream.Close()
+	})
+	defer stop()
 
 	cc := conn.Config()
 	name := fmt.Sprintf("%s:%d", cc.Host, cc.Port)
-	log.Logf(0, "connected: %s", name)
+	log.With("scheme", cfg.URL.Scheme, "stream", name, "remote_addr", name).Logf(0, "connected: %s", name)
+
+	completer, _ := cfg.Completer.(*ndog.WordCompleter)
+	if completer != nil {
+		refreshCompletions(ctx, conn, completer)
+	}
 
 	stream := cfg.Stream
 
@@ -77,6 +92,9 @@ func Connect(cfg ndog.ConnectConfig) error {
 				log.Logf(-1, "error converting rows to CSV: %s", err)
 			}
 		}
+		if completer != nil && ddlPattern.MatchString(stmt) {
+			refreshCompletions(ctx, conn, completer)
+		}
 	}
 	return nil
 }
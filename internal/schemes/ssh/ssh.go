@@ -1,6 +1,8 @@
 package ssh
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 
@@ -19,11 +21,26 @@ Listen starts an SSH server on the host and port specified in the URL.
 	`,
 }
 
-func Listen(cfg ndog.ListenConfig) error {
+func Listen(ctx context.Context, cfg ndog.ListenConfig) error {
 	handler := func(s ssh.Session) {
 		name := fmt.Sprintf("%s@%s", s.User(), s.RemoteAddr())
 		log.Logf(1, "accepted: %s %s", name, s.RawCommand())
-		stream := cfg.StreamManager.NewStream(name)
+		stream, err := cfg.StreamManager.NewStream(name, ndog.StreamMetadata{
+			Scheme:     cfg.URL.Scheme,
+			RemoteAddr: s.RemoteAddr().String(),
+			LocalAddr:  s.LocalAddr().String(),
+			SSH: &ndog.SSHMetadata{
+				User:    s.User(),
+				Command: s.RawCommand(),
+			},
+		})
+		if err != nil {
+			log.Logf(-1, "stream error: %s: %s", name, err)
+			fmt.Fprintln(s.Stderr(), "ndog: failed to handle session")
+			s.Exit(1)
+			return
+		}
+		defer stream.Close()
 		go io.Copy(stream.Writer, s)
 		io.Copy(s, stream.Reader)
 	}
@@ -36,6 +53,26 @@ func Listen(cfg ndog.ListenConfig) error {
 			return false
 		},
 	}
-	log.Logf(0, "listening: %s", cfg.URL.Host)
-	return server.ListenAndServe()
+
+	listener, err := cfg.Net.Listen(ctx, "tcp", cfg.URL.Host)
+	if err != nil {
+		return err
+	}
+	log.With("scheme", cfg.URL.Scheme, "addr", listener.Addr()).Logf(0, "listening: %s", listener.Addr())
+
+	shutdownDone := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(shutdownDone)
+		log.Logf(1, "shutting down: %s", listener.Addr())
+		if err := server.Shutdown(context.Background()); err != nil {
+			log.Logf(-1, "shutdown error: %s", err)
+		}
+	})
+	defer stop()
+
+	if err := server.Serve(listener); !errors.Is(err, ssh.ErrServerClosed) {
+		return err
+	}
+	<-shutdownDone
+	return nil
 }
@@ -1,6 +1,8 @@
 package tcp
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -16,6 +18,8 @@ var Scheme = &ndog.Scheme{
 	Names:   []string{"tcp"},
 	Connect: Connect,
 	Listen:  Listen,
+	Probe:   Probe,
+	Resets:  true,
 
 	Description: `
 Connect opens a TCP connection to the server host and port specified in the URL.
@@ -27,62 +31,124 @@ Examples:
 	`,
 }
 
-func Listen(cfg ndog.ListenConfig) error {
-	listener, err := cfg.Net.Listen("tcp", cfg.URL.Host)
+func Listen(ctx context.Context, cfg ndog.ListenConfig) error {
+	listener, err := cfg.Net.Listen(ctx, "tcp", cfg.URL.Host)
 	if err != nil {
 		return err
 	}
 	defer listener.Close()
-	log.Logf(0, "listening: %s", listener.Addr())
+	log.With("scheme", cfg.URL.Scheme, "addr", listener.Addr()).Logf(0, "listening: %s", listener.Addr())
+
+	return serve(ctx, listener, cfg.URL.Scheme, cfg.StreamManager)
+}
+
+// serve accepts connections from the listener and handles each of them with a
+// new stream until ctx is cancelled, after which it waits for any in-flight
+// connections to be closed.
+func serve(ctx context.Context, listener net.Listener, scheme string, streamManager ndog.StreamManager) error {
+	stop := context.AfterFunc(ctx, func() {
+		log.Logf(1, "closing listener: %s", listener.Addr())
+		listener.Close()
+	})
+	defer stop()
 
 	handleConn := func(conn net.Conn) {
 		defer conn.Close()
 
 		remoteAddr := conn.RemoteAddr()
-		log.Logf(1, "accepted: %s", remoteAddr)
-		defer log.Logf(1, "closed: %s", remoteAddr)
+		logger := log.With("scheme", scheme, "stream", remoteAddr.String(), "remote_addr", remoteAddr)
+		logger.Logf(1, "accepted: %s", remoteAddr)
+
+		meta := ndog.StreamMetadata{
+			Scheme:     scheme,
+			RemoteAddr: remoteAddr.String(),
+			LocalAddr:  conn.LocalAddr().String(),
+		}
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				logger.Logf(-1, "handshake error: %s: %s", remoteAddr, err)
+				return
+			}
+			meta.TLS = ndog.NewTLSMetadata(tlsConn.ConnectionState())
+		}
 
-		stream := cfg.StreamManager.NewStream(remoteAddr.String())
+		stream, err := streamManager.NewStream(remoteAddr.String(), meta)
+		if err != nil {
+			logger.Logf(-1, "stream error: %s: %s", remoteAddr, err)
+			return
+		}
 		defer stream.Close()
 
-		bidirectionalCopy(conn, stream)
+		sent, recv := bidirectionalCopy(logger, conn, stream, false)
+		logger.With("bytes_sent", sent, "bytes_recv", recv).Logf(1, "closed: %s", remoteAddr)
 	}
 
+	wg := conc.WaitGroup{}
+	defer wg.Wait()
+
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
 			if conn != nil {
-				log.Logf(-1, "accept error: %s: %s", conn.RemoteAddr(), err)
+				log.With("scheme", scheme, "remote_addr", conn.RemoteAddr()).Logf(-1, "accept error: %s: %s", conn.RemoteAddr(), err)
 			} else {
 				log.Logf(-1, "accept error: %s", err)
 			}
 			continue
 		}
-		go handleConn(conn)
+		wg.Go(func() {
+			handleConn(conn)
+		})
 	}
 }
 
-func Connect(cfg ndog.ConnectConfig) error {
+func dial(ctx context.Context, cfg ndog.Config) (net.Conn, error) {
 	addr, err := net.ResolveTCPAddr("tcp", cfg.URL.Host)
 	if err != nil {
-		return fmt.Errorf("invalid address: %w", err)
+		return nil, fmt.Errorf("invalid address: %w", err)
 	}
+	return cfg.Net.DialContext(ctx, "tcp", addr.String())
+}
 
-	conn, err := net.DialTCP("tcp", nil, addr)
+func Connect(ctx context.Context, cfg ndog.ConnectConfig) error {
+	conn, err := dial(ctx, cfg.Config)
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
 
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
 	remoteAddr := conn.RemoteAddr()
-	log.Logf(0, "connected: %s", remoteAddr)
-	defer log.Logf(0, "closed: %s", remoteAddr)
+	logger := log.With("scheme", cfg.URL.Scheme, "stream", remoteAddr.String(), "remote_addr", remoteAddr)
+	logger.Logf(0, "connected: %s", remoteAddr)
 
-	bidirectionalCopy(conn, cfg.Stream)
+	sent, recv := bidirectionalCopy(logger, conn, cfg.Stream, true)
+	logger.With("bytes_sent", sent, "bytes_recv", recv).Logf(0, "closed: %s", remoteAddr)
 
 	return nil
 }
 
+// Probe reports whether a connection can be established, without sending
+// anything.
+func Probe(ctx context.Context, cfg ndog.Config) (ndog.PortState, error) {
+	conn, err := dial(ctx, cfg)
+	if err != nil {
+		return ndog.DialState(err), err
+	}
+	conn.Close()
+	return ndog.PortOpen, nil
+}
+
 type Request struct {
 	RemoteAddr string
 	Data       []byte
@@ -92,27 +158,75 @@ type Response struct {
 	Data []byte
 }
 
-func bidirectionalCopy(conn io.ReadWriteCloser, stream ndog.Stream) {
+// bidirectionalCopy copies data in both directions between conn and stream
+// until both directions are done. EOF in either direction is propagated as a
+// half-close, so that e.g. a request can be fully sent while its response is
+// still being received. If closeOnRemoteEOF is set, the stream is closed
+// entirely once the remote is done sending, rather than waiting for the
+// stream to be done sending as well. It returns the number of bytes sent to and
+// received from conn.
+func bidirectionalCopy(logger log.Logger, conn net.Conn, stream ndog.Stream, closeOnRemoteEOF bool) (sent int64, recv int64) {
 	wg := conc.WaitGroup{}
 	wg.Go(func() {
-		defer conn.Close()
-		defer stream.Close()
-
-		if _, err := io.Copy(conn, stream.Reader); err != nil {
-			if !ndog.IsIOClosedErr(err) && !errors.Is(err, net.ErrClosed) {
-				log.Logf(-1, "write error: %s", err)
+		var err error
+		if sent, err = io.Copy(conn, stream.Reader); err != nil {
+			if errors.Is(err, ndog.ErrStreamReset) {
+				reset(conn)
+			} else if !isClosedErr(err) {
+				logger.Logf(-1, "write error: %s", err)
 			}
+			conn.Close()
+			stream.Close()
+			return
 		}
+		logger.Logf(10, "stream EOF, closing write: %s", conn.RemoteAddr())
+		if cw, ok := conn.(ndog.CloseWriter); ok {
+			if err := cw.CloseWrite(); err == nil {
+				return
+			}
+		}
+		conn.Close()
 	})
 	wg.Go(func() {
-		defer conn.Close()
-		defer stream.Close()
-
-		if _, err := io.Copy(stream.Writer, conn); err != nil {
-			if !ndog.IsIOClosedErr(err) && !errors.Is(err, net.ErrClosed) {
-				log.Logf(-1, "read error: %s", err)
+		var err error
+		if recv, err = io.Copy(stream.Writer, conn); err != nil {
+			// A closed error means the other direction is already
+			// tearing things down, so leave it to finish.
+			if isClosedErr(err) {
+				return
+			}
+			if errors.Is(err, ndog.ErrStreamReset) {
+				reset(conn)
+				stream.Close()
+				return
 			}
+			logger.Logf(-1, "read error: %s", err)
+			conn.Close()
+			stream.Close()
+			return
+		}
+		logger.Logf(10, "remote EOF, closing stream write: %s", conn.RemoteAddr())
+		stream.CloseWrite()
+		if closeOnRemoteEOF {
+			stream.Close()
 		}
 	})
 	wg.Wait()
+	return sent, recv
+}
+
+// reset closes conn with a RST rather than a FIN, if it is a TCP connection.
+func reset(conn net.Conn) {
+	netConn := conn
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		netConn = tlsConn.NetConn()
+	}
+	if tcpConn, ok := netConn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	conn.Close()
+}
+
+func isClosedErr(err error) bool {
+	return ndog.IsIOClosedErr(err) || errors.Is(err, net.ErrClosed)
 }
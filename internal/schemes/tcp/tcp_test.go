@@ -0,0 +1,141 @@
+package tcp
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/isobit/ndog/internal"
+	"github.com/isobit/ndog/internal/log"
+)
+
+func TestBidirectionalCopyHalfClose(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	// The stream only responds once it has received the entire request,
+	// which requires the client's half-close to be propagated to it.
+	reqReader, reqWriter := io.Pipe()
+	respReader, respWriter := io.Pipe()
+	stream := ndog.Stream{
+		Reader: respReader,
+		Writer: reqWriter,
+	}
+	go func() {
+		req, _ := io.ReadAll(reqReader)
+		respWriter.Write(append([]byte("response to "), req...))
+		respWriter.Close()
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		bidirectionalCopy(log.Logger{}, conn, stream, false)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("request"))
+	require.NoError(t, err)
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+
+	resp, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "response to request", string(resp))
+	<-done
+}
+
+type slowStreamManager struct {
+	delay time.Duration
+}
+
+func (m slowStreamManager) NewStream(name string, meta ndog.StreamMetadata) (ndog.Stream, error) {
+	// Like a slow --exec handler, respond a while after the whole request
+	// has been received.
+	reqReader, reqWriter := io.Pipe()
+	respReader, respWriter := io.Pipe()
+	go func() {
+		req, _ := io.ReadAll(reqReader)
+		time.Sleep(m.delay)
+		respWriter.Write(append([]byte("response to "), req...))
+		respWriter.Close()
+	}()
+	return ndog.Stream{
+		Reader: respReader,
+		Writer: reqWriter,
+	}, nil
+}
+
+func TestServeSlowResponse(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go serve(ctx, listener, "tcp", slowStreamManager{delay: 2500 * time.Millisecond})
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("request"))
+	require.NoError(t, err)
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+
+	resp, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "response to request", string(resp))
+}
+
+type closeStreamManager struct {
+	closed chan struct{}
+}
+
+func (m closeStreamManager) NewStream(name string, meta ndog.StreamMetadata) (ndog.Stream, error) {
+	// The reader never reaches EOF, like a terminal.
+	r, _ := io.Pipe()
+	return ndog.Stream{
+		Reader: ndog.FuncReadCloser(r, func() error {
+			close(m.closed)
+			return r.Close()
+		}),
+		Writer: ndog.NopWriteCloser(io.Discard),
+	}, nil
+}
+
+func TestServeRemoteCloseIdleTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := closeStreamManager{closed: make(chan struct{})}
+	go serve(ctx, listener, "tcp", &ndog.TimeoutStreamManager{
+		StreamManager: m,
+		Idle:          50 * time.Millisecond,
+	})
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("hi"))
+	require.NoError(t, err)
+	conn.Close()
+
+	// The stream is kept open after the remote closes, since it may still be
+	// sending, until --idle-timeout closes it.
+	select {
+	case <-m.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream was not closed by the idle timeout")
+	}
+}
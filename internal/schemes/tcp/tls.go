@@ -1,17 +1,21 @@
 package tcp
 
 import (
+	"context"
 	"crypto/tls"
 	"net"
 
 	"github.com/isobit/ndog/internal"
 	"github.com/isobit/ndog/internal/log"
+	"github.com/isobit/ndog/internal/netutil"
 )
 
 var TLSScheme = &ndog.Scheme{
 	Names:   []string{"tls"},
 	Connect: TLSConnect,
 	Listen:  TLSListen,
+	Probe:   TLSProbe,
+	Resets:  true,
 
 	Description: `
 Connect opens a TLS connection to the server host and port specified in the URL.
@@ -23,64 +27,70 @@ Examples:
 	`,
 }
 
-func TLSListen(cfg ndog.ListenConfig) error {
+func TLSListen(ctx context.Context, cfg ndog.ListenConfig) error {
 	tlsConfig, err := cfg.TLS.Config(true, []string{cfg.URL.Hostname()})
 	if err != nil {
 		return err
 	}
 
-	tcpListener, err := cfg.Net.Listen("tcp", cfg.URL.Host)
+	tcpListener, err := cfg.Net.Listen(ctx, "tcp", cfg.URL.Host)
 	if err != nil {
 		return err
 	}
 	listener := tls.NewListener(tcpListener, tlsConfig)
 	defer listener.Close()
-	log.Logf(0, "listening: %s", listener.Addr())
+	log.With("scheme", cfg.URL.Scheme, "addr", listener.Addr()).Logf(0, "listening: %s", listener.Addr())
 
-	handleConn := func(conn net.Conn) {
-		defer conn.Close()
-
-		remoteAddr := conn.RemoteAddr()
-		log.Logf(1, "accepted: %s", remoteAddr)
-		defer log.Logf(1, "closed: %s", remoteAddr)
-
-		stream := cfg.StreamManager.NewStream(remoteAddr.String())
-		defer stream.Close()
+	return serve(ctx, listener, cfg.URL.Scheme, cfg.StreamManager)
+}
 
-		bidirectionalCopy(conn, stream)
+// TLSProbe reports whether a connection can be established, treating a failed
+// handshake as open since something is listening.
+func TLSProbe(ctx context.Context, cfg ndog.Config) (ndog.PortState, error) {
+	tlsConfig, err := cfg.TLS.Config(false, nil)
+	if err != nil {
+		return "", err
 	}
-
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			if conn != nil {
-				log.Logf(-1, "accept error: %s: %s", conn.RemoteAddr(), err)
-			} else {
-				log.Logf(-1, "accept error: %s", err)
-			}
-			continue
-		}
-		go handleConn(conn)
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = cfg.URL.Hostname()
+	}
+	conn, err := dial(ctx, cfg)
+	if err != nil {
+		return ndog.DialState(err), err
 	}
+	defer conn.Close()
+	_, err = netutil.Connect(ctx, cfg.Net, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, tls.Client(conn, tlsConfig).HandshakeContext(ctx)
+	})
+	return ndog.PortOpen, err
 }
 
-func TLSConnect(cfg ndog.ConnectConfig) error {
+func TLSConnect(ctx context.Context, cfg ndog.ConnectConfig) error {
 	tlsConfig, err := cfg.TLS.Config(false, nil)
 	if err != nil {
 		return err
 	}
 
-	conn, err := tls.Dial("tcp", cfg.URL.Host, tlsConfig)
+	dialer := tls.Dialer{Config: tlsConfig}
+	conn, err := netutil.Connect(ctx, cfg.Net, func(ctx context.Context) (net.Conn, error) {
+		return dialer.DialContext(ctx, "tcp", cfg.URL.Host)
+	})
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
 
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
 	remoteAddr := conn.RemoteAddr()
-	log.Logf(0, "connected: %s", remoteAddr)
-	defer log.Logf(0, "closed: %s", remoteAddr)
+	logger := log.With("scheme", cfg.URL.Scheme, "stream", remoteAddr.String(), "remote_addr", remoteAddr)
+	logger.Logf(0, "connected: %s", remoteAddr)
 
-	bidirectionalCopy(conn, cfg.Stream)
+	sent, recv := bidirectionalCopy(logger, conn, cfg.Stream, true)
+	logger.With("bytes_sent", sent, "bytes_recv", recv).Logf(0, "closed: %s", remoteAddr)
 
 	return nil
 }
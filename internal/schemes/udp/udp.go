@@ -1,18 +1,26 @@
 package udp
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/isobit/ndog/internal"
 	"github.com/isobit/ndog/internal/log"
+	"github.com/isobit/ndog/internal/netutil"
 )
 
 var Scheme = &ndog.Scheme{
 	Names:   []string{"udp"},
 	Connect: Connect,
 	Listen:  Listen,
+	Probe:   Probe,
 
 	Description: `
 Connect opens a UDP connection to the server host and port specified in the URL.
@@ -24,15 +32,76 @@ Examples:
 	`,
 }
 
-func Listen(cfg ndog.ListenConfig) error {
-	conn, err := cfg.Net.ListenPacket("udp", cfg.URL.Host)
+func Listen(ctx context.Context, cfg ndog.ListenConfig) error {
+	conn, err := cfg.Net.ListenPacket(ctx, "udp", cfg.URL.Host)
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
-	log.Logf(0, "listening: %s", conn.LocalAddr())
+	log.With("scheme", cfg.URL.Scheme, "addr", conn.LocalAddr()).Logf(0, "listening: %s", conn.LocalAddr())
+
+	stop := context.AfterFunc(ctx, func() {
+		log.Logf(1, "closing listener: %s", conn.LocalAddr())
+		conn.Close()
+	})
+	defer stop()
+
+	// Streams are removed once they are done sending for any reason other
+	// than EOF, e.g. a timeout. Streams which have sent EOF may still
+	// receive, so they are only removed once a datagram finds them closed.
+	var mu sync.Mutex
+	streams := map[string]*ndog.MessageStream{}
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, stream := range streams {
+			stream.Close()
+		}
+	}()
+	removeStream := func(remoteAddrStr string, stream *ndog.MessageStream) {
+		mu.Lock()
+		defer mu.Unlock()
+		if streams[remoteAddrStr] == stream {
+			delete(streams, remoteAddrStr)
+		}
+	}
 
-	streams := map[string]ndog.Stream{}
+	getStream := func(logger log.Logger, remoteAddr net.Addr) (*ndog.MessageStream, error) {
+		remoteAddrStr := remoteAddr.String()
+		mu.Lock()
+		stream, ok := streams[remoteAddrStr]
+		mu.Unlock()
+		if ok {
+			logger.Logf(10, "using existing stream: %s", remoteAddrStr)
+			return stream, nil
+		}
+		logger.Logf(10, "creating new stream: %s", remoteAddrStr)
+		s, err := ndog.NewMessageStream(cfg.StreamManager, remoteAddrStr, ndog.StreamMetadata{
+			Scheme:     cfg.URL.Scheme,
+			RemoteAddr: remoteAddrStr,
+			LocalAddr:  conn.LocalAddr().String(),
+		}, ndog.RawFraming)
+		if err != nil {
+			return nil, err
+		}
+		stream = &s
+		mu.Lock()
+		streams[remoteAddrStr] = stream
+		mu.Unlock()
+		go func() {
+			err := sendMessages(logger, stream.Reader, func(msg []byte) error {
+				_, err := conn.WriteTo(msg, remoteAddr)
+				return err
+			})
+			// EOF only means that the stream is done sending, but
+			// anything else, e.g. a timeout, means it is done.
+			if err != io.EOF {
+				removeStream(remoteAddrStr, stream)
+				stream.Close()
+			}
+		}()
+		return stream, nil
+	}
 
 	// ReadFrom dequeues an entire packet from the socket each time it's
 	// called, so the buffer needs to have enough space to read entire packets
@@ -43,63 +112,136 @@ func Listen(cfg ndog.ListenConfig) error {
 	for {
 		nr, remoteAddr, err := conn.ReadFrom(buf)
 		if err != nil {
-			if err == io.EOF || err == net.ErrClosed {
+			if ctx.Err() != nil || err == io.EOF || errors.Is(err, net.ErrClosed) {
 				return nil
 			}
 			return err
 		}
 		remoteAddrStr := remoteAddr.String()
-		log.Logf(10, "%d bytes from %s", nr, remoteAddrStr)
-
-		var stream ndog.Stream
-		if existingStream, ok := streams[remoteAddrStr]; ok {
-			log.Logf(10, "using existing stream: %s", remoteAddrStr)
-			stream = existingStream
-		} else {
-			log.Logf(10, "creating new stream: %s", remoteAddrStr)
-			stream = cfg.StreamManager.NewStream(remoteAddrStr)
-			// TODO close stream reader on timeout
-			streams[remoteAddrStr] = stream
-			go io.Copy(&connWriter{conn: conn, addr: remoteAddr}, stream.Reader)
-		}
+		logger := log.With("scheme", cfg.URL.Scheme, "stream", remoteAddrStr, "remote_addr", remoteAddrStr)
+		logger.With("bytes", nr).Logf(10, "%d bytes from %s", nr, remoteAddrStr)
 
-		// TODO close stream writer on timeout
-		_, err = stream.Writer.Write(buf[:nr])
+		stream, err := getStream(logger, remoteAddr)
 		if err != nil {
-			return err
+			logger.Logf(-1, "stream error, dropping datagram: %s: %s", remoteAddrStr, err)
+			continue
+		}
+		if err := stream.Writer.WriteMessage(bytes.Clone(buf[:nr])); err != nil {
+			// The stream was closed, e.g. by a timeout, so the datagram
+			// starts a new one.
+			logger.Logf(10, "stream closed: %s: %s", remoteAddrStr, err)
+			removeStream(remoteAddrStr, stream)
+			stream.Close()
+			if stream, err = getStream(logger, remoteAddr); err != nil {
+				logger.Logf(-1, "stream error, dropping datagram: %s: %s", remoteAddrStr, err)
+				continue
+			}
+			if err := stream.Writer.WriteMessage(bytes.Clone(buf[:nr])); err != nil {
+				logger.Logf(-1, "write error, dropping datagram: %s: %s", remoteAddrStr, err)
+			}
 		}
 	}
 }
 
-type connWriter struct {
-	conn net.PacketConn
-	addr net.Addr
-}
-
-func (w *connWriter) Write(p []byte) (int, error) {
-	return w.conn.WriteTo(p, w.addr)
+// sendMessages sends each message read from r as a datagram until r is done,
+// returning the error which ended it.
+func sendMessages(logger log.Logger, r ndog.MessageReader, send func([]byte) error) error {
+	for {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			switch {
+			case errors.Is(err, netutil.ErrIdleTimeout):
+				// Datagrams have no end, so an idle timeout is
+				// how streams usually end.
+				logger.Logf(1, "closed: %s", err)
+			case err != io.EOF && !ndog.IsIOClosedErr(err):
+				logger.Logf(-1, "read error: %s", err)
+			}
+			return err
+		}
+		if err := send(msg); err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Logf(-1, "write error: %s", err)
+			}
+			return err
+		}
+	}
 }
 
-func Connect(cfg ndog.ConnectConfig) error {
+func Connect(ctx context.Context, cfg ndog.ConnectConfig) error {
 	addr, err := net.ResolveUDPAddr("udp", cfg.URL.Host)
 	if err != nil {
 		return fmt.Errorf("invalid address: %w", err)
 	}
 
-	conn, err := net.DialUDP("udp", nil, addr)
+	conn, err := cfg.Net.DialContext(ctx, "udp", addr.String())
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
 
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
 	remoteAddr := conn.RemoteAddr()
-	log.Logf(0, "connected: %s", remoteAddr)
+	logger := log.With("scheme", cfg.URL.Scheme, "stream", remoteAddr.String(), "remote_addr", remoteAddr)
+	logger.Logf(0, "connected: %s", remoteAddr)
 
-	stream := cfg.Stream
+	stream := cfg.MessageStream(ndog.RawFraming)
 
-	go io.Copy(conn, stream.Reader)
-	_, err = io.Copy(stream.Writer, conn)
+	go sendMessages(logger, stream.Reader, func(msg []byte) error {
+		_, err := conn.Write(msg)
+		return err
+	})
 
-	log.Logf(0, "closed: %s", remoteAddr)
-	return err
+	buf := make([]byte, 65535)
+	for {
+		nr, err := conn.Read(buf)
+		if err != nil {
+			logger.Logf(0, "closed: %s", remoteAddr)
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if err := stream.Writer.WriteMessage(bytes.Clone(buf[:nr])); err != nil {
+			logger.Logf(0, "closed: %s", remoteAddr)
+			if ndog.IsIOClosedErr(err) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// Probe sends an empty datagram and waits up to the connect timeout for a
+// response. A response means the port is open, and an ICMP port unreachable
+// means it is closed, but no response can mean either open or filtered.
+func Probe(ctx context.Context, cfg ndog.Config) (ndog.PortState, error) {
+	conn, err := cfg.Net.DialContext(ctx, "udp", cfg.URL.Host)
+	if err != nil {
+		return ndog.DialState(err), err
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	if cfg.Net.ConnectTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(cfg.Net.ConnectTimeout))
+	}
+	if _, err := conn.Write(nil); err != nil {
+		return ndog.DialState(err), err
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return ndog.PortOpenFiltered, nil
+		}
+		return ndog.DialState(err), err
+	}
+	return ndog.PortOpen, nil
 }
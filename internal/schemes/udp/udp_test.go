@@ -0,0 +1,80 @@
+package udp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/isobit/ndog/internal"
+)
+
+type echoStreamManager struct{}
+
+func (echoStreamManager) NewStream(name string, meta ndog.StreamMetadata) (ndog.Stream, error) {
+	return ndog.Stream{}, fmt.Errorf("not a message stream")
+}
+
+func (echoStreamManager) NewMessageStream(name string, meta ndog.StreamMetadata, framing ndog.Framing) (ndog.MessageStream, error) {
+	r, w := ndog.MessagePipe()
+	return ndog.MessageStream{Reader: r, Writer: w}, nil
+}
+
+func TestListenShapePreservesDatagrams(t *testing.T) {
+	// Find a free port to listen on.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := pc.LocalAddr().String()
+	pc.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- Listen(ctx, ndog.ListenConfig{
+			Config: ndog.Config{URL: &url.URL{Scheme: "udp", Host: addr}},
+			StreamManager: &ndog.ShapeStreamManager{
+				StreamManager: echoStreamManager{},
+				Send:          ndog.Shaping{Latency: 50 * time.Millisecond, Fragment: 2},
+				Recv:          ndog.Shaping{Rate: 1000, Fragment: 2},
+			},
+		})
+	}()
+
+	conn, err := net.Dial("udp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	msgs := []string{"hello", "world!"}
+	buf := make([]byte, 1024)
+	var got []string
+	// The listener may not be up yet, so retry the first datagram.
+	for attempt := 0; len(got) == 0 && attempt < 20; attempt++ {
+		_, err = conn.Write([]byte(msgs[0]))
+		require.NoError(t, err)
+		conn.SetReadDeadline(time.Now().Add(250 * time.Millisecond))
+		n, err := conn.Read(buf)
+		if err != nil {
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+		got = append(got, string(buf[:n]))
+	}
+	_, err = conn.Write([]byte(msgs[1]))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	got = append(got, string(buf[:n]))
+
+	// Each datagram is shaped as a whole, rather than fragmented.
+	assert.Equal(t, msgs, got)
+
+	cancel()
+	require.NoError(t, <-done)
+}
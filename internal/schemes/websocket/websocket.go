@@ -1,11 +1,15 @@
 package websocket
 
 import (
-	"bufio"
+	"context"
 	"errors"
+	"io"
 	"net"
 	"net/http"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -13,6 +17,7 @@ import (
 
 	"github.com/isobit/ndog/internal"
 	"github.com/isobit/ndog/internal/log"
+	"github.com/isobit/ndog/internal/netutil"
 	"github.com/isobit/ndog/internal/util"
 )
 
@@ -21,6 +26,10 @@ var WSScheme = &ndog.Scheme{
 	Listen:  Listen,
 	Connect: Connect,
 
+	NewCompleter: func(ndog.Config) ndog.Completer {
+		return &ndog.HistoryCompleter{}
+	},
+
 	Description: `
 Connect opens a WebSocket connection to the specified URL.
 
@@ -35,14 +44,21 @@ Examples:
 
 type ListenOptions struct {
 	MessageType int
+	Framing     ndog.Framing
 }
 
 var listenOptionHelp = ndog.OptionsHelp{}.
+	Add("raw", "", "Don't delimit messages with newlines when reading from or writing to a byte stream").
 	Add("text", "", "Send using text data frames instead of binary")
 
 func extractListenOptions(opts ndog.Options) (ListenOptions, error) {
 	o := ListenOptions{
 		MessageType: websocket.BinaryMessage,
+		Framing:     ndog.LineFraming,
+	}
+
+	if _, ok := opts.Pop("raw"); ok {
+		o.Framing = ndog.RawFraming
 	}
 
 	if _, ok := opts.Pop("text"); ok {
@@ -51,36 +67,54 @@ func extractListenOptions(opts ndog.Options) (ListenOptions, error) {
 
 	return o, opts.Done()
 }
-func Listen(cfg ndog.ListenConfig) error {
+func Listen(ctx context.Context, cfg ndog.ListenConfig) error {
 	opts, err := extractListenOptions(cfg.Options)
 	if err != nil {
 		return err
 	}
 
+	// Upgraded connections are hijacked from the HTTP server, so they are not
+	// waited on during server shutdown and need to be tracked separately.
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
 	s := &http.Server{
 		Addr: cfg.URL.Host,
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			log.Logf(0, "request: %s: %s %s", r.RemoteAddr, r.Method, r.URL)
+			logger := log.With("scheme", cfg.URL.Scheme, "stream", r.RemoteAddr, "remote_addr", r.RemoteAddr, "path", r.URL.Path)
+			logger.Logf(0, "request: %s: %s %s", r.RemoteAddr, r.Method, r.URL)
 			if r.Host != cfg.URL.Host {
-				log.Logf(1, "request header: Host: %s", r.Host)
+				logger.Logf(1, "request header: Host: %s", r.Host)
 			}
 			util.LogHeaders("request header: ", r.Header)
 
+			wg.Add(1)
+			defer wg.Done()
+
 			upgrader := &websocket.Upgrader{}
 			conn, err := upgrader.Upgrade(w, r, nil)
 			if err != nil {
-				log.Logf(-1, "error upgrading request: %w", err)
+				logger.Logf(-1, "error upgrading request: %s", err)
 				return
 			}
 			defer conn.Close()
 
-			log.Logf(2, "upgraded %s", r.RemoteAddr)
-			defer log.Logf(1, "closed: %s", r.RemoteAddr)
+			logger.Logf(2, "upgraded %s", r.RemoteAddr)
+			defer logger.Logf(1, "closed: %s", r.RemoteAddr)
 
-			stream := cfg.StreamManager.NewStream(r.RemoteAddr)
+			stream, err := ndog.NewMessageStream(cfg.StreamManager, r.RemoteAddr, ndog.NewHTTPStreamMetadata(cfg.URL.Scheme, r), opts.Framing)
+			if err != nil {
+				logger.Logf(-1, "stream error: %s: %s", r.RemoteAddr, err)
+				conn.WriteControl(
+					websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseInternalServerErr, ""),
+					time.Now().Add(closeTimeout),
+				)
+				return
+			}
 			defer stream.Close()
 
-			bidirectionalCopy(conn, stream, opts.MessageType)
+			bidirectionalCopy(logger, conn, recordSent(stream, cfg.Completer), opts.MessageType, false)
 		}),
 	}
 	if cfg.URL.Scheme == "wss" {
@@ -89,11 +123,8 @@ func Listen(cfg ndog.ListenConfig) error {
 			return err
 		}
 		s.TLSConfig = tlsConfig
-		log.Logf(0, "listening: %s", s.Addr)
-		return s.ListenAndServeTLS("", "")
 	}
-	log.Logf(0, "listening: %s", s.Addr)
-	return s.ListenAndServe()
+	return cfg.Net.ServeHTTP(ctx, s)
 }
 
 type ConnectOptions struct {
@@ -101,12 +132,14 @@ type ConnectOptions struct {
 	Protocol    string
 	Headers     map[string]string
 	MessageType int
+	Framing     ndog.Framing
 }
 
 var connectOptionHelp = ndog.OptionsHelp{}.
 	Add("header.<NAME>", "<VALUE>", "extra request headers to send").
 	Add("origin", "<ORIGIN>", "").
 	Add("protocol", "<PROTOCOL>", "").
+	Add("raw", "", "Don't delimit messages with newlines when reading from or writing to a byte stream").
 	Add("text", "", "Send using text data frames instead of binary")
 
 func extractConnectOptions(opts ndog.Options) (ConnectOptions, error) {
@@ -114,6 +147,11 @@ func extractConnectOptions(opts ndog.Options) (ConnectOptions, error) {
 		Origin:      "http://localhost",
 		Headers:     map[string]string{},
 		MessageType: websocket.BinaryMessage,
+		Framing:     ndog.LineFraming,
+	}
+
+	if _, ok := opts.Pop("raw"); ok {
+		o.Framing = ndog.RawFraming
 	}
 
 	if val, ok := opts.Pop("origin"); ok {
@@ -141,7 +179,7 @@ func extractConnectOptions(opts ndog.Options) (ConnectOptions, error) {
 	return o, opts.Done()
 }
 
-func Connect(cfg ndog.ConnectConfig) error {
+func Connect(ctx context.Context, cfg ndog.ConnectConfig) error {
 	opts, err := extractConnectOptions(cfg.Options)
 	if err != nil {
 		return err
@@ -165,65 +203,156 @@ func Connect(cfg ndog.ConnectConfig) error {
 		dialer.Subprotocols = []string{opts.Protocol}
 	}
 
-	conn, _, err := dialer.Dial(cfg.URL.String(), header)
+	conn, err := netutil.Connect(ctx, cfg.Net, func(ctx context.Context) (*websocket.Conn, error) {
+		conn, _, err := dialer.DialContext(ctx, cfg.URL.String(), header)
+		return conn, err
+	})
 	if err != nil {
 		return err
 	}
 
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
 	remoteAddr := conn.RemoteAddr()
-	log.Logf(0, "connected: %s", remoteAddr)
+	logger := log.With("scheme", cfg.URL.Scheme, "stream", remoteAddr.String(), "remote_addr", remoteAddr)
+	logger.Logf(0, "connected: %s", remoteAddr)
 	defer func() {
 		conn.Close()
-		log.Logf(0, "closed: %s", remoteAddr)
+		logger.Logf(0, "closed: %s", remoteAddr)
 	}()
 
-	bidirectionalCopy(conn, cfg.Stream, opts.MessageType)
+	bidirectionalCopy(logger, conn, recordSent(cfg.MessageStream(opts.Framing), cfg.Completer), opts.MessageType, true)
 
 	return nil
 }
 
-func bidirectionalCopy(conn *websocket.Conn, stream ndog.Stream, sendMsgType int) {
+// recordSent wraps the stream so that messages sent from it are added to the
+// completer's history in interactive mode.
+func recordSent(stream ndog.MessageStream, completer ndog.Completer) ndog.MessageStream {
+	history, ok := completer.(*ndog.HistoryCompleter)
+	if !ok {
+		return stream
+	}
+	stream.Reader = historyReader{MessageReadCloser: stream.Reader, history: history}
+	return stream
+}
+
+type historyReader struct {
+	ndog.MessageReadCloser
+	history *ndog.HistoryCompleter
+}
+
+func (r historyReader) ReadMessage() ([]byte, error) {
+	msg, err := r.MessageReadCloser.ReadMessage()
+	if err == nil {
+		r.history.Add(string(msg))
+	}
+	return msg, err
+}
+
+// closeTimeout is how long to wait for the remote to reply to a close frame
+// before giving up on the closing handshake.
+const closeTimeout = 5 * time.Second
+
+// bidirectionalCopy copies messages in both directions between conn and
+// stream until both directions are done. EOF from the stream starts the
+// closing handshake, and a close frame from the remote is propagated to the
+// stream as a half-close. Replying to the remote's close frame is deferred
+// until the stream is done sending, so that a complete response can still be
+// sent, unless closeOnRemoteClose is set, in which case the stream is closed
+// as soon as the remote closes.
+func bidirectionalCopy(logger log.Logger, conn *websocket.Conn, stream ndog.MessageStream, sendMsgType int, closeOnRemoteClose bool) {
+	conn.SetCloseHandler(func(code int, text string) error {
+		return nil
+	})
+
+	var remoteClosed atomic.Bool
+
 	wg := conc.WaitGroup{}
 	wg.Go(func() {
-		defer conn.Close()
-		defer stream.Close()
-
 		for {
 			msgType, msg, err := conn.ReadMessage()
 			if err != nil {
-				if !errors.Is(err, net.ErrClosed) {
-					log.Logf(-1, "read error: %s", err)
+				var closeErr *websocket.CloseError
+				switch {
+				case errors.As(err, &closeErr):
+					logger.Logf(1, "received close: %d %s", closeErr.Code, closeErr.Text)
+					remoteClosed.Store(true)
+					stream.CloseWrite()
+					if closeOnRemoteClose {
+						stream.Close()
+					}
+					return
+				case errors.Is(err, os.ErrDeadlineExceeded):
+					logger.Logf(1, "timed out waiting for close")
+				case !errors.Is(err, net.ErrClosed):
+					logger.Logf(-1, "read error: %s", err)
 				}
+				stream.Close()
 				return
 			}
-			log.Logf(2, "received message (type=%d)", msgType)
-			if _, err := stream.Writer.Write(append(msg, '\n')); err != nil {
+			logger.With("bytes", len(msg)).Logf(2, "received message (type=%d)", msgType)
+			if err := stream.Writer.WriteMessage(msg); err != nil {
+				// A closed error means the other direction is already
+				// tearing things down, so leave it to finish.
 				if !ndog.IsIOClosedErr(err) {
-					log.Logf(-1, "read error: %s", err)
+					logger.Logf(-1, "read error: %s", err)
+					stream.Close()
 				}
 				return
 			}
 		}
 	})
 	wg.Go(func() {
-		defer conn.Close()
-		defer stream.Close()
-
-		s := bufio.NewScanner(stream.Reader)
-		for s.Scan() {
-			if err := conn.WriteMessage(sendMsgType, s.Bytes()); err != nil {
+		for {
+			msg, err := stream.Reader.ReadMessage()
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				closed := ndog.IsIOClosedErr(err)
+				if !closed {
+					logger.Logf(-1, "write error: %s", err)
+				}
+				// The stream being closed after the remote closed is
+				// expected, and still warrants a close frame in reply.
+				if !closed || !remoteClosed.Load() {
+					conn.Close()
+					return
+				}
+				break
+			}
+			if err := conn.WriteMessage(sendMsgType, msg); err != nil {
 				if !errors.Is(err, net.ErrClosed) {
-					log.Logf(-1, "write error: %s", err)
+					logger.Logf(-1, "write error: %s", err)
 				}
+				conn.Close()
 				return
 			}
-			log.Logf(2, "sent message")
+			logger.With("bytes", len(msg)).Logf(2, "sent message")
 		}
-		if err := s.Err(); err != nil {
-			if !ndog.IsIOClosedErr(err) {
-				log.Logf(-1, "write error: %s", err)
+
+		logger.Logf(2, "sending close")
+		deadline := time.Now().Add(closeTimeout)
+		msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+		if err := conn.WriteControl(websocket.CloseMessage, msg, deadline); err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Logf(-1, "write error: %s", err)
 			}
+			conn.Close()
+			return
+		}
+		if remoteClosed.Load() {
+			// Closing handshake is complete.
+			conn.Close()
+			return
 		}
+		// Leave the reader to receive any remaining messages until the
+		// remote replies with its own close frame.
+		conn.SetReadDeadline(deadline)
 	})
 	wg.Wait()
 }
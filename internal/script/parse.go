@@ -0,0 +1,346 @@
+// Package script implements a small send/expect language for scripting
+// protocol dialogues over a stream.
+//
+// A script is a sequence of commands, one per line. Blank lines and lines
+// starting with # are ignored, and a line of the form "NAME:" defines a label.
+// STRING arguments must be double-quoted, and support Go escape sequences and
+// references to variables as $NAME or ${NAME}; use $$ for a literal $. REGEX
+// arguments are delimited by slashes, and all other arguments, i.e. names,
+// labels, durations, exit codes and keywords, are bare words.
+//
+//	send STRING...                         send the concatenated strings
+//	sendhex STRING...                      send hex encoded bytes, ignoring whitespace
+//	expect /REGEX/ [timeout DUR] [else L]  wait for received data matching REGEX
+//	if STRING /REGEX/ LABEL                jump to LABEL if STRING matches REGEX
+//	goto LABEL                             jump to LABEL
+//	set NAME STRING                        set a variable
+//	timeout DUR                            set the default expect timeout
+//	sleep DUR                              pause
+//	print STRING...                        write a line to the output
+//	close                                  send EOF
+//	exit                                   end the script successfully
+//	fail [CODE] [STRING]                   end the script with an exit code
+//
+// Matching with expect or if sets the variables $0 (the whole match), $1, $2,
+// etc. for groups, and named groups by name. Received data up to the end of
+// the match is consumed. If expect times out or the remote sends EOF first,
+// the script jumps to the else label if given, or fails otherwise.
+package script
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type opcode string
+
+const (
+	opSend    opcode = "send"
+	opSendHex opcode = "sendhex"
+	opExpect  opcode = "expect"
+	opIf      opcode = "if"
+	opGoto    opcode = "goto"
+	opSet     opcode = "set"
+	opTimeout opcode = "timeout"
+	opSleep   opcode = "sleep"
+	opPrint   opcode = "print"
+	opClose   opcode = "close"
+	opExit    opcode = "exit"
+	opFail    opcode = "fail"
+)
+
+// instr is a single parsed command; which fields are used depends on op.
+type instr struct {
+	line     int
+	op       opcode
+	strings  []string
+	name     string
+	re       *regexp.Regexp
+	duration time.Duration
+	label    string
+	code     int
+}
+
+type Script struct {
+	instrs []instr
+	labels map[string]int
+}
+
+// SyntaxError is returned by Parse for an invalid script.
+type SyntaxError struct {
+	Line int
+	Err  error
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err)
+}
+
+func (e *SyntaxError) Unwrap() error {
+	return e.Err
+}
+
+func Parse(r io.Reader) (*Script, error) {
+	s := &Script{
+		labels: map[string]int{},
+	}
+	labelLines := map[string]int{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if label, ok := strings.CutSuffix(text, ":"); ok && isName(label) {
+			if _, ok := s.labels[label]; ok {
+				return nil, &SyntaxError{line, fmt.Errorf("duplicate label: %s", label)}
+			}
+			s.labels[label] = len(s.instrs)
+			continue
+		}
+		tokens, err := tokenize(text)
+		if err != nil {
+			return nil, &SyntaxError{line, err}
+		}
+		in, err := parseInstr(tokens)
+		if err != nil {
+			return nil, &SyntaxError{line, err}
+		}
+		in.line = line
+		if in.label != "" {
+			labelLines[in.label] = line
+		}
+		s.instrs = append(s.instrs, in)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for label, line := range labelLines {
+		if _, ok := s.labels[label]; !ok {
+			return nil, &SyntaxError{line, fmt.Errorf("undefined label: %s", label)}
+		}
+	}
+	return s, nil
+}
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenString
+	tokenRegex
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+}
+
+func tokenize(text string) ([]token, error) {
+	tokens := []token{}
+	for {
+		text = strings.TrimLeft(text, " \t")
+		if text == "" || text[0] == '#' {
+			return tokens, nil
+		}
+		switch text[0] {
+		case '"':
+			end := 1
+			for ; end < len(text) && text[end] != '"'; end++ {
+				if text[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(text) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			s, err := strconv.Unquote(text[:end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string %s: %w", text[:end+1], err)
+			}
+			tokens = append(tokens, token{tokenString, s})
+			text = text[end+1:]
+		case '/':
+			var sb strings.Builder
+			end := 1
+			for ; end < len(text) && text[end] != '/'; end++ {
+				if text[end] == '\\' && end+1 < len(text) && text[end+1] == '/' {
+					end++
+				}
+				sb.WriteByte(text[end])
+			}
+			if end >= len(text) {
+				return nil, fmt.Errorf("unterminated regex")
+			}
+			tokens = append(tokens, token{tokenRegex, sb.String()})
+			text = text[end+1:]
+		default:
+			end := strings.IndexAny(text, " \t")
+			if end < 0 {
+				end = len(text)
+			}
+			tokens = append(tokens, token{tokenWord, text[:end]})
+			text = text[end:]
+		}
+	}
+}
+
+func parseInstr(tokens []token) (instr, error) {
+	if tokens[0].kind != tokenWord {
+		return instr{}, fmt.Errorf("expected command")
+	}
+	in := instr{op: opcode(tokens[0].value)}
+	args := tokens[1:]
+
+	word := func() (string, error) {
+		if len(args) == 0 || args[0].kind != tokenWord {
+			return "", fmt.Errorf("%s: expected word", in.op)
+		}
+		w := args[0].value
+		args = args[1:]
+		return w, nil
+	}
+	label := func() (string, error) {
+		w, err := word()
+		if err != nil || !isName(w) {
+			return "", fmt.Errorf("%s: expected label", in.op)
+		}
+		return w, nil
+	}
+	str := func() (string, error) {
+		if len(args) == 0 || args[0].kind != tokenString {
+			return "", fmt.Errorf("%s: expected string", in.op)
+		}
+		s := args[0].value
+		args = args[1:]
+		return s, nil
+	}
+	regex := func() (*regexp.Regexp, error) {
+		if len(args) == 0 || args[0].kind != tokenRegex {
+			return nil, fmt.Errorf("%s: expected regex", in.op)
+		}
+		re, err := regexp.Compile(args[0].value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", in.op, err)
+		}
+		args = args[1:]
+		return re, nil
+	}
+	duration := func() (time.Duration, error) {
+		w, err := word()
+		if err != nil {
+			return 0, err
+		}
+		d, err := time.ParseDuration(w)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", in.op, err)
+		}
+		return d, nil
+	}
+
+	var err error
+	switch in.op {
+	case opSend, opSendHex, opPrint:
+		for len(args) > 0 {
+			s, err := str()
+			if err != nil {
+				return in, err
+			}
+			in.strings = append(in.strings, s)
+		}
+		if in.op != opPrint && len(in.strings) == 0 {
+			return in, fmt.Errorf("%s: expected string", in.op)
+		}
+	case opExpect:
+		if in.re, err = regex(); err != nil {
+			return in, err
+		}
+		for len(args) > 0 {
+			kw, _ := word()
+			switch kw {
+			case "timeout":
+				if in.duration, err = duration(); err != nil {
+					return in, err
+				}
+			case "else":
+				if in.label, err = label(); err != nil {
+					return in, err
+				}
+			default:
+				return in, fmt.Errorf("expect: expected timeout or else")
+			}
+		}
+	case opIf:
+		s, err := str()
+		if err != nil {
+			return in, err
+		}
+		in.strings = []string{s}
+		if in.re, err = regex(); err != nil {
+			return in, err
+		}
+		if in.label, err = label(); err != nil {
+			return in, err
+		}
+	case opGoto:
+		if in.label, err = label(); err != nil {
+			return in, err
+		}
+	case opSet:
+		if in.name, err = word(); err != nil || !isName(in.name) {
+			return in, fmt.Errorf("set: expected variable name")
+		}
+		s, err := str()
+		if err != nil {
+			return in, err
+		}
+		in.strings = []string{s}
+	case opTimeout, opSleep:
+		if in.duration, err = duration(); err != nil {
+			return in, err
+		}
+	case opClose, opExit:
+	case opFail:
+		in.code = 1
+		if len(args) > 0 && args[0].kind == tokenWord {
+			w, _ := word()
+			if in.code, err = strconv.Atoi(w); err != nil || in.code < 1 || in.code > 255 {
+				return in, fmt.Errorf("fail: invalid exit code: %s", w)
+			}
+		}
+		if len(args) > 0 {
+			s, err := str()
+			if err != nil {
+				return in, err
+			}
+			in.strings = []string{s}
+		}
+	default:
+		return in, fmt.Errorf("unknown command: %s", in.op)
+	}
+	if len(args) > 0 {
+		return in, fmt.Errorf("%s: unexpected argument", in.op)
+	}
+	return in, nil
+}
+
+func isName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !isNameRune(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func isNameRune(r rune) bool {
+	return r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+}
@@ -0,0 +1,261 @@
+package script
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/isobit/ndog/internal/log"
+)
+
+// DefaultTimeout is how long expect waits unless changed by the timeout
+// command or its own timeout.
+const DefaultTimeout = 10 * time.Second
+
+// ExitError is returned by Run when a script fails.
+type ExitError struct {
+	Line    int
+	Code    int
+	Message string
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("script failed at line %d: %s", e.Line, e.Message)
+}
+
+func (e *ExitError) ExitCode() int {
+	return e.Code
+}
+
+// Run runs the script, sending to w and expecting data read from r. Output of
+// the print command is written to out. w is closed with EOF by the close
+// command, but otherwise is left open.
+func (s *Script) Run(ctx context.Context, r io.Reader, w io.WriteCloser, out io.Writer) error {
+	rn := &runner{
+		script:  s,
+		w:       w,
+		out:     out,
+		vars:    map[string]string{},
+		timeout: DefaultTimeout,
+		notify:  make(chan struct{}, 1),
+	}
+	go rn.receive(r)
+
+	for pc := 0; pc < len(s.instrs); pc++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		in := s.instrs[pc]
+		log.Logf(2, "script: line %d: %s", in.line, in.op)
+		jump, err := rn.exec(ctx, in)
+		if err == errExit {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if jump != "" {
+			pc = s.labels[jump] - 1
+		}
+	}
+	return nil
+}
+
+type runner struct {
+	script  *Script
+	w       io.WriteCloser
+	out     io.Writer
+	vars    map[string]string
+	timeout time.Duration
+
+	mu     sync.Mutex
+	buf    []byte
+	eof    bool
+	notify chan struct{}
+}
+
+// receive buffers data from r until EOF, for expect to match against.
+func (rn *runner) receive(r io.Reader) {
+	b := make([]byte, 4096)
+	for {
+		n, err := r.Read(b)
+		rn.mu.Lock()
+		rn.buf = append(rn.buf, b[:n]...)
+		rn.eof = err != nil
+		rn.mu.Unlock()
+		select {
+		case rn.notify <- struct{}{}:
+		default:
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// exec executes a single instruction, returning a label to jump to if any.
+func (rn *runner) exec(ctx context.Context, in instr) (string, error) {
+	fail := func(code int, format string, v ...any) error {
+		return &ExitError{
+			Line:    in.line,
+			Code:    code,
+			Message: fmt.Sprintf(format, v...),
+		}
+	}
+
+	switch in.op {
+	case opSend:
+		data := rn.expand(in.strings...)
+		if _, err := io.WriteString(rn.w, data); err != nil {
+			return "", fail(1, "send: %s", err)
+		}
+	case opSendHex:
+		data, err := hex.DecodeString(strings.Join(strings.Fields(rn.expand(in.strings...)), ""))
+		if err != nil {
+			return "", fail(1, "sendhex: %s", err)
+		}
+		if _, err := rn.w.Write(data); err != nil {
+			return "", fail(1, "sendhex: %s", err)
+		}
+	case opExpect:
+		timeout := rn.timeout
+		if in.duration != 0 {
+			timeout = in.duration
+		}
+		reason, ok := rn.expect(ctx, in, timeout)
+		if ok {
+			break
+		}
+		if in.label != "" {
+			return in.label, nil
+		}
+		return "", fail(1, "%s waiting for /%s/", reason, in.re)
+	case opIf:
+		if m := in.re.FindStringSubmatch(rn.expand(in.strings[0])); m != nil {
+			rn.setMatch(in, m)
+			return in.label, nil
+		}
+	case opGoto:
+		return in.label, nil
+	case opSet:
+		rn.vars[in.name] = rn.expand(in.strings[0])
+	case opTimeout:
+		rn.timeout = in.duration
+	case opSleep:
+		select {
+		case <-time.After(in.duration):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	case opPrint:
+		fmt.Fprintln(rn.out, rn.expand(in.strings...))
+	case opClose:
+		if err := rn.w.Close(); err != nil {
+			return "", fail(1, "close: %s", err)
+		}
+	case opExit:
+		return "", errExit
+	case opFail:
+		msg := "fail"
+		if len(in.strings) > 0 {
+			msg = rn.expand(in.strings[0])
+		}
+		return "", fail(in.code, "%s", msg)
+	}
+	return "", nil
+}
+
+// errExit ends a script successfully, and is never returned from Run.
+var errExit = fmt.Errorf("exit")
+
+// expect waits for buffered data to match, returning the reason if it doesn't.
+func (rn *runner) expect(ctx context.Context, in instr, timeout time.Duration) (string, bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		rn.mu.Lock()
+		loc := in.re.FindSubmatchIndex(rn.buf)
+		if loc != nil {
+			m := make([]string, len(loc)/2)
+			for i := range m {
+				if loc[2*i] >= 0 {
+					m[i] = string(rn.buf[loc[2*i]:loc[2*i+1]])
+				}
+			}
+			rn.buf = rn.buf[loc[1]:]
+			rn.mu.Unlock()
+			rn.setMatch(in, m)
+			return "", true
+		}
+		eof := rn.eof
+		rn.mu.Unlock()
+		if eof {
+			return "EOF", false
+		}
+		select {
+		case <-rn.notify:
+		case <-timer.C:
+			return "timed out", false
+		case <-ctx.Done():
+			return ctx.Err().Error(), false
+		}
+	}
+}
+
+func (rn *runner) setMatch(in instr, m []string) {
+	for i, s := range m {
+		rn.vars[strconv.Itoa(i)] = s
+	}
+	for i, name := range in.re.SubexpNames() {
+		if name != "" {
+			rn.vars[name] = m[i]
+		}
+	}
+}
+
+// expand concatenates strings with variable references replaced.
+func (rn *runner) expand(strs ...string) string {
+	var sb strings.Builder
+	for _, s := range strs {
+		for {
+			i := strings.IndexByte(s, '$')
+			if i < 0 || i == len(s)-1 {
+				sb.WriteString(s)
+				break
+			}
+			sb.WriteString(s[:i])
+			s = s[i+1:]
+			switch {
+			case s[0] == '$':
+				sb.WriteByte('$')
+				s = s[1:]
+			case s[0] == '{':
+				end := strings.IndexByte(s, '}')
+				if end < 0 {
+					sb.WriteString("${")
+					s = s[1:]
+					continue
+				}
+				sb.WriteString(rn.vars[s[1:end]])
+				s = s[end+1:]
+			default:
+				end := strings.IndexFunc(s, func(r rune) bool { return !isNameRune(r) })
+				if end < 0 {
+					end = len(s)
+				}
+				if end == 0 {
+					sb.WriteByte('$')
+					continue
+				}
+				sb.WriteString(rn.vars[s[:end]])
+				s = s[end:]
+			}
+		}
+	}
+	return sb.String()
+}
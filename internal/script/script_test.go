@@ -0,0 +1,121 @@
+package script
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenize(t *testing.T) {
+	tokens, err := tokenize(`expect /a\/b "c"/ timeout 1s # comment`)
+	require.NoError(t, err)
+	assert.Equal(t, []token{
+		{tokenWord, "expect"},
+		{tokenRegex, `a/b "c"`},
+		{tokenWord, "timeout"},
+		{tokenWord, "1s"},
+	}, tokens)
+
+	tokens, err = tokenize(`send "a\"b\r\n" "$x"`)
+	require.NoError(t, err)
+	assert.Equal(t, []token{
+		{tokenWord, "send"},
+		{tokenString, "a\"b\r\n"},
+		{tokenString, "$x"},
+	}, tokens)
+
+	_, err = tokenize(`send "abc`)
+	assert.Error(t, err)
+}
+
+func TestParse(t *testing.T) {
+	s, err := Parse(strings.NewReader(`
+# greeting
+expect /^220 (?P<host>\S+)/ timeout 2s else nogreeting
+send "HELO ${host}\r\n"
+done:
+exit
+nogreeting:
+fail 3 "no greeting"
+`))
+	require.NoError(t, err)
+	require.Len(t, s.instrs, 4)
+	assert.Equal(t, opExpect, s.instrs[0].op)
+	assert.Equal(t, 2*time.Second, s.instrs[0].duration)
+	assert.Equal(t, "nogreeting", s.instrs[0].label)
+	assert.Equal(t, 3, s.instrs[3].code)
+	assert.Equal(t, map[string]int{"done": 2, "nogreeting": 3}, s.labels)
+
+	for _, src := range []string{
+		"bogus",
+		"send",
+		"send bare",
+		"expect /(/",
+		"expect /a/ timeout soon",
+		"goto nowhere",
+		"fail 256",
+		"exit now",
+		"a:\na:",
+	} {
+		_, err := Parse(strings.NewReader(src))
+		var syntaxErr *SyntaxError
+		assert.True(t, errors.As(err, &syntaxErr), "expected syntax error for %q", src)
+	}
+}
+
+func TestRun(t *testing.T) {
+	s, err := Parse(strings.NewReader(`
+timeout 1s
+send "HELO\n"
+expect /^(\d+) (?P<msg>.*)\n/
+if "$1" /^5/ error
+print "ok: $msg"
+sendhex "51 55 49 54 0a"
+expect /bye/ else nobye
+exit
+nobye:
+fail 4 "no bye"
+error:
+fail 2 "error: ${msg}"
+`))
+	require.NoError(t, err)
+
+	run := func(responses ...string) (string, error) {
+		remoteReader, w := io.Pipe()
+		r, remoteWriter := io.Pipe()
+		go func() {
+			br := bufio.NewReader(remoteReader)
+			for _, resp := range responses {
+				br.ReadString('\n')
+				remoteWriter.Write([]byte(resp))
+			}
+			remoteWriter.Close()
+			io.Copy(io.Discard, br)
+		}()
+		var out bytes.Buffer
+		err := s.Run(context.Background(), r, w, &out)
+		return out.String(), err
+	}
+
+	out, err := run("250 hello\n", "bye\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "ok: hello\n", out)
+
+	_, err = run("550 denied\n")
+	var exitErr *ExitError
+	require.True(t, errors.As(err, &exitErr))
+	assert.Equal(t, 2, exitErr.ExitCode())
+	assert.Equal(t, "error: denied", exitErr.Message)
+
+	_, err = run("250 hello\n")
+	require.True(t, errors.As(err, &exitErr))
+	assert.Equal(t, 4, exitErr.ExitCode())
+}
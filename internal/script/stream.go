@@ -0,0 +1,96 @@
+package script
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	ndog "github.com/isobit/ndog/internal"
+	"github.com/isobit/ndog/internal/log"
+)
+
+// StreamManager runs a script for each stream. Once the script is done, the
+// stream sends EOF and stops receiving.
+type StreamManager struct {
+	Script *Script
+	Output io.Writer
+
+	// OnDone, if set, is called for each stream once its script is done and
+	// everything it sent has been read from the stream, e.g. so that a
+	// connection can be closed without waiting for the remote.
+	OnDone func()
+
+	mu  sync.Mutex
+	err error
+}
+
+func NewStreamManager(script *Script, output io.Writer) *StreamManager {
+	return &StreamManager{
+		Script: script,
+		Output: output,
+	}
+}
+
+func (m *StreamManager) NewStream(name string, meta ndog.StreamMetadata) (ndog.Stream, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	recvReader, recvWriter := io.Pipe()
+	sendReader, sendWriter := io.Pipe()
+	reader := &eofReader{
+		Reader: sendReader,
+		eof:    make(chan struct{}),
+	}
+
+	go func() {
+		err := m.Script.Run(ctx, recvReader, sendWriter, m.Output)
+		if err != nil && ctx.Err() == nil {
+			log.Logf(-1, "%s: %s", name, err)
+			m.mu.Lock()
+			if m.err == nil {
+				m.err = err
+			}
+			m.mu.Unlock()
+		}
+		recvReader.Close()
+		sendWriter.Close()
+		if m.OnDone != nil {
+			select {
+			case <-reader.eof:
+			case <-ctx.Done():
+			}
+			m.OnDone()
+		}
+	}()
+
+	return ndog.Stream{
+		Reader: ndog.FuncReadCloser(reader, func() error {
+			cancel()
+			sendReader.Close()
+			return nil
+		}),
+		Writer: recvWriter,
+	}, nil
+}
+
+// Err returns the error of the first script which failed, if any.
+func (m *StreamManager) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// eofReader closes eof once the underlying reader has returned EOF.
+type eofReader struct {
+	io.Reader
+	eof  chan struct{}
+	once sync.Once
+}
+
+func (r *eofReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		r.once.Do(func() {
+			close(r.eof)
+		})
+	}
+	return n, err
+}
@@ -0,0 +1,420 @@
+package ndog
+
+import (
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Shaping simulates network conditions for one direction of a stream.
+type Shaping struct {
+	// Rate limits throughput in bytes per second; 0 is unlimited.
+	Rate int64
+	// Burst is the number of bytes which may be sent at once while within
+	// Rate; it defaults to a tenth of Rate.
+	Burst int64
+	// Latency delays each chunk, with a random +/- Jitter. Chunks are
+	// delayed concurrently, and stay in order.
+	Latency time.Duration
+	Jitter  time.Duration
+	// Fragment splits chunks into pieces of at most this many bytes; 0
+	// doesn't split. It doesn't apply to message streams, whose messages
+	// are never split.
+	Fragment int
+}
+
+func (s Shaping) IsZero() bool {
+	return s == Shaping{}
+}
+
+// ParseShaping parses comma separated KEY=VALUE pairs with keys rate, burst,
+// latency, jitter and fragment, e.g. "rate=10k,latency=100ms". Sizes accept k
+// and m suffixes (powers of 1024).
+func ParseShaping(spec string) (Shaping, error) {
+	s := Shaping{}
+	for _, kv := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok {
+			return s, fmt.Errorf("invalid shaping: expected KEY=VALUE: %s", kv)
+		}
+		var err error
+		switch key {
+		case "rate":
+			s.Rate, err = parseSize(value)
+		case "burst":
+			s.Burst, err = parseSize(value)
+		case "latency":
+			s.Latency, err = time.ParseDuration(value)
+		case "jitter":
+			s.Jitter, err = time.ParseDuration(value)
+		case "fragment":
+			var n int64
+			n, err = parseSize(value)
+			s.Fragment = int(n)
+		default:
+			return s, fmt.Errorf("invalid shaping: unknown key: %s", key)
+		}
+		if err != nil {
+			return s, fmt.Errorf("invalid shaping %s: %w", key, err)
+		}
+	}
+	return s, nil
+}
+
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "k"):
+		mult = 1024
+		s = s[:len(s)-1]
+	case strings.HasSuffix(s, "m"):
+		mult = 1024 * 1024
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("must not be negative: %d", n)
+	}
+	return n * mult, nil
+}
+
+// ShapeStreamManager applies Shaping to streams created by its delegate. Send
+// applies to data read from streams, i.e. sent to the remote, and Recv to data
+// written to them, i.e. received from the remote.
+type ShapeStreamManager struct {
+	StreamManager
+	Send Shaping
+	Recv Shaping
+}
+
+func (m *ShapeStreamManager) NewStream(name string, meta StreamMetadata) (Stream, error) {
+	stream, err := m.StreamManager.NewStream(name, meta)
+	if err != nil {
+		return Stream{}, err
+	}
+	// Closing the reader means the stream is done, so any data still queued
+	// in either direction is dropped rather than waited for.
+	var sendWriter, recvWriter *shapedWriter
+	r := stream.Reader
+	if !m.Send.IsZero() {
+		pr, pw := io.Pipe()
+		sendWriter = newShapedWriter(pw, m.Send, false)
+		go func() {
+			if _, err := io.Copy(sendWriter, r); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			sendWriter.Close()
+		}()
+		stream.Reader = pr
+	}
+	if !m.Recv.IsZero() {
+		recvWriter = newShapedWriter(stream.Writer, m.Recv, false)
+		stream.Writer = recvWriter
+	}
+	if sendWriter != nil || recvWriter != nil {
+		shaped := stream.Reader
+		stream.Reader = FuncReadCloser(shaped, func() error {
+			if sendWriter != nil {
+				sendWriter.abort()
+				shaped.Close()
+			}
+			if recvWriter != nil {
+				recvWriter.abort()
+			}
+			return r.Close()
+		})
+	}
+	return stream, nil
+}
+
+// NewMessageStream shapes whole messages: each is delayed by the latency and
+// sent at once when the rate allows, and is never fragmented.
+func (m *ShapeStreamManager) NewMessageStream(name string, meta StreamMetadata, framing Framing) (MessageStream, error) {
+	stream, err := NewMessageStream(m.StreamManager, name, meta, framing)
+	if err != nil {
+		return MessageStream{}, err
+	}
+	var sendWriter, recvWriter *shapedWriter
+	r := stream.Reader
+	if !m.Send.IsZero() {
+		pr, pw := MessagePipe()
+		sendWriter = newShapedWriter(messageWriterAdapter{pw}, m.Send, true)
+		sr := &shapedMessageReader{MessageReadCloser: pr}
+		go func() {
+			for {
+				msg, err := r.ReadMessage()
+				if err == io.EOF {
+					sendWriter.Close()
+					return
+				}
+				if err == nil {
+					_, err = sendWriter.Write(msg)
+				}
+				if err != nil {
+					// Like for byte streams, the error ends the
+					// stream at once.
+					sr.err = err
+					sendWriter.abort()
+					sendWriter.Close()
+					return
+				}
+			}
+		}()
+		stream.Reader = sr
+	}
+	if !m.Recv.IsZero() {
+		recvWriter = newShapedWriter(messageWriterAdapter{stream.Writer}, m.Recv, true)
+		stream.Writer = messageWriteCloser{
+			MessageWriter: shapedMessageWriter{recvWriter},
+			Closer:        recvWriter,
+		}
+	}
+	if sendWriter != nil || recvWriter != nil {
+		shaped := stream.Reader
+		stream.Reader = messageReadCloser{
+			MessageReader: shaped,
+			Closer: closerFunc(func() error {
+				if sendWriter != nil {
+					sendWriter.abort()
+					shaped.Close()
+				}
+				if recvWriter != nil {
+					recvWriter.abort()
+				}
+				return r.Close()
+			}),
+		}
+	}
+	return stream, nil
+}
+
+// messageWriterAdapter writes each write as a whole message.
+type messageWriterAdapter struct {
+	w MessageWriteCloser
+}
+
+func (a messageWriterAdapter) Write(p []byte) (int, error) {
+	if err := a.w.WriteMessage(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (a messageWriterAdapter) Close() error {
+	return a.w.Close()
+}
+
+type shapedMessageWriter struct {
+	sw *shapedWriter
+}
+
+func (w shapedMessageWriter) WriteMessage(msg []byte) error {
+	_, err := w.sw.Write(msg)
+	return err
+}
+
+// shapedMessageReader reads shaped messages, returning the error which ended
+// the underlying reader, if any, instead of EOF.
+type shapedMessageReader struct {
+	MessageReadCloser
+	// err is set before the pipe is closed.
+	err error
+}
+
+func (r *shapedMessageReader) ReadMessage() ([]byte, error) {
+	msg, err := r.MessageReadCloser.ReadMessage()
+	if err == io.EOF && r.err != nil {
+		return nil, r.err
+	}
+	return msg, err
+}
+
+type shapedChunk struct {
+	data []byte
+	due  time.Time
+}
+
+// shapedWriter queues writes to be forwarded to w once due, at a limited rate.
+// Writes block only once the queue is full, and return any error from
+// forwarding earlier writes.
+type shapedWriter struct {
+	w       io.WriteCloser
+	shaping Shaping
+	// messages is set if each write is a message, which must be forwarded
+	// whole.
+	messages bool
+	queue    chan shapedChunk
+	// closing is closed by Close, after which the queue is drained, and
+	// aborted by abort, after which it is dropped.
+	closing chan struct{}
+	aborted chan struct{}
+	done    chan struct{}
+
+	mu        sync.Mutex
+	err       error
+	lastDue   time.Time
+	closed    bool
+	abortOnce sync.Once
+}
+
+func newShapedWriter(w io.WriteCloser, shaping Shaping, messages bool) *shapedWriter {
+	if shaping.Rate > 0 && shaping.Burst == 0 {
+		shaping.Burst = max(shaping.Rate/10, 1)
+	}
+	sw := &shapedWriter{
+		w:        w,
+		shaping:  shaping,
+		messages: messages,
+		queue:    make(chan shapedChunk, 64),
+		closing:  make(chan struct{}),
+		aborted:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go sw.forward()
+	return sw
+}
+
+func (sw *shapedWriter) Write(p []byte) (int, error) {
+	sw.mu.Lock()
+	if sw.err != nil || sw.closed {
+		err := sw.err
+		sw.mu.Unlock()
+		if err == nil {
+			err = io.ErrClosedPipe
+		}
+		return 0, err
+	}
+	delay := sw.shaping.Latency
+	if j := sw.shaping.Jitter; j > 0 {
+		delay += time.Duration(rand.Int64N(int64(2*j+1))) - j
+	}
+	due := time.Now().Add(delay)
+	if due.Before(sw.lastDue) {
+		due = sw.lastDue
+	}
+	sw.lastDue = due
+	sw.mu.Unlock()
+
+	select {
+	case sw.queue <- shapedChunk{data: append([]byte(nil), p...), due: due}:
+		return len(p), nil
+	case <-sw.done:
+		sw.mu.Lock()
+		defer sw.mu.Unlock()
+		if sw.err != nil {
+			return 0, sw.err
+		}
+		return 0, io.ErrClosedPipe
+	}
+}
+
+// Close closes the underlying writer once all queued writes are forwarded, or
+// at once if the writer is aborted.
+func (sw *shapedWriter) Close() error {
+	sw.mu.Lock()
+	if !sw.closed {
+		sw.closed = true
+		close(sw.closing)
+	}
+	sw.mu.Unlock()
+	<-sw.done
+	return nil
+}
+
+// abort drops all queued writes and closes the underlying writer.
+func (sw *shapedWriter) abort() {
+	sw.abortOnce.Do(func() {
+		close(sw.aborted)
+	})
+}
+
+func (sw *shapedWriter) forward() {
+	defer close(sw.done)
+	defer sw.w.Close()
+
+	tokens := float64(sw.shaping.Burst)
+	last := time.Now()
+	// sleep returns false if the writer was aborted in the meantime.
+	sleep := func(d time.Duration) bool {
+		if d <= 0 {
+			return true
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return true
+		case <-sw.aborted:
+			return false
+		}
+	}
+	send := func(chunk shapedChunk) bool {
+		if !sleep(time.Until(chunk.due)) {
+			return false
+		}
+		// Write at least once, so that empty messages are forwarded.
+		for p, first := chunk.data, true; first || len(p) > 0; first = false {
+			n := len(p)
+			if sw.shaping.Fragment > 0 && !sw.messages {
+				n = min(n, sw.shaping.Fragment)
+			}
+			if sw.shaping.Rate > 0 {
+				if !sw.messages {
+					n = min(n, int(sw.shaping.Burst))
+				}
+				// Refill the token bucket, then wait for enough
+				// tokens to send n bytes.
+				now := time.Now()
+				tokens = min(tokens+now.Sub(last).Seconds()*float64(sw.shaping.Rate), float64(sw.shaping.Burst))
+				last = now
+				if deficit := float64(n) - tokens; deficit > 0 {
+					if !sleep(time.Duration(deficit / float64(sw.shaping.Rate) * float64(time.Second))) {
+						return false
+					}
+					tokens = float64(n)
+					last = time.Now()
+				}
+				tokens -= float64(n)
+			}
+			if _, err := sw.w.Write(p[:n]); err != nil {
+				sw.mu.Lock()
+				sw.err = err
+				sw.mu.Unlock()
+				return false
+			}
+			p = p[n:]
+		}
+		return true
+	}
+
+	for {
+		select {
+		case chunk := <-sw.queue:
+			if !send(chunk) {
+				return
+			}
+		case <-sw.closing:
+			// Drain what was queued before closing.
+			for {
+				select {
+				case chunk := <-sw.queue:
+					if !send(chunk) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		case <-sw.aborted:
+			return
+		}
+	}
+}
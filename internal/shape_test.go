@@ -0,0 +1,79 @@
+package ndog
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseShaping(t *testing.T) {
+	s, err := ParseShaping("rate=10k,burst=512,latency=100ms,jitter=10ms,fragment=8")
+	require.NoError(t, err)
+	assert.Equal(t, Shaping{
+		Rate:     10 * 1024,
+		Burst:    512,
+		Latency:  100 * time.Millisecond,
+		Jitter:   10 * time.Millisecond,
+		Fragment: 8,
+	}, s)
+
+	for _, spec := range []string{"rate", "rate=fast", "speed=1", "rate=-1"} {
+		_, err := ParseShaping(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+type chunkWriter struct {
+	chunks [][]byte
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	w.chunks = append(w.chunks, bytes.Clone(p))
+	return len(p), nil
+}
+
+func TestShapedWriter(t *testing.T) {
+	w := &chunkWriter{}
+	sw := newShapedWriter(NopWriteCloser(w), Shaping{
+		Rate:     1000,
+		Burst:    10,
+		Latency:  50 * time.Millisecond,
+		Fragment: 4,
+	}, false)
+	start := time.Now()
+	sw.Write([]byte("0123456789"))
+	sw.Write([]byte("abcdefghij"))
+	assert.Less(t, time.Since(start), 10*time.Millisecond, "writes should not block")
+	sw.Close()
+
+	// 50ms of latency, then 20 bytes at 1000 bytes/s with a burst of 10.
+	elapsed := time.Since(start)
+	assert.GreaterOrEqual(t, elapsed, 55*time.Millisecond)
+	assert.Less(t, elapsed, 200*time.Millisecond)
+	assert.Equal(t, [][]byte{
+		[]byte("0123"), []byte("4567"), []byte("89"),
+		[]byte("abcd"), []byte("efgh"), []byte("ij"),
+	}, w.chunks)
+}
+
+func TestShapedWriterClose(t *testing.T) {
+	// Writes racing with Close must fail rather than panic.
+	for i := 0; i < 100; i++ {
+		sw := newShapedWriter(NopWriteCloser(&chunkWriter{}), Shaping{Fragment: 1}, false)
+		go sw.Write([]byte("data"))
+		sw.Close()
+		_, err := sw.Write([]byte("data"))
+		assert.Error(t, err)
+	}
+
+	// Aborting drops queued writes instead of waiting for them.
+	sw := newShapedWriter(NopWriteCloser(&chunkWriter{}), Shaping{Rate: 1, Burst: 1}, false)
+	sw.Write([]byte("this takes a long time at 1 byte/s"))
+	start := time.Now()
+	sw.abort()
+	sw.Close()
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+}
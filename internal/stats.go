@@ -0,0 +1,354 @@
+package ndog
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// maxStatsHistory limits how many closed streams are kept for the summary.
+const maxStatsHistory = 1000
+
+// StreamStats are traffic statistics for a single stream. Bytes and Chunks
+// are indexed by Direction.
+type StreamStats struct {
+	Name   string
+	Scheme string
+	Opened time.Time
+	Closed time.Time
+	Bytes  [2]atomic.Int64
+	Chunks [2]atomic.Int64
+}
+
+func (s *StreamStats) add(dir Direction, n int) {
+	s.Bytes[dir].Add(int64(n))
+	s.Chunks[dir].Add(1)
+}
+
+type schemeStats struct {
+	opened     int64
+	active     int64
+	openErrors int64
+	ioErrors   int64
+	// Traffic and durations of closed streams; traffic of active streams
+	// is added when reporting.
+	bytes    [2]int64
+	chunks   [2]int64
+	duration time.Duration
+}
+
+// StatsStreamManager collects traffic statistics for streams created by its
+// delegate, aggregated by scheme.
+type StatsStreamManager struct {
+	StreamManager
+
+	mu      sync.Mutex
+	schemes map[string]*schemeStats
+	active  map[*StreamStats]struct{}
+	history []*StreamStats
+	dropped int
+}
+
+func NewStatsStreamManager(delegate StreamManager) *StatsStreamManager {
+	return &StatsStreamManager{
+		StreamManager: delegate,
+		schemes:       map[string]*schemeStats{},
+		active:        map[*StreamStats]struct{}{},
+	}
+}
+
+func (m *StatsStreamManager) NewStream(name string, meta StreamMetadata) (Stream, error) {
+	stream, err := m.StreamManager.NewStream(name, meta)
+	s, err := m.open(name, meta, err)
+	if err != nil {
+		return Stream{}, err
+	}
+	return Stream{
+		Reader: &statsReader{
+			ReadCloser: stream.Reader,
+			m:          m,
+			s:          s,
+		},
+		Writer: &statsWriter{
+			WriteCloser: stream.Writer,
+			m:           m,
+			s:           s,
+		},
+	}, nil
+}
+
+func (m *StatsStreamManager) NewMessageStream(name string, meta StreamMetadata, framing Framing) (MessageStream, error) {
+	stream, err := NewMessageStream(m.StreamManager, name, meta, framing)
+	s, err := m.open(name, meta, err)
+	if err != nil {
+		return MessageStream{}, err
+	}
+	return MessageStream{
+		Reader: &statsMessageReader{
+			MessageReadCloser: stream.Reader,
+			m:                 m,
+			s:                 s,
+		},
+		Writer: &statsMessageWriter{
+			MessageWriteCloser: stream.Writer,
+			m:                  m,
+			s:                  s,
+		},
+	}, nil
+}
+
+func (m *StatsStreamManager) scheme(name string) *schemeStats {
+	ss, ok := m.schemes[name]
+	if !ok {
+		ss = &schemeStats{}
+		m.schemes[name] = ss
+	}
+	return ss
+}
+
+// open records a new stream, or the error creating it.
+func (m *StatsStreamManager) open(name string, meta StreamMetadata, err error) (*StreamStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ss := m.scheme(meta.Scheme)
+	if err != nil {
+		ss.openErrors++
+		return nil, err
+	}
+	ss.opened++
+	ss.active++
+	s := &StreamStats{
+		Name:   name,
+		Scheme: meta.Scheme,
+		Opened: time.Now(),
+	}
+	m.active[s] = struct{}{}
+	return s, nil
+}
+
+func (m *StatsStreamManager) close(s *StreamStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.active[s]; !ok {
+		return
+	}
+	delete(m.active, s)
+	s.Closed = time.Now()
+
+	ss := m.scheme(s.Scheme)
+	ss.active--
+	ss.duration += s.Closed.Sub(s.Opened)
+	for dir := range s.Bytes {
+		ss.bytes[dir] += s.Bytes[dir].Load()
+		ss.chunks[dir] += s.Chunks[dir].Load()
+	}
+
+	m.history = append(m.history, s)
+	if len(m.history) > maxStatsHistory {
+		m.history = m.history[1:]
+		m.dropped++
+	}
+}
+
+// ioError counts err if it is a real I/O error rather than the stream ending.
+func (m *StatsStreamManager) ioError(s *StreamStats, err error) {
+	if err == nil || errors.Is(err, io.EOF) || IsIOClosedErr(err) {
+		return
+	}
+	m.mu.Lock()
+	m.scheme(s.Scheme).ioErrors++
+	m.mu.Unlock()
+}
+
+// WriteSummary writes a table of all streams and totals.
+func (m *StatsStreamManager) WriteSummary(w io.Writer) error {
+	m.mu.Lock()
+	streams := slices.Clone(m.history)
+	for s := range m.active {
+		streams = append(streams, s)
+	}
+	dropped := m.dropped
+	var errs int64
+	for _, ss := range m.schemes {
+		errs += ss.openErrors + ss.ioErrors
+	}
+	m.mu.Unlock()
+	slices.SortFunc(streams, func(a, b *StreamStats) int {
+		return a.Opened.Compare(b.Opened)
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STREAM\tSCHEME\tDURATION\tSENT\tSENT CHUNKS\tRECV\tRECV CHUNKS\t")
+	var total [2]struct{ bytes, chunks int64 }
+	now := time.Now()
+	for _, s := range streams {
+		closed := s.Closed
+		if closed.IsZero() {
+			closed = now
+		}
+		fmt.Fprintf(
+			tw, "%s\t%s\t%s\t%d\t%d\t%d\t%d\t\n",
+			s.Name, s.Scheme, closed.Sub(s.Opened).Round(time.Millisecond),
+			s.Bytes[Send].Load(), s.Chunks[Send].Load(),
+			s.Bytes[Recv].Load(), s.Chunks[Recv].Load(),
+		)
+		for dir := range total {
+			total[dir].bytes += s.Bytes[dir].Load()
+			total[dir].chunks += s.Chunks[dir].Load()
+		}
+	}
+	fmt.Fprintf(
+		tw, "TOTAL (%d stream(s), %d error(s))\t\t\t%d\t%d\t%d\t%d\t\n",
+		len(streams)+dropped, errs,
+		total[Send].bytes, total[Send].chunks,
+		total[Recv].bytes, total[Recv].chunks,
+	)
+	if dropped > 0 {
+		fmt.Fprintf(tw, "(%d older stream(s) omitted)\t\t\t\t\t\t\t\n", dropped)
+	}
+	return tw.Flush()
+}
+
+// WriteMetrics writes metrics in the Prometheus text exposition format.
+func (m *StatsStreamManager) WriteMetrics(w io.Writer) error {
+	m.mu.Lock()
+	schemes := map[string]schemeStats{}
+	for name, ss := range m.schemes {
+		schemes[name] = *ss
+	}
+	for s := range m.active {
+		ss := schemes[s.Scheme]
+		for dir := range s.Bytes {
+			ss.bytes[dir] += s.Bytes[dir].Load()
+			ss.chunks[dir] += s.Chunks[dir].Load()
+		}
+		schemes[s.Scheme] = ss
+	}
+	m.mu.Unlock()
+	names := make([]string, 0, len(schemes))
+	for name := range schemes {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var err error
+	printf := func(format string, v ...any) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, format, v...)
+		}
+	}
+	metric := func(name, typ, help string, value func(ss schemeStats) int64) {
+		printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, scheme := range names {
+			printf("%s{scheme=%q} %d\n", name, scheme, value(schemes[scheme]))
+		}
+	}
+	directionMetric := func(name, help string, value func(ss schemeStats, dir Direction) int64) {
+		printf("# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for _, scheme := range names {
+			for _, dir := range []Direction{Send, Recv} {
+				printf("%s{scheme=%q,direction=%q} %d\n", name, scheme, dir, value(schemes[scheme], dir))
+			}
+		}
+	}
+
+	metric("ndog_streams_opened_total", "counter", "Number of streams opened.", func(ss schemeStats) int64 {
+		return ss.opened
+	})
+	metric("ndog_streams_active", "gauge", "Number of streams currently open.", func(ss schemeStats) int64 {
+		return ss.active
+	})
+	printf("# HELP ndog_stream_duration_seconds Duration of closed streams.\n# TYPE ndog_stream_duration_seconds summary\n")
+	for _, scheme := range names {
+		ss := schemes[scheme]
+		printf("ndog_stream_duration_seconds_sum{scheme=%q} %g\n", scheme, ss.duration.Seconds())
+		printf("ndog_stream_duration_seconds_count{scheme=%q} %d\n", scheme, ss.opened-ss.active)
+	}
+	directionMetric("ndog_stream_bytes_total", "Number of bytes sent to or received from remotes.", func(ss schemeStats, dir Direction) int64 {
+		return ss.bytes[dir]
+	})
+	directionMetric("ndog_stream_chunks_total", "Number of chunks (reads, writes or messages) sent to or received from remotes.", func(ss schemeStats, dir Direction) int64 {
+		return ss.chunks[dir]
+	})
+	printf("# HELP ndog_stream_errors_total Number of errors opening streams or reading and writing them.\n# TYPE ndog_stream_errors_total counter\n")
+	for _, scheme := range names {
+		printf("ndog_stream_errors_total{scheme=%q,kind=\"open\"} %d\n", scheme, schemes[scheme].openErrors)
+		printf("ndog_stream_errors_total{scheme=%q,kind=\"io\"} %d\n", scheme, schemes[scheme].ioErrors)
+	}
+	return err
+}
+
+type statsReader struct {
+	io.ReadCloser
+	m *StatsStreamManager
+	s *StreamStats
+}
+
+func (r *statsReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.s.add(Send, n)
+	}
+	r.m.ioError(r.s, err)
+	return n, err
+}
+
+func (r *statsReader) Close() error {
+	r.m.close(r.s)
+	return r.ReadCloser.Close()
+}
+
+type statsWriter struct {
+	io.WriteCloser
+	m *StatsStreamManager
+	s *StreamStats
+}
+
+func (w *statsWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	if n > 0 {
+		w.s.add(Recv, n)
+	}
+	w.m.ioError(w.s, err)
+	return n, err
+}
+
+type statsMessageReader struct {
+	MessageReadCloser
+	m *StatsStreamManager
+	s *StreamStats
+}
+
+func (r *statsMessageReader) ReadMessage() ([]byte, error) {
+	msg, err := r.MessageReadCloser.ReadMessage()
+	if err == nil {
+		r.s.add(Send, len(msg))
+	}
+	r.m.ioError(r.s, err)
+	return msg, err
+}
+
+func (r *statsMessageReader) Close() error {
+	r.m.close(r.s)
+	return r.MessageReadCloser.Close()
+}
+
+type statsMessageWriter struct {
+	MessageWriteCloser
+	m *StatsStreamManager
+	s *StreamStats
+}
+
+func (w *statsMessageWriter) WriteMessage(msg []byte) error {
+	err := w.MessageWriteCloser.WriteMessage(msg)
+	if err == nil {
+		w.s.add(Recv, len(msg))
+	}
+	w.m.ioError(w.s, err)
+	return err
+}
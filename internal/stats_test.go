@@ -0,0 +1,58 @@
+package ndog
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type errStreamManager struct {
+	err error
+}
+
+func (m errStreamManager) NewStream(name string, meta StreamMetadata) (Stream, error) {
+	return Stream{}, m.err
+}
+
+func TestStatsStreamManager(t *testing.T) {
+	m := NewStatsStreamManager(fixedStreamManager{Stream{
+		Reader: io.NopCloser(strings.NewReader("response")),
+		Writer: NopWriteCloser(io.Discard),
+	}})
+	stream, err := m.NewStream("client", StreamMetadata{Scheme: "tcp"})
+	require.NoError(t, err)
+	stream.Writer.Write([]byte("req"))
+	stream.Writer.Write([]byte("uest"))
+	io.ReadAll(stream.Reader)
+
+	var metrics bytes.Buffer
+	require.NoError(t, m.WriteMetrics(&metrics))
+	assert.Contains(t, metrics.String(), `ndog_streams_active{scheme="tcp"} 1`)
+	assert.Contains(t, metrics.String(), `ndog_stream_bytes_total{scheme="tcp",direction="recv"} 7`)
+	assert.Contains(t, metrics.String(), `ndog_stream_chunks_total{scheme="tcp",direction="recv"} 2`)
+	assert.Contains(t, metrics.String(), `ndog_stream_bytes_total{scheme="tcp",direction="send"} 8`)
+
+	stream.Close()
+	m.StreamManager = errStreamManager{errors.New("boom")}
+	_, err = m.NewStream("client", StreamMetadata{Scheme: "tcp"})
+	assert.Error(t, err)
+
+	metrics.Reset()
+	require.NoError(t, m.WriteMetrics(&metrics))
+	assert.Contains(t, metrics.String(), `ndog_streams_active{scheme="tcp"} 0`)
+	assert.Contains(t, metrics.String(), `ndog_stream_duration_seconds_count{scheme="tcp"} 1`)
+	assert.Contains(t, metrics.String(), `ndog_stream_bytes_total{scheme="tcp",direction="recv"} 7`)
+	assert.Contains(t, metrics.String(), `ndog_stream_errors_total{scheme="tcp",kind="open"} 1`)
+
+	var summary bytes.Buffer
+	require.NoError(t, m.WriteSummary(&summary))
+	lines := strings.Split(strings.TrimSpace(summary.String()), "\n")
+	require.Len(t, lines, 3)
+	assert.Regexp(t, `^client\s+tcp\s+\S+\s+8\s+1\s+7\s+2`, lines[1])
+	assert.Regexp(t, `^TOTAL \(1 stream\(s\), 1 error\(s\)\)\s+8\s+1\s+7\s+2`, lines[2])
+}
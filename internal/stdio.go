@@ -4,17 +4,23 @@ import (
 	"bytes"
 	"io"
 	"os"
+	"sync"
 
 	"github.com/isobit/ndog/internal/log"
 )
 
 type StdIOStreamManager struct {
+	// Renderer formats data written to STDOUT.
+	Renderer Renderer
+
 	fixedData   []byte
 	stdinFanout *Fanout
+	stdoutMu    sync.Mutex
 }
 
 func NewStdIOStreamManager(fixedData []byte) *StdIOStreamManager {
 	m := &StdIOStreamManager{
+		Renderer:  Renderer{Format: FormatRaw},
 		fixedData: fixedData,
 	}
 	if fixedData == nil {
@@ -27,13 +33,12 @@ func NewStdIOStreamManager(fixedData []byte) *StdIOStreamManager {
 				}
 			}
 			log.Logf(10, "stdin EOF")
-			// os.Exit(1) // TODO clean shutdown
 		}()
 	}
 	return m
 }
 
-func (m *StdIOStreamManager) NewStream(name string) Stream {
+func (m *StdIOStreamManager) NewStream(name string, meta StreamMetadata) (Stream, error) {
 	var r io.ReadCloser
 
 	if m.fixedData != nil {
@@ -44,8 +49,37 @@ func (m *StdIOStreamManager) NewStream(name string) Stream {
 		r = m.stdinFanout.Tee()
 	}
 
+	w := NopWriteCloser(os.Stdout)
+	if m.Renderer.Format != FormatRaw {
+		sr := m.Renderer.Stream(name)
+		w = NopWriteCloser(writerFunc(func(p []byte) (int, error) {
+			// Keep chunks from concurrent streams from interleaving.
+			m.stdoutMu.Lock()
+			defer m.stdoutMu.Unlock()
+			if _, err := os.Stdout.Write(sr.Render(Recv, p)); err != nil {
+				return 0, err
+			}
+			return len(p), nil
+		}))
+	}
+
 	return Stream{
 		Reader: r,
-		Writer: NopWriteCloser(os.Stdout),
-	}
+		Writer: w,
+	}, nil
+}
+
+// NewStdIOMuxStreamManager returns a MuxStreamManager which writes envelopes to
+// STDOUT and routes envelopes read from STDIN. Once STDIN is done, all streams
+// are ended.
+func NewStdIOMuxStreamManager() *MuxStreamManager {
+	m := NewMuxStreamManager(os.Stdout)
+	go func() {
+		if err := m.Route(os.Stdin); err != nil {
+			log.Logf(-1, "stdin read error: %s", err)
+		}
+		log.Logf(10, "stdin EOF")
+		m.Close(nil)
+	}()
+	return m
 }
@@ -1,8 +1,8 @@
 package ndog
 
 import (
+	"bytes"
 	"io"
-	"strconv"
 
 	"github.com/isobit/ndog/internal/log"
 )
@@ -18,31 +18,103 @@ func (stream Stream) Close() error {
 	return nil
 }
 
+// CloseWrite half-closes the stream by closing only its writer, which signals
+// EOF to whatever is consuming the stream while leaving the reader open so
+// that any remaining data (e.g. a response) can still be read from it.
+func (stream Stream) CloseWrite() error {
+	return stream.Writer.Close()
+}
+
+// CloseWriter is implemented by connections which can close their writing
+// side independently, such as *net.TCPConn and *tls.Conn.
+type CloseWriter interface {
+	CloseWrite() error
+}
+
 type StreamManager interface {
-	NewStream(name string) Stream
+	NewStream(name string, meta StreamMetadata) (Stream, error)
 }
 
+// LogStreamManager logs all data sent and received on streams, formatted by
+// its Renderer.
 type LogStreamManager struct {
 	StreamManager
+	Renderer Renderer
 }
 
 func NewLogStreamManager(delegate StreamManager) *LogStreamManager {
 	return &LogStreamManager{
 		StreamManager: delegate,
+		Renderer:      Renderer{Format: FormatQuote},
 	}
 }
 
-func (f *LogStreamManager) NewStream(name string) Stream {
-	stream := f.StreamManager.NewStream(name)
+func (f *LogStreamManager) NewStream(name string, meta StreamMetadata) (Stream, error) {
+	stream, err := f.StreamManager.NewStream(name, meta)
+	if err != nil {
+		return Stream{}, err
+	}
+	r := f.Renderer.Stream(name)
+	logger := log.With("scheme", meta.Scheme, "stream", name)
 	return streamWithLogging(
 		stream,
 		func(p []byte) {
-			log.Logf(0, "<-%s %s", name, strconv.Quote(string(p)))
+			logRendered(logger, r, Recv, p)
 		},
 		func(p []byte) {
-			log.Logf(0, "->%s %s", name, strconv.Quote(string(p)))
+			logRendered(logger, r, Send, p)
 		},
-	)
+	), nil
+}
+
+func (f *LogStreamManager) NewMessageStream(name string, meta StreamMetadata, framing Framing) (MessageStream, error) {
+	stream, err := NewMessageStream(f.StreamManager, name, meta, framing)
+	if err != nil {
+		return MessageStream{}, err
+	}
+	r := f.Renderer.Stream(name)
+	logger := log.With("scheme", meta.Scheme, "stream", name)
+	return MessageStream{
+		Reader: loggingMessageReader{
+			MessageReadCloser: stream.Reader,
+			log: func(msg []byte) {
+				logRendered(logger, r, Send, msg)
+			},
+		},
+		Writer: loggingMessageWriter{
+			MessageWriteCloser: stream.Writer,
+			log: func(msg []byte) {
+				logRendered(logger, r, Recv, msg)
+			},
+		},
+	}, nil
+}
+
+func logRendered(logger log.Logger, r *StreamRenderer, dir Direction, p []byte) {
+	logger.With("direction", dir, "bytes", len(p)).Logf(0, "%s", bytes.TrimSuffix(r.Render(dir, p), []byte{'\n'}))
+}
+
+type loggingMessageReader struct {
+	MessageReadCloser
+	log func([]byte)
+}
+
+func (r loggingMessageReader) ReadMessage() ([]byte, error) {
+	msg, err := r.MessageReadCloser.ReadMessage()
+	if err == nil {
+		r.log(msg)
+	}
+	return msg, err
+}
+
+type loggingMessageWriter struct {
+	MessageWriteCloser
+	log func([]byte)
+}
+
+func (w loggingMessageWriter) WriteMessage(msg []byte) error {
+	w.log(msg)
+	return w.MessageWriteCloser.WriteMessage(msg)
 }
 
 func streamWithLogging(stream Stream, logRecv func([]byte), logSend func([]byte)) Stream {
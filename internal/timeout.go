@@ -0,0 +1,201 @@
+package ndog
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/isobit/ndog/internal/netutil"
+)
+
+// TimeoutStreamManager closes streams created by its delegate once no data
+// has been sent or received for Idle, or once they have been open for Total.
+// Reads and writes then fail with netutil.ErrIdleTimeout or netutil.ErrTimeout
+// respectively. Zero durations are disabled.
+type TimeoutStreamManager struct {
+	StreamManager
+	Idle  time.Duration
+	Total time.Duration
+
+	// OnTimeout is called, if set, when a stream times out.
+	OnTimeout func(name string, err error)
+}
+
+func (m *TimeoutStreamManager) NewStream(name string, meta StreamMetadata) (Stream, error) {
+	stream, err := m.StreamManager.NewStream(name, meta)
+	if err != nil {
+		return Stream{}, err
+	}
+	t := m.start(name, stream)
+	return Stream{
+		Reader: &timeoutReader{ReadCloser: stream.Reader, t: t},
+		Writer: &timeoutWriter{WriteCloser: stream.Writer, t: t},
+	}, nil
+}
+
+func (m *TimeoutStreamManager) NewMessageStream(name string, meta StreamMetadata, framing Framing) (MessageStream, error) {
+	stream, err := NewMessageStream(m.StreamManager, name, meta, framing)
+	if err != nil {
+		return MessageStream{}, err
+	}
+	t := m.start(name, stream)
+	return MessageStream{
+		Reader: &timeoutMessageReader{MessageReadCloser: stream.Reader, t: t},
+		Writer: &timeoutMessageWriter{MessageWriteCloser: stream.Writer, t: t},
+	}, nil
+}
+
+func (m *TimeoutStreamManager) start(name string, stream io.Closer) *streamTimer {
+	t := &streamTimer{idle: m.Idle}
+	timeout := func(err error) {
+		t.mu.Lock()
+		if t.err != nil || t.stopped {
+			t.mu.Unlock()
+			return
+		}
+		t.err = err
+		t.stopTimers()
+		t.mu.Unlock()
+
+		stream.Close()
+		if m.OnTimeout != nil {
+			m.OnTimeout(name, err)
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if m.Idle > 0 {
+		t.idleTimer = time.AfterFunc(m.Idle, func() {
+			timeout(netutil.ErrIdleTimeout)
+		})
+	}
+	if m.Total > 0 {
+		t.totalTimer = time.AfterFunc(m.Total, func() {
+			timeout(netutil.ErrTimeout)
+		})
+	}
+	return t
+}
+
+// streamTimer tracks the timeouts of a single stream.
+type streamTimer struct {
+	idle time.Duration
+
+	mu         sync.Mutex
+	idleTimer  *time.Timer
+	totalTimer *time.Timer
+	// err is set once the stream has timed out.
+	err     error
+	stopped bool
+}
+
+// activity resets the idle timeout.
+func (t *streamTimer) activity() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.idleTimer != nil && t.err == nil && !t.stopped {
+		t.idleTimer.Reset(t.idle)
+	}
+}
+
+func (t *streamTimer) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+func (t *streamTimer) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopped = true
+	t.stopTimers()
+}
+
+func (t *streamTimer) stopTimers() {
+	if t.idleTimer != nil {
+		t.idleTimer.Stop()
+	}
+	if t.totalTimer != nil {
+		t.totalTimer.Stop()
+	}
+}
+
+// wrap replaces err with the timeout error if the stream has timed out, since
+// that is what caused err.
+func (t *streamTimer) wrap(err error) error {
+	if err == nil {
+		return nil
+	}
+	if terr := t.Err(); terr != nil {
+		return terr
+	}
+	return err
+}
+
+type timeoutReader struct {
+	io.ReadCloser
+	t *streamTimer
+}
+
+func (r *timeoutReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.t.activity()
+	}
+	return n, r.t.wrap(err)
+}
+
+func (r *timeoutReader) Close() error {
+	r.t.stop()
+	return r.ReadCloser.Close()
+}
+
+type timeoutWriter struct {
+	io.WriteCloser
+	t *streamTimer
+}
+
+func (w *timeoutWriter) Write(p []byte) (int, error) {
+	if err := w.t.Err(); err != nil {
+		return 0, err
+	}
+	n, err := w.WriteCloser.Write(p)
+	if n > 0 {
+		w.t.activity()
+	}
+	return n, w.t.wrap(err)
+}
+
+type timeoutMessageReader struct {
+	MessageReadCloser
+	t *streamTimer
+}
+
+func (r *timeoutMessageReader) ReadMessage() ([]byte, error) {
+	msg, err := r.MessageReadCloser.ReadMessage()
+	if err == nil {
+		r.t.activity()
+	}
+	return msg, r.t.wrap(err)
+}
+
+func (r *timeoutMessageReader) Close() error {
+	r.t.stop()
+	return r.MessageReadCloser.Close()
+}
+
+type timeoutMessageWriter struct {
+	MessageWriteCloser
+	t *streamTimer
+}
+
+func (w *timeoutMessageWriter) WriteMessage(msg []byte) error {
+	if err := w.t.Err(); err != nil {
+		return err
+	}
+	err := w.MessageWriteCloser.WriteMessage(msg)
+	if err == nil {
+		w.t.activity()
+	}
+	return w.t.wrap(err)
+}
@@ -0,0 +1,71 @@
+package ndog
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/isobit/ndog/internal/netutil"
+)
+
+func TestTimeoutStreamManager(t *testing.T) {
+	newStream := func(idle, total time.Duration) (Stream, *io.PipeWriter, chan error) {
+		pr, pw := io.Pipe()
+		timeouts := make(chan error, 1)
+		m := &TimeoutStreamManager{
+			StreamManager: fixedStreamManager{Stream{
+				Reader: pr,
+				Writer: NopWriteCloser(&bytes.Buffer{}),
+			}},
+			Idle:  idle,
+			Total: total,
+			OnTimeout: func(name string, err error) {
+				timeouts <- err
+			},
+		}
+		stream, err := m.NewStream("test", StreamMetadata{})
+		require.NoError(t, err)
+		return stream, pw, timeouts
+	}
+
+	// Activity in either direction postpones the idle timeout.
+	stream, pw, timeouts := newStream(100*time.Millisecond, 0)
+	go func() {
+		for i := 0; i < 3; i++ {
+			time.Sleep(50 * time.Millisecond)
+			pw.Write([]byte("x"))
+		}
+	}()
+	start := time.Now()
+	sent, err := io.ReadAll(stream.Reader)
+	assert.ErrorIs(t, err, netutil.ErrIdleTimeout)
+	assert.Equal(t, "xxx", string(sent))
+	assert.Greater(t, time.Since(start), 200*time.Millisecond)
+	assert.ErrorIs(t, <-timeouts, netutil.ErrIdleTimeout)
+	_, err = stream.Writer.Write([]byte("y"))
+	assert.ErrorIs(t, err, netutil.ErrIdleTimeout)
+
+	// The total timeout applies regardless of activity.
+	stream, pw, timeouts = newStream(time.Second, 100*time.Millisecond)
+	go func() {
+		for {
+			time.Sleep(10 * time.Millisecond)
+			if _, err := pw.Write([]byte("x")); err != nil {
+				return
+			}
+		}
+	}()
+	_, err = io.ReadAll(stream.Reader)
+	assert.ErrorIs(t, err, netutil.ErrTimeout)
+	assert.ErrorIs(t, <-timeouts, netutil.ErrTimeout)
+
+	// Closing the stream stops the timeouts.
+	stream, _, timeouts = newStream(10*time.Millisecond, 0)
+	stream.Close()
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, timeouts)
+}
@@ -10,15 +10,15 @@ import (
 )
 
 type Config struct {
-	TLSSkipVerify bool   `cli:"name=tls-skip-verify,env=NDOG_TLS_SKIP_VERIFY"`
-	TLSServerName string `cli:"name=tls-server-name,env=NDOG_TLS_SERVER_NAME"`
+	TLSSkipVerify bool   `cli:"name=tls-skip-verify,env=NDOG_TLS_SKIP_VERIFY" yaml:"skip_verify"`
+	TLSServerName string `cli:"name=tls-server-name,env=NDOG_TLS_SERVER_NAME" yaml:"server_name"`
 
-	TLSCert string `cli:"name=tls-cert,env=NDOG_TLS_CERT"`
-	TLSKey  string `cli:"name=tls-key,env=NDOG_TLS_KEY"`
+	TLSCert string `cli:"name=tls-cert,env=NDOG_TLS_CERT" yaml:"cert"`
+	TLSKey  string `cli:"name=tls-key,env=NDOG_TLS_KEY" yaml:"key"`
 
-	TLSCACert     string   `cli:"name=tls-ca-cert,env=NDOG_TLS_CA_CERT"`
-	TLSCAKey      string   `cli:"name=tls-ca-key,env=NDOG_TLS_CA_KEY"`
-	TLSExtraHosts []string `cli:"name=tls-extra-hosts,env=NDOG_TLS_CA_EXTRA_HOSTS,append"`
+	TLSCACert     string   `cli:"name=tls-ca-cert,env=NDOG_TLS_CA_CERT" yaml:"ca_cert"`
+	TLSCAKey      string   `cli:"name=tls-ca-key,env=NDOG_TLS_CA_KEY" yaml:"ca_key"`
+	TLSExtraHosts []string `cli:"name=tls-extra-hosts,env=NDOG_TLS_CA_EXTRA_HOSTS,append" yaml:"extra_hosts"`
 }
 
 func (cfg Config) Config(server bool, hosts []string) (*tls.Config, error) {
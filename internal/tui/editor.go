@@ -0,0 +1,229 @@
+package tui
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+type key int
+
+const (
+	keyRune key = iota
+	keyEnter
+	keyTab
+	keyBackspace
+	keyDelete
+	keyUp
+	keyDown
+	keyLeft
+	keyRight
+	keyHome
+	keyEnd
+	keyPageUp
+	keyPageDown
+	keyCtrlC
+	keyCtrlD
+	keyCtrlN
+	keyCtrlP
+	keyCtrlU
+	keyCtrlW
+	keyCtrlX
+	keyCtrlL
+)
+
+type keyEvent struct {
+	key  key
+	rune rune
+}
+
+var escapeSequences = map[string]key{
+	"[A":  keyUp,
+	"[B":  keyDown,
+	"[C":  keyRight,
+	"[D":  keyLeft,
+	"[H":  keyHome,
+	"[F":  keyEnd,
+	"OH":  keyHome,
+	"OF":  keyEnd,
+	"[1~": keyHome,
+	"[4~": keyEnd,
+	"[3~": keyDelete,
+	"[5~": keyPageUp,
+	"[6~": keyPageDown,
+}
+
+var controlKeys = map[byte]key{
+	0x01: keyHome,  // Ctrl-A
+	0x03: keyCtrlC, // Ctrl-C
+	0x04: keyCtrlD, // Ctrl-D
+	0x05: keyEnd,   // Ctrl-E
+	0x08: keyBackspace,
+	0x09: keyTab,
+	0x0c: keyCtrlL,
+	0x0d: keyEnter,
+	0x0e: keyCtrlN,
+	0x10: keyCtrlP,
+	0x15: keyCtrlU,
+	0x17: keyCtrlW,
+	0x18: keyCtrlX,
+	0x7f: keyBackspace,
+}
+
+// parseKeys parses raw terminal input into key events. Escape sequences are
+// assumed not to be split across reads; unknown ones are ignored.
+func parseKeys(p []byte) []keyEvent {
+	events := []keyEvent{}
+	for len(p) > 0 {
+		if p[0] == 0x1b {
+			seq, n := parseEscape(p[1:])
+			if k, ok := escapeSequences[seq]; ok {
+				events = append(events, keyEvent{key: k})
+			}
+			p = p[1+n:]
+			continue
+		}
+		if k, ok := controlKeys[p[0]]; ok {
+			events = append(events, keyEvent{key: k})
+			p = p[1:]
+			continue
+		}
+		r, n := utf8.DecodeRune(p)
+		if unicode.IsPrint(r) {
+			events = append(events, keyEvent{key: keyRune, rune: r})
+		}
+		p = p[n:]
+	}
+	return events
+}
+
+// parseEscape returns the escape sequence at the start of p (after the ESC),
+// e.g. "[A" or "[3~", and its length.
+func parseEscape(p []byte) (string, int) {
+	if len(p) == 0 || (p[0] != '[' && p[0] != 'O') {
+		return "", 0
+	}
+	for i := 1; i < len(p); i++ {
+		if p[i] >= 0x40 && p[i] <= 0x7e {
+			return string(p[:i+1]), i + 1
+		}
+	}
+	return "", len(p)
+}
+
+// lineEditor is a single line text editor with history.
+type lineEditor struct {
+	buf []rune
+	pos int
+
+	history []string
+	// histPos is the index into history of the line being edited, or
+	// len(history) for a new line, which is saved in draft while navigating.
+	histPos int
+	draft   []rune
+}
+
+func (e *lineEditor) String() string {
+	return string(e.buf)
+}
+
+func (e *lineEditor) set(s string) {
+	e.buf = []rune(s)
+	e.pos = len(e.buf)
+}
+
+func (e *lineEditor) insert(r rune) {
+	e.buf = append(e.buf[:e.pos], append([]rune{r}, e.buf[e.pos:]...)...)
+	e.pos++
+}
+
+func (e *lineEditor) backspace() {
+	if e.pos == 0 {
+		return
+	}
+	e.buf = append(e.buf[:e.pos-1], e.buf[e.pos:]...)
+	e.pos--
+}
+
+func (e *lineEditor) delete() {
+	if e.pos == len(e.buf) {
+		return
+	}
+	e.buf = append(e.buf[:e.pos], e.buf[e.pos+1:]...)
+}
+
+func (e *lineEditor) left() {
+	if e.pos > 0 {
+		e.pos--
+	}
+}
+
+func (e *lineEditor) right() {
+	if e.pos < len(e.buf) {
+		e.pos++
+	}
+}
+
+func (e *lineEditor) home() {
+	e.pos = 0
+}
+
+func (e *lineEditor) end() {
+	e.pos = len(e.buf)
+}
+
+// killLine deletes everything before the cursor.
+func (e *lineEditor) killLine() {
+	e.buf = e.buf[e.pos:]
+	e.pos = 0
+}
+
+// killWord deletes the word before the cursor.
+func (e *lineEditor) killWord() {
+	i := e.pos
+	for i > 0 && unicode.IsSpace(e.buf[i-1]) {
+		i--
+	}
+	for i > 0 && !unicode.IsSpace(e.buf[i-1]) {
+		i--
+	}
+	e.buf = append(e.buf[:i], e.buf[e.pos:]...)
+	e.pos = i
+}
+
+func (e *lineEditor) prev() {
+	if e.histPos == 0 {
+		return
+	}
+	if e.histPos == len(e.history) {
+		e.draft = e.buf
+	}
+	e.histPos--
+	e.set(e.history[e.histPos])
+}
+
+func (e *lineEditor) next() {
+	if e.histPos == len(e.history) {
+		return
+	}
+	e.histPos++
+	if e.histPos == len(e.history) {
+		e.buf = e.draft
+		e.pos = len(e.buf)
+		return
+	}
+	e.set(e.history[e.histPos])
+}
+
+// submit returns the current line, adds it to the history, and resets the
+// editor.
+func (e *lineEditor) submit() string {
+	line := string(e.buf)
+	if line != "" && (len(e.history) == 0 || e.history[len(e.history)-1] != line) {
+		e.history = append(e.history, line)
+	}
+	e.histPos = len(e.history)
+	e.buf = nil
+	e.pos = 0
+	e.draft = nil
+	return line
+}
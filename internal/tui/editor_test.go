@@ -0,0 +1,48 @@
+package tui
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseKeys(t *testing.T) {
+	events := parseKeys([]byte("a\x1b[A\x1b[3~é\r\x7f\x1b[99x\x18"))
+	assert.Equal(t, []keyEvent{
+		{key: keyRune, rune: 'a'},
+		{key: keyUp},
+		{key: keyDelete},
+		{key: keyRune, rune: 'é'},
+		{key: keyEnter},
+		{key: keyBackspace},
+		{key: keyCtrlX},
+	}, events)
+}
+
+func TestLineEditor(t *testing.T) {
+	e := lineEditor{}
+	for _, r := range "hello world" {
+		e.insert(r)
+	}
+	e.killWord()
+	assert.Equal(t, "hello ", e.String())
+	e.home()
+	e.delete()
+	e.insert('j')
+	assert.Equal(t, "jello ", e.String())
+	assert.Equal(t, "jello ", e.submit())
+	assert.Equal(t, "", e.String())
+
+	e.set("second")
+	e.submit()
+	e.insert('x')
+	e.prev()
+	assert.Equal(t, "second", e.String())
+	e.prev()
+	assert.Equal(t, "jello ", e.String())
+	e.prev()
+	assert.Equal(t, "jello ", e.String())
+	e.next()
+	e.next()
+	assert.Equal(t, "x", e.String())
+}
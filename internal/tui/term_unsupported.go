@@ -0,0 +1,17 @@
+//go:build !linux && !darwin
+
+package tui
+
+import "fmt"
+
+func makeRaw(fd int) (restore func() error, err error) {
+	return nil, fmt.Errorf("interactive mode is currently only supported on linux and darwin")
+}
+
+func getSize(fd int) (width int, height int, err error) {
+	return 0, 0, fmt.Errorf("interactive mode is currently only supported on linux and darwin")
+}
+
+func IsTerminal(fd int) bool {
+	return false
+}
@@ -0,0 +1,648 @@
+// Package tui implements an interactive terminal user interface for streams.
+package tui
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/isobit/ndog/internal"
+	"github.com/isobit/ndog/internal/log"
+)
+
+const (
+	maxScrollback = 1000
+	// maxClosedPanes limits how many closed streams are kept in the list,
+	// dropping the oldest first.
+	maxClosedPanes = 50
+	maxListWidth   = 30
+	sendQueueSize  = 64
+)
+
+type direction int
+
+const (
+	dirInfo direction = iota
+	dirRecv
+	dirSend
+)
+
+type line struct {
+	dir  direction
+	text string
+}
+
+// pane is an entry in the stream list with its scrollback.
+type pane struct {
+	name    string
+	lines   []line
+	partial []byte
+	unread  bool
+	scroll  int
+
+	// The following are only set for stream panes.
+	stream      bool
+	sendCh      chan []byte
+	sendClosed  bool
+	pipeWriter  *io.PipeWriter
+	remoteEOF   bool
+	closed      bool
+	closeSendMu sync.Mutex
+}
+
+func (p *pane) addLine(dir direction, text string) {
+	p.lines = append(p.lines, line{dir: dir, text: text})
+	if len(p.lines) > maxScrollback {
+		p.lines = p.lines[len(p.lines)-maxScrollback:]
+	}
+}
+
+// addData adds received data to the scrollback, keeping any incomplete
+// trailing line so that it can be continued by the next write.
+func (p *pane) addData(dir direction, data []byte) {
+	data = append(p.partial, data...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		p.addLine(dir, string(bytes.TrimSuffix(data[:i], []byte{'\r'})))
+		data = data[i+1:]
+	}
+	p.partial = bytes.Clone(data)
+}
+
+func (p *pane) flush(dir direction) {
+	if len(p.partial) > 0 {
+		p.addLine(dir, string(p.partial))
+		p.partial = nil
+	}
+}
+
+// TUI is a StreamManager which presents streams in an interactive terminal
+// UI, with a list of streams, a scrollback pane for the selected stream, and a
+// line editor for sending data to it. Logs are shown in their own pane.
+type TUI struct {
+	in  *os.File
+	out *os.File
+
+	restore func() error
+	redraw  chan struct{}
+	done    chan struct{}
+	sigCh   chan os.Signal
+
+	mu        sync.Mutex
+	panes     []*pane
+	selected  int
+	editor    lineEditor
+	completer ndog.Completer
+	hint      string
+	width     int
+	height    int
+
+	closeOnce sync.Once
+}
+
+// New puts the terminal into raw mode and starts the UI. Logs are redirected
+// to the UI until it is closed.
+func New(in *os.File, out *os.File) (*TUI, error) {
+	restore, err := makeRaw(int(in.Fd()))
+	if err != nil {
+		return nil, err
+	}
+	t := &TUI{
+		in:      in,
+		out:     out,
+		restore: restore,
+		redraw:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		sigCh:   make(chan os.Signal, 1),
+		panes:   []*pane{{name: "log"}},
+	}
+	t.resize()
+
+	// Use the alternate screen buffer.
+	io.WriteString(out, "\x1b[?1049h")
+	log.Log = logWriter{t}
+	log.LogColor = false
+
+	signal.Notify(t.sigCh, syscall.SIGWINCH)
+	go t.renderLoop()
+	go t.inputLoop()
+	t.requestRedraw()
+	return t, nil
+}
+
+// SetCompleter sets the completer used when Tab is pressed.
+func (t *TUI) SetCompleter(c ndog.Completer) {
+	t.mu.Lock()
+	t.completer = c
+	t.mu.Unlock()
+}
+
+// Close restores the terminal.
+func (t *TUI) Close() error {
+	t.closeOnce.Do(func() {
+		signal.Stop(t.sigCh)
+		close(t.done)
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		log.Log = os.Stderr
+		io.WriteString(t.out, "\x1b[?25h\x1b[?1049l")
+		t.restore()
+	})
+	return nil
+}
+
+type logWriter struct {
+	t *TUI
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w.t.mu.Lock()
+	w.t.panes[0].addData(dirInfo, p)
+	w.t.markUnread(w.t.panes[0])
+	w.t.mu.Unlock()
+	w.t.requestRedraw()
+	return len(p), nil
+}
+
+func (t *TUI) NewStream(name string, meta ndog.StreamMetadata) (ndog.Stream, error) {
+	pr, pw := io.Pipe()
+	p := &pane{
+		name:       name,
+		stream:     true,
+		sendCh:     make(chan []byte, sendQueueSize),
+		pipeWriter: pw,
+	}
+	go func() {
+		defer pw.Close()
+		for data := range p.sendCh {
+			if _, err := pw.Write(data); err != nil {
+				return
+			}
+		}
+	}()
+
+	t.mu.Lock()
+	p.addLine(dirInfo, fmt.Sprintf("opened: %s", describe(meta)))
+	t.panes = append(t.panes, p)
+	// Follow the first stream automatically, since that is most likely the
+	// one of interest, e.g. when connecting.
+	if t.selected == 0 && len(t.panes) == 2 {
+		t.selected = 1
+	}
+	t.markUnread(p)
+	t.mu.Unlock()
+	t.requestRedraw()
+
+	return ndog.Stream{
+		Reader: ndog.FuncReadCloser(pr, func() error {
+			t.mu.Lock()
+			p.flush(dirRecv)
+			p.closed = true
+			p.addLine(dirInfo, "closed")
+			t.pruneClosed()
+			t.mu.Unlock()
+			t.closeSend(p)
+			t.requestRedraw()
+			return pr.Close()
+		}),
+		Writer: ndog.FuncWriteCloser(paneWriter{t: t, p: p}, func() error {
+			t.mu.Lock()
+			p.flush(dirRecv)
+			p.remoteEOF = true
+			p.addLine(dirInfo, "EOF")
+			t.mu.Unlock()
+			t.requestRedraw()
+			return nil
+		}),
+	}, nil
+}
+
+type paneWriter struct {
+	t *TUI
+	p *pane
+}
+
+func (w paneWriter) Write(data []byte) (int, error) {
+	w.t.mu.Lock()
+	w.p.addData(dirRecv, data)
+	w.t.markUnread(w.p)
+	w.t.mu.Unlock()
+	w.t.requestRedraw()
+	return len(data), nil
+}
+
+// markUnread marks the pane as having unread data if it isn't selected. It
+// must be called with t.mu held.
+func (t *TUI) markUnread(p *pane) {
+	if t.panes[t.selected] != p {
+		p.unread = true
+	}
+}
+
+// send queues data to be sent to the stream.
+func (t *TUI) send(p *pane, data []byte) bool {
+	p.closeSendMu.Lock()
+	defer p.closeSendMu.Unlock()
+	if p.sendClosed {
+		return false
+	}
+	select {
+	case p.sendCh <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeSend half-closes the stream once all queued data has been sent, and
+// reports whether it was still open.
+func (t *TUI) closeSend(p *pane) bool {
+	p.closeSendMu.Lock()
+	defer p.closeSendMu.Unlock()
+	if p.sendClosed {
+		return false
+	}
+	p.sendClosed = true
+	close(p.sendCh)
+	return true
+}
+
+func (t *TUI) requestRedraw() {
+	select {
+	case t.redraw <- struct{}{}:
+	default:
+	}
+}
+
+func (t *TUI) renderLoop() {
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-t.sigCh:
+			t.mu.Lock()
+			t.resize()
+			t.mu.Unlock()
+			t.render()
+		case <-t.redraw:
+			t.render()
+		}
+	}
+}
+
+// resize updates the terminal size. It must be called with t.mu held.
+func (t *TUI) resize() {
+	w, h, err := getSize(int(t.out.Fd()))
+	if err != nil || w <= 0 || h <= 0 {
+		w, h = 80, 24
+	}
+	t.width, t.height = w, h
+}
+
+func (t *TUI) inputLoop() {
+	buf := make([]byte, 1024)
+	for {
+		n, err := t.in.Read(buf)
+		if err != nil {
+			return
+		}
+		for _, ev := range parseKeys(buf[:n]) {
+			t.handleKey(ev)
+		}
+		t.requestRedraw()
+	}
+}
+
+func (t *TUI) handleKey(ev keyEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p := t.panes[t.selected]
+	e := &t.editor
+	t.hint = ""
+	switch ev.key {
+	case keyTab:
+		t.complete()
+	case keyRune:
+		e.insert(ev.rune)
+	case keyBackspace:
+		e.backspace()
+	case keyDelete:
+		e.delete()
+	case keyLeft:
+		e.left()
+	case keyRight:
+		e.right()
+	case keyHome:
+		e.home()
+	case keyEnd:
+		e.end()
+	case keyUp:
+		e.prev()
+	case keyDown:
+		e.next()
+	case keyCtrlU:
+		e.killLine()
+	case keyCtrlW:
+		e.killWord()
+	case keyPageUp:
+		p.scroll += t.contentHeight() / 2
+	case keyPageDown:
+		p.scroll = max(0, p.scroll-t.contentHeight()/2)
+	case keyCtrlN:
+		t.selectPane((t.selected + 1) % len(t.panes))
+	case keyCtrlP:
+		t.selectPane((t.selected + len(t.panes) - 1) % len(t.panes))
+	case keyEnter:
+		if !p.stream {
+			return
+		}
+		text := e.submit()
+		if t.send(p, []byte(text+"\n")) {
+			p.flush(dirRecv)
+			p.addLine(dirSend, text)
+		} else {
+			p.addLine(dirInfo, "not sent: stream is closed or busy")
+		}
+		p.scroll = 0
+	case keyCtrlD:
+		if p.stream && t.closeSend(p) {
+			p.addLine(dirInfo, "sent EOF")
+		}
+	case keyCtrlX:
+		if p.stream && !p.closed {
+			p.addLine(dirInfo, "closing")
+			p.pipeWriter.CloseWithError(io.ErrClosedPipe)
+		}
+	case keyCtrlC:
+		// Raw mode disables signal generation, so raise SIGINT ourselves
+		// in order to shut down as usual.
+		syscall.Kill(os.Getpid(), syscall.SIGINT)
+	case keyCtrlL:
+		io.WriteString(t.out, "\x1b[2J")
+	}
+}
+
+// complete replaces the input before the cursor with the longest common
+// prefix of its completions, and shows them as a hint if there are several. It
+// must be called with t.mu held.
+func (t *TUI) complete() {
+	if t.completer == nil {
+		return
+	}
+	e := &t.editor
+	before := string(e.buf[:e.pos])
+	candidates := t.completer.Complete(before)
+	if len(candidates) == 0 {
+		t.hint = "no completions"
+		return
+	}
+
+	prefix := candidates[0]
+	for _, c := range candidates[1:] {
+		prefix = commonPrefix(prefix, c)
+	}
+	if len(prefix) >= len(before) {
+		rest := e.buf[e.pos:]
+		e.set(prefix)
+		e.buf = append(e.buf, rest...)
+	}
+
+	if len(candidates) > 1 {
+		base := before[:len(before)-len(ndog.LastWord(before))]
+		hints := make([]string, len(candidates))
+		for i, c := range candidates {
+			hints[i] = strings.TrimPrefix(c, base)
+		}
+		t.hint = strings.Join(hints, "  ")
+	}
+}
+
+func commonPrefix(a string, b string) string {
+	ar, br := []rune(a), []rune(b)
+	n := 0
+	for n < len(ar) && n < len(br) && ar[n] == br[n] {
+		n++
+	}
+	return string(ar[:n])
+}
+
+// pruneClosed removes the oldest closed stream panes beyond maxClosedPanes,
+// other than the selected one. It must be called with t.mu held.
+func (t *TUI) pruneClosed() {
+	closed := 0
+	for _, p := range t.panes {
+		if p.closed {
+			closed++
+		}
+	}
+	for i := 0; i < len(t.panes) && closed > maxClosedPanes; {
+		if !t.panes[i].closed || i == t.selected {
+			i++
+			continue
+		}
+		t.panes = slices.Delete(t.panes, i, i+1)
+		if t.selected > i {
+			t.selected--
+		}
+		closed--
+	}
+}
+
+// selectPane must be called with t.mu held.
+func (t *TUI) selectPane(i int) {
+	t.selected = i
+	t.panes[i].unread = false
+}
+
+// contentHeight returns the height of the list and scrollback panes. It must
+// be called with t.mu held.
+func (t *TUI) contentHeight() int {
+	return max(1, t.height-2)
+}
+
+func (t *TUI) render() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	select {
+	case <-t.done:
+		return
+	default:
+	}
+
+	w, h := t.width, t.height
+	ch := t.contentHeight()
+	listWidth := min(maxListWidth, w/3)
+	scrollWidth := max(1, w-listWidth-1)
+	selected := t.panes[t.selected]
+
+	// Wrap the visible part of the selected pane's scrollback.
+	rows := []line{}
+	lines := selected.lines
+	if len(selected.partial) > 0 {
+		lines = append(lines[:len(lines):len(lines)], line{dir: dirRecv, text: string(selected.partial)})
+	}
+	selected.scroll = min(selected.scroll, max(0, len(lines)-1))
+	end := len(lines) - selected.scroll
+	for i := end - 1; i >= 0 && len(rows) < ch; i-- {
+		wrapped := wrap(prefix(lines[i].dir)+sanitize(lines[i].text), scrollWidth)
+		for j := len(wrapped) - 1; j >= 0 && len(rows) < ch; j-- {
+			rows = append(rows, line{dir: lines[i].dir, text: wrapped[j]})
+		}
+	}
+
+	// Scroll the stream list to keep the selected stream visible.
+	listStart := max(0, t.selected-ch+1)
+
+	var b strings.Builder
+	b.WriteString("\x1b[?25l")
+	for y := 0; y < ch; y++ {
+		fmt.Fprintf(&b, "\x1b[%d;1H", y+1)
+
+		// Stream list
+		if i := listStart + y; i < len(t.panes) {
+			p := t.panes[i]
+			marker := " "
+			if p.unread {
+				marker = "+"
+			}
+			text := truncate(marker+sanitize(p.name), listWidth)
+			switch {
+			case i == t.selected:
+				b.WriteString("\x1b[7m")
+			case p.closed:
+				b.WriteString("\x1b[2m")
+			}
+			b.WriteString(text)
+			b.WriteString(strings.Repeat(" ", listWidth-utf8.RuneCountInString(text)))
+			b.WriteString("\x1b[0m")
+		} else {
+			b.WriteString(strings.Repeat(" ", listWidth))
+		}
+		b.WriteString("\x1b[2m│\x1b[0m")
+
+		// Scrollback, bottom aligned
+		if i := ch - 1 - y; i < len(rows) {
+			b.WriteString(color(rows[i].dir))
+			b.WriteString(rows[i].text)
+			b.WriteString("\x1b[0m")
+		}
+		b.WriteString("\x1b[K")
+	}
+
+	// Status line
+	status := " " + sanitize(selected.name)
+	switch {
+	case selected.closed:
+		status += " (closed)"
+	case selected.remoteEOF:
+		status += " (remote EOF)"
+	}
+	if selected.scroll > 0 {
+		status += fmt.Sprintf(" [scrolled %d]", selected.scroll)
+	}
+	hints := "^N/^P select  ^D EOF  ^X close  ^C quit "
+	if t.hint != "" {
+		status = " " + sanitize(t.hint)
+		hints = ""
+	}
+	if pad := w - utf8.RuneCountInString(status) - utf8.RuneCountInString(hints); pad > 0 {
+		status += strings.Repeat(" ", pad) + hints
+	}
+	fmt.Fprintf(&b, "\x1b[%d;1H\x1b[7m%s\x1b[0m\x1b[K", h-1, truncate(status, w))
+
+	// Input line, scrolled horizontally to keep the cursor visible.
+	prompt := "> "
+	inputWidth := max(1, w-len(prompt)-1)
+	start := max(0, t.editor.pos-inputWidth)
+	input := t.editor.buf[start:min(len(t.editor.buf), start+inputWidth)]
+	fmt.Fprintf(&b, "\x1b[%d;1H%s%s\x1b[K", h, prompt, sanitize(string(input)))
+	fmt.Fprintf(&b, "\x1b[%d;%dH\x1b[?25h", h, len(prompt)+t.editor.pos-start+1)
+
+	io.WriteString(t.out, b.String())
+}
+
+func prefix(dir direction) string {
+	switch dir {
+	case dirRecv:
+		return "< "
+	case dirSend:
+		return "> "
+	default:
+		return "- "
+	}
+}
+
+func color(dir direction) string {
+	switch dir {
+	case dirRecv:
+		return "\x1b[32m"
+	case dirSend:
+		return "\x1b[36m"
+	default:
+		return "\x1b[2m"
+	}
+}
+
+func describe(meta ndog.StreamMetadata) string {
+	parts := []string{}
+	if meta.Scheme != "" {
+		parts = append(parts, meta.Scheme)
+	}
+	if meta.RemoteAddr != "" {
+		parts = append(parts, meta.RemoteAddr)
+	}
+	if meta.HTTP != nil {
+		parts = append(parts, meta.HTTP.Method, meta.HTTP.URI)
+	}
+	return strings.Join(parts, " ")
+}
+
+// sanitize replaces tabs with spaces and other control characters with dots
+// so that they can't mess up the display.
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\t':
+			return ' '
+		case r == utf8.RuneError || !unicode.IsPrint(r):
+			return '.'
+		default:
+			return r
+		}
+	}, s)
+}
+
+func truncate(s string, width int) string {
+	r := []rune(s)
+	if len(r) <= width {
+		return s
+	}
+	return string(r[:width])
+}
+
+func wrap(s string, width int) []string {
+	r := []rune(s)
+	if len(r) == 0 {
+		return []string{""}
+	}
+	lines := []string{}
+	for len(r) > 0 {
+		n := min(width, len(r))
+		lines = append(lines, string(r[:n]))
+		r = r[n:]
+	}
+	return lines
+}
@@ -0,0 +1,29 @@
+package tui
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPruneClosed(t *testing.T) {
+	tui := &TUI{panes: []*pane{{name: "log"}}}
+	for i := 0; i < 2*(maxClosedPanes+10); i++ {
+		tui.panes = append(tui.panes, &pane{name: fmt.Sprint(i), stream: true, closed: i%2 == 0})
+	}
+	tui.selected = 1
+	tui.pruneClosed()
+
+	closed := 0
+	for _, p := range tui.panes {
+		if p.closed {
+			closed++
+		}
+	}
+	assert.Equal(t, maxClosedPanes, closed)
+	assert.Equal(t, "log", tui.panes[0].name)
+	// The selected pane is kept even though it is the oldest closed one.
+	assert.Equal(t, "0", tui.panes[tui.selected].name)
+	assert.Equal(t, "1", tui.panes[2].name)
+}
@@ -0,0 +1,99 @@
+package ndog
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/isobit/ndog/internal/log"
+)
+
+var ErrExecWorkerExited = errors.New("exec worker exited")
+
+// ExecWorkerStreamManager handles all streams with a single long-lived
+// process, with the streams multiplexed over its stdin and stdout as JSON
+// lines envelopes (see MuxStreamManager). If the process exits, all open
+// streams are ended and new streams fail.
+type ExecWorkerStreamManager struct {
+	*MuxStreamManager
+
+	cmd    *exec.Cmd
+	stdin  io.Closer
+	exited chan struct{}
+}
+
+func NewExecWorkerStreamManager(args []string) (*ExecWorkerStreamManager, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), "NDOG_WORKER=1")
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("error creating stdin pipe: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("error creating stdout pipe: %w", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, fmt.Errorf("error creating stderr pipe: %w", err)
+	}
+
+	log.Logf(10, "exec: starting worker: %s", cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("error starting worker: %w", err)
+	}
+	pid := cmd.Process.Pid
+	log.Logf(1, "exec: started worker: %d", pid)
+
+	m := &ExecWorkerStreamManager{
+		MuxStreamManager: NewMuxStreamManager(stdin),
+		cmd:              cmd,
+		stdin:            stdin,
+		exited:           make(chan struct{}),
+	}
+
+	// Log stderr
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			log.Logf(0, "exec: stderr: %d: %s", pid, scanner.Text())
+		}
+	}()
+
+	go func() {
+		defer close(m.exited)
+		if err := m.Route(stdout); err != nil && !IsIOClosedErr(err) {
+			log.Logf(-1, "exec: worker read error: %d: %s", pid, err)
+		}
+		m.Close(ErrExecWorkerExited)
+		if err := cmd.Wait(); err != nil {
+			log.Logf(-1, "exec: worker exited: %d: %s", pid, err)
+		} else {
+			log.Logf(1, "exec: worker exited: %d", pid)
+		}
+	}()
+
+	return m, nil
+}
+
+// Shutdown closes the worker's stdin and waits for it to exit, terminating it
+// with SIGTERM and then killing it if it does not exit in time.
+func (m *ExecWorkerStreamManager) Shutdown() {
+	m.stdin.Close()
+	for _, sig := range []os.Signal{syscall.SIGTERM, os.Kill} {
+		select {
+		case <-m.exited:
+			return
+		case <-time.After(execTerminateTimeout):
+		}
+		log.Logf(10, "exec: signaling worker: %d: %s", m.cmd.Process.Pid, sig)
+		m.cmd.Process.Signal(sig)
+	}
+	<-m.exited
+}
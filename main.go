@@ -1,21 +1,31 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"slices"
 	"sort"
 	"strings"
 	"text/tabwriter"
+	"time"
 
 	"github.com/google/shlex"
 	"github.com/isobit/cli"
+	"github.com/sourcegraph/conc/pool"
 
 	"github.com/isobit/ndog/internal"
 	ndog_log "github.com/isobit/ndog/internal/log"
 	"github.com/isobit/ndog/internal/netutil"
 	"github.com/isobit/ndog/internal/schemes"
+	"github.com/isobit/ndog/internal/script"
 	ndog_tls "github.com/isobit/ndog/internal/tls"
+	"github.com/isobit/ndog/internal/tui"
 	ndog_version "github.com/isobit/ndog/internal/version"
 )
 
@@ -26,18 +36,40 @@ func main() {
 		}
 	}
 
-	err := cli.New("ndog", &Ndog{}).
+	err := cli.New("ndog", &Ndog{
+		ExecPolicy:  string(ndog.ExecPolicyQueue),
+		ReplayMatch: string(ndog.ReplayMatchExact),
+		Format:      string(ndog.FormatRaw),
+		LogIOFormat: string(ndog.FormatQuote),
+		LogFormat:   string(ndog_log.FormatText),
+		GracePeriod: 10 * time.Second,
+
+		ReconnectDelay:    time.Second,
+		ReconnectMaxDelay: time.Minute,
+
+		ScanWorkers: 100,
+		ScanFormat:  string(ndog.ScanFormatText),
+	}).
 		Parse().
-		Run()
+		RunWithSigCancel()
 
 	if err != nil && err != cli.ErrHelp {
 		ndog_log.Logf(-1, "error: %s", err)
 	}
+	var exitCoder cli.ExitCoder
+	if errors.As(err, &exitCoder) {
+		os.Exit(exitCoder.ExitCode())
+	}
 }
 
 type Ndog struct {
-	ListenURL  *url.URL `cli:"name=listen,short=l,placeholder=URL"`
-	ConnectURL *url.URL `cli:"name=connect,short=c,placeholder=URL"`
+	ListenURLs []*url.URL `cli:"name=listen,short=l,append,nodefault,placeholder=URL,help=may be passed multiple times to listen on several URLs with the same handler"`
+	Connect    string     `cli:"name=connect,short=c,placeholder=URL"`
+	// ConnectURL is parsed from Connect, unless scanning, since scan URLs
+	// may have lists and ranges of ports.
+	ConnectURL *url.URL `cli:"-"`
+
+	Config string `cli:"placeholder=FILE,help=run all listeners and connectors described in a YAML config file"`
 
 	Options []string `cli:"short=o,name=option,append,placeholder=KEY=VAL,nodefault,help=scheme options; may be passed multiple times"`
 
@@ -45,6 +77,28 @@ type Ndog struct {
 	Exec string  `cli:"short=x,help=execute a command to handle streams"`
 	Tee  bool    `cli:"short=t,help=also write command input to stdout"`
 
+	Worker bool `cli:"help=run the --exec command as a single long-lived worker which handles all streams multiplexed as JSON lines"`
+
+	Envelope bool `cli:"short=j,help=multiplex streams over STDIN/STDOUT as JSON lines envelopes"`
+	NoTUI    bool `cli:"name=no-tui,help=disable the interactive terminal UI which is used when STDIN and STDOUT are terminals"`
+
+	MaxExec          int           `cli:"help=maximum number of concurrent exec processes; 0 is unlimited"`
+	ExecPolicy       string        `cli:"placeholder=POLICY,help=what to do with new streams once --max-exec is reached: queue/reject/shed (oldest)"`
+	ExecQueueTimeout time.Duration `cli:"help=maximum time for a stream to wait in the exec queue; 0 waits forever"`
+
+	GracePeriod time.Duration `cli:"help=time to wait for open streams to close on shutdown before closing them forcibly"`
+
+	MaxStreams int  `cli:"help=stop listening after handling this many streams and exit with the status of the --exec command; 0 is unlimited"`
+	Once       bool `cli:"help=stop listening after handling a single stream; like --max-streams 1"`
+
+	Reconnect         bool          `cli:"help=connect again whenever the connection is closed or fails until interrupted; only when connecting"`
+	ReconnectDelay    time.Duration `cli:"help=initial delay between reconnect attempts; doubled after each failure"`
+	ReconnectMaxDelay time.Duration `cli:"help=maximum delay between reconnect attempts"`
+
+	Scan        bool   `cli:"short=z,help=probe the ports of the --connect URL without sending data and report which are open; the URL may list hosts and ports or port ranges separated by commas"`
+	ScanWorkers int    `cli:"help=maximum number of concurrent --scan probes"`
+	ScanFormat  string `cli:"placeholder=FORMAT,help=format of --scan results written to STDOUT: text/json; text only lists open ports unless --verbose"`
+
 	ListSchemes bool   `cli:"short=L,help=list available schemes"`
 	SchemeHelp  string `cli:"short=H,help=show help for scheme"`
 
@@ -54,13 +108,39 @@ type Ndog struct {
 	LogLevel int  `cli:"hidden"`
 	LogIO    bool `cli:"help=log all I/O"`
 
+	LogFormat string `cli:"placeholder=FORMAT,help=format of log lines: text/json"`
+
+	InCodec  []string `cli:"append,nodefault,placeholder=CODEC,help=transform data sent to the remote with a codec: NAME[:encode|:decode] (default decode); may be passed multiple times to chain"`
+	OutCodec []string `cli:"append,nodefault,placeholder=CODEC,help=transform data received from the remote with a codec; like --in-codec"`
+
+	Shape     string `cli:"placeholder=SPEC,help=simulate network conditions in both directions: comma separated rate=BYTES/burst=BYTES/latency=DUR/jitter=DUR/fragment=BYTES"`
+	ShapeSend string `cli:"placeholder=SPEC,help=simulate network conditions for data sent to the remote; overrides --shape"`
+	ShapeRecv string `cli:"placeholder=SPEC,help=simulate network conditions for data received from the remote; overrides --shape"`
+
+	Faults []string `cli:"name=fault,append,nodefault,placeholder=FAULT,help=inject faults into streams: KIND[:KEY=VAL...] with kinds refuse/drop/reset/corrupt/stall and keys p/after/dir; may be passed multiple times"`
+
+	Format      string `cli:"placeholder=FORMAT,help=format of data written to STDOUT: raw/quote/hex"`
+	LogIOFormat string `cli:"name=log-io-format,placeholder=FORMAT,help=format of data logged by --log-io: raw/quote/hex"`
+	Timestamps  bool   `cli:"help=prefix data formatted by --format and --log-io-format with timestamps and deltas"`
+
+	Stats         bool   `cli:"help=print a summary of traffic statistics for all streams on exit"`
+	MetricsListen string `cli:"placeholder=ADDR,help=serve traffic statistics in the Prometheus text format over HTTP at ADDR/metrics"`
+
+	Record string `cli:"placeholder=FILE,help=append a timestamped recording of all streams to a file as JSON lines"`
+
+	Script string `cli:"placeholder=FILE,help=run a send/expect script to drive each stream"`
+
+	Replay       string `cli:"placeholder=FILE,help=respond to streams by replaying a recording made with --record; HTTP recordings must be made with --listen and only their bodies are replayed"`
+	ReplayMatch  string `cli:"placeholder=MODE,help=how requests are matched against the --replay recording: exact/regex/glob"`
+	ReplayTiming bool   `cli:"help=delay --replay responses by their original timing"`
+
 	Version bool `cli:"short=V,help=show version"`
 
 	TLS ndog_tls.Config `cli:"embed"`
 	Net netutil.Config  `cli:"embed"`
 }
 
-func (cmd Ndog) Run() error {
+func (cmd Ndog) Run(ctx context.Context) error {
 	if cmd.ListSchemes {
 		return listSchemes()
 	}
@@ -84,6 +164,14 @@ func (cmd Ndog) Run() error {
 	case cmd.Debug:
 		ndog_log.LogLevel = 10
 	}
+	logFormat, err := ndog_log.ParseFormat(cmd.LogFormat)
+	if err != nil {
+		return cli.UsageErrorf("%s", err)
+	}
+	ndog_log.LogFormat = logFormat
+	if logFormat == ndog_log.FormatJSON {
+		ndog_log.LogColor = false
+	}
 
 	// Parse options.
 	opts := map[string]string{}
@@ -92,14 +180,42 @@ func (cmd Ndog) Run() error {
 		opts[key] = value
 	}
 
-	var listenScheme *ndog.Scheme
-	if cmd.ListenURL != nil {
-		scheme, ok := schemes.Lookup(cmd.ListenURL.Scheme)
+	if cmd.Config != "" {
+		if len(cmd.ListenURLs) > 0 || cmd.Connect != "" || cmd.Scan {
+			return cli.UsageErrorf("--config is mutually exclusive with --listen, --connect and --scan")
+		}
+		if flags := cmd.configExclusiveFlags(); len(flags) > 0 {
+			return cli.UsageErrorf("--config is mutually exclusive with %s", strings.Join(flags, ", "))
+		}
+		return cmd.runConfig(ctx)
+	}
+
+	if cmd.Scan {
+		if len(cmd.ListenURLs) > 0 {
+			return cli.UsageErrorf("--scan is mutually exclusive with --listen")
+		}
+		if cmd.Connect == "" {
+			return cli.UsageErrorf("--scan requires --connect")
+		}
+		return cmd.scan(ctx, opts)
+	}
+	if cmd.Connect != "" {
+		u, err := url.Parse(cmd.Connect)
+		if err != nil {
+			return cli.UsageErrorf("invalid connect URL: %s", err)
+		}
+		cmd.ConnectURL = u
+	}
+
+	var listenSchemes []*ndog.Scheme
+	for _, u := range cmd.ListenURLs {
+		scheme, ok := schemes.Lookup(u.Scheme)
 		if !ok || scheme == nil || scheme.Listen == nil {
-			return fmt.Errorf("unknown listen scheme: %s", cmd.ListenURL.Scheme)
+			return fmt.Errorf("unknown listen scheme: %s", u.Scheme)
 		}
-		listenScheme = scheme
+		listenSchemes = append(listenSchemes, scheme)
 	}
+	listening := len(listenSchemes) > 0
 
 	var connectScheme *ndog.Scheme
 	if cmd.ConnectURL != nil {
@@ -110,15 +226,74 @@ func (cmd Ndog) Run() error {
 		connectScheme = scheme
 	}
 
-	// var interactive bool
+	// With multiple listeners, each is only given the options its scheme
+	// describes, so that options for one aren't rejected as unknown by the
+	// others.
+	var listenOpts []ndog.Options
+	if len(listenSchemes) > 1 {
+		used := map[string]bool{}
+		for _, scheme := range listenSchemes {
+			o := ndog.Options{}
+			for key, value := range opts {
+				if scheme.ListenOptionHelp.Has(key) {
+					o[key] = value
+					used[key] = true
+				}
+			}
+			listenOpts = append(listenOpts, o)
+		}
+		if connectScheme != nil {
+			for key := range opts {
+				if connectScheme.ConnectOptionHelp.Has(key) {
+					used[key] = true
+				}
+			}
+		}
+		var unknown []string
+		for key := range opts {
+			if !used[key] {
+				unknown = append(unknown, key)
+			}
+		}
+		if len(unknown) > 0 {
+			sort.Strings(unknown)
+			return cli.UsageErrorf("unknown options: %s", strings.Join(unknown, ", "))
+		}
+	}
+
+	maxStreams := cmd.MaxStreams
+	if cmd.Once {
+		if maxStreams > 1 {
+			return cli.UsageErrorf("--once and --max-streams are mutually exclusive")
+		}
+		maxStreams = 1
+	}
+	if maxStreams < 0 {
+		return cli.UsageErrorf("--max-streams must not be negative")
+	}
+	if maxStreams > 0 && !listening {
+		return cli.UsageErrorf("--max-streams and --once require --listen")
+	}
+	if cmd.Reconnect && (listening || connectScheme == nil) {
+		return cli.UsageErrorf("--reconnect requires --connect without --listen")
+	}
+
+	format, err := ndog.ParseFormat(cmd.Format)
+	if err != nil {
+		return cli.UsageErrorf("%s", err)
+	}
+	logIOFormat, err := ndog.ParseFormat(cmd.LogIOFormat)
+	if err != nil {
+		return cli.UsageErrorf("%s", err)
+	}
+
+	var interactive bool
 	var fixedData []byte
 	if cmd.Data != nil {
 		fixedData = []byte(*cmd.Data)
+	} else if !cmd.NoTUI && format == ndog.FormatRaw {
+		interactive = tui.IsTerminal(int(os.Stdin.Fd())) && tui.IsTerminal(int(os.Stdout.Fd()))
 	}
-	// else {
-	// 	stdinStat, _ := os.Stdin.Stat()
-	// 	interactive = stdinStat.Mode()&os.ModeCharDevice != 0
-	// }
 
 	connectCfg := ndog.Config{
 		URL:     cmd.ConnectURL,
@@ -126,57 +301,661 @@ func (cmd Ndog) Run() error {
 		TLS:     cmd.TLS,
 		Net:     cmd.Net,
 	}
+	// The URL is set for each listener.
 	listenCfg := ndog.Config{
-		URL:     cmd.ListenURL,
 		Options: opts,
 		TLS:     cmd.TLS,
 		Net:     cmd.Net,
 	}
 
+	// Only one of these can handle streams, so don't silently ignore the
+	// others.
+	var handlers []string
+	for _, h := range []struct {
+		name string
+		set  bool
+	}{
+		{"--exec", cmd.Exec != ""},
+		{"--script", cmd.Script != ""},
+		{"--replay", cmd.Replay != ""},
+		{"--envelope", cmd.Envelope},
+	} {
+		if h.set {
+			handlers = append(handlers, h.name)
+		}
+	}
+	if len(handlers) > 1 {
+		return cli.UsageErrorf("%s are mutually exclusive", strings.Join(handlers, " and "))
+	}
+
 	var streamManager ndog.StreamManager
+	var execStreamManager *ndog.ExecStreamManager
+	var workerStreamManager *ndog.ExecWorkerStreamManager
+	var scriptStreamManager *script.StreamManager
+	var statsStreamManager *ndog.StatsStreamManager
+	// Write the summary last, e.g. after the interactive UI is closed.
+	defer func() {
+		if cmd.Stats && statsStreamManager != nil {
+			statsStreamManager.WriteSummary(os.Stderr)
+		}
+	}()
 	switch {
-	case listenScheme != nil && connectScheme != nil:
+	case listening && connectScheme != nil:
 		streamManager = ndog.ProxyStreamManager{
 			ConnectConfig: connectCfg,
 			Connect:       connectScheme.Connect,
 		}
+	case cmd.Exec != "" && cmd.Worker:
+		args, err := shlex.Split(cmd.Exec)
+		if err != nil {
+			return cli.UsageErrorf("failed to split exec args: %s", err)
+		}
+		workerStreamManager, err = ndog.NewExecWorkerStreamManager(args)
+		if err != nil {
+			return err
+		}
+		streamManager = workerStreamManager
 	case cmd.Exec != "":
 		args, err := shlex.Split(cmd.Exec)
 		if err != nil {
 			return cli.UsageErrorf("failed to split exec args: %s", err)
 		}
-		execStreamManager := ndog.NewExecStreamManager(args)
+		policy, err := ndog.ParseExecPolicy(cmd.ExecPolicy)
+		if err != nil {
+			return cli.UsageErrorf("%s", err)
+		}
+		execStreamManager = ndog.NewExecStreamManager(args)
 		if cmd.Tee {
 			execStreamManager.TeeWriter = os.Stdout
 		}
+		execStreamManager.MaxProcs = cmd.MaxExec
+		execStreamManager.Policy = policy
+		execStreamManager.QueueTimeout = cmd.ExecQueueTimeout
 		streamManager = execStreamManager
-	// case interactive:
-	// TODO
+	case cmd.Script != "":
+		f, err := os.Open(cmd.Script)
+		if err != nil {
+			return fmt.Errorf("error opening script: %w", err)
+		}
+		s, err := script.Parse(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("error parsing script: %w", err)
+		}
+		scriptStreamManager = script.NewStreamManager(s, os.Stdout)
+		streamManager = scriptStreamManager
+	case cmd.Replay != "":
+		match, err := ndog.ParseReplayMatch(cmd.ReplayMatch)
+		if err != nil {
+			return cli.UsageErrorf("%s", err)
+		}
+		f, err := os.Open(cmd.Replay)
+		if err != nil {
+			return fmt.Errorf("error opening replay file: %w", err)
+		}
+		records, err := ndog.ReadRecords(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("error reading replay file: %w", err)
+		}
+		streamManager, err = ndog.NewReplayStreamManager(records, match, cmd.ReplayTiming)
+		if err != nil {
+			return err
+		}
+	case cmd.Envelope:
+		if fixedData != nil {
+			return cli.UsageErrorf("--data and --envelope are mutually exclusive")
+		}
+		streamManager = ndog.NewStdIOMuxStreamManager()
+	case interactive:
+		t, err := tui.New(os.Stdin, os.Stdout)
+		if err != nil {
+			return err
+		}
+		defer t.Close()
+		switch {
+		case len(listenSchemes) == 1 && listenSchemes[0].NewCompleter != nil:
+			cfg := listenCfg
+			cfg.URL = cmd.ListenURLs[0]
+			listenCfg.Completer = listenSchemes[0].NewCompleter(cfg)
+			t.SetCompleter(listenCfg.Completer)
+		case connectScheme != nil && connectScheme.NewCompleter != nil:
+			connectCfg.Completer = connectScheme.NewCompleter(connectCfg)
+			t.SetCompleter(connectCfg.Completer)
+		}
+		streamManager = t
 	default:
-		streamManager = ndog.NewStdIOStreamManager(fixedData)
+		stdioStreamManager := ndog.NewStdIOStreamManager(fixedData)
+		stdioStreamManager.Renderer = ndog.Renderer{
+			Format:     format,
+			Timestamps: cmd.Timestamps,
+		}
+		streamManager = stdioStreamManager
+	}
+	if len(cmd.InCodec) > 0 || len(cmd.OutCodec) > 0 {
+		codecStreamManager := &ndog.CodecStreamManager{
+			StreamManager: streamManager,
+		}
+		for _, spec := range cmd.InCodec {
+			t, err := ndog.ParseCodec(spec)
+			if err != nil {
+				return cli.UsageErrorf("%s", err)
+			}
+			codecStreamManager.In = append(codecStreamManager.In, t)
+		}
+		for _, spec := range cmd.OutCodec {
+			t, err := ndog.ParseCodec(spec)
+			if err != nil {
+				return cli.UsageErrorf("%s", err)
+			}
+			codecStreamManager.Out = append(codecStreamManager.Out, t)
+		}
+		streamManager = codecStreamManager
 	}
 	if cmd.LogIO {
-		streamManager = ndog.NewLogStreamManager(streamManager)
+		logStreamManager := ndog.NewLogStreamManager(streamManager)
+		logStreamManager.Renderer = ndog.Renderer{
+			Format:     logIOFormat,
+			Timestamps: cmd.Timestamps,
+		}
+		streamManager = logStreamManager
 	}
-
-	switch {
-	case listenScheme != nil:
-		return listenScheme.Listen(ndog.ListenConfig{
-			Config:        listenCfg,
+	if cmd.Record != "" {
+		f, err := os.OpenFile(cmd.Record, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("error opening recording file: %w", err)
+		}
+		defer f.Close()
+		streamManager = ndog.NewRecordStreamManager(streamManager, f)
+	}
+	if cmd.Shape != "" || cmd.ShapeSend != "" || cmd.ShapeRecv != "" {
+		shapeStreamManager := &ndog.ShapeStreamManager{
+			StreamManager: streamManager,
+		}
+		if cmd.Shape != "" {
+			shaping, err := ndog.ParseShaping(cmd.Shape)
+			if err != nil {
+				return cli.UsageErrorf("%s", err)
+			}
+			shapeStreamManager.Send = shaping
+			shapeStreamManager.Recv = shaping
+		}
+		if cmd.ShapeSend != "" {
+			shaping, err := ndog.ParseShaping(cmd.ShapeSend)
+			if err != nil {
+				return cli.UsageErrorf("%s", err)
+			}
+			shapeStreamManager.Send = shaping
+		}
+		if cmd.ShapeRecv != "" {
+			shaping, err := ndog.ParseShaping(cmd.ShapeRecv)
+			if err != nil {
+				return cli.UsageErrorf("%s", err)
+			}
+			shapeStreamManager.Recv = shaping
+		}
+		streamManager = shapeStreamManager
+	}
+	if len(cmd.Faults) > 0 {
+		faultStreamManager := &ndog.FaultStreamManager{
 			StreamManager: streamManager,
+		}
+		for _, spec := range cmd.Faults {
+			fault, err := ndog.ParseFault(spec)
+			if err != nil {
+				return cli.UsageErrorf("%s", err)
+			}
+			if fault.Kind == ndog.FaultReset {
+				// Faults apply to the streams of the listeners, or of the
+				// connection if not listening.
+				streamURLs, streamSchemes := cmd.ListenURLs, listenSchemes
+				if !listening && connectScheme != nil {
+					streamURLs, streamSchemes = []*url.URL{cmd.ConnectURL}, []*ndog.Scheme{connectScheme}
+				}
+				for i, scheme := range streamSchemes {
+					if !scheme.Resets {
+						return cli.UsageErrorf("fault reset is not supported by scheme %s", streamURLs[i].Scheme)
+					}
+				}
+			}
+			faultStreamManager.Faults = append(faultStreamManager.Faults, fault)
+		}
+		streamManager = faultStreamManager
+	}
+	var timeoutStreamManager *ndog.TimeoutStreamManager
+	if cmd.Net.IdleTimeout > 0 || cmd.Net.Timeout > 0 {
+		timeoutStreamManager = &ndog.TimeoutStreamManager{
+			StreamManager: streamManager,
+			Idle:          cmd.Net.IdleTimeout,
+			Total:         cmd.Net.Timeout,
+		}
+		streamManager = timeoutStreamManager
+	}
+	if cmd.Stats || cmd.MetricsListen != "" {
+		statsStreamManager = ndog.NewStatsStreamManager(streamManager)
+		streamManager = statsStreamManager
+	}
+	if cmd.MetricsListen != "" {
+		ln, err := net.Listen("tcp", cmd.MetricsListen)
+		if err != nil {
+			return fmt.Errorf("error listening for metrics: %w", err)
+		}
+		ndog_log.Logf(0, "serving metrics: http://%s/metrics", ln.Addr())
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			statsStreamManager.WriteMetrics(w)
 		})
+		srv := &http.Server{Handler: mux}
+		go srv.Serve(ln)
+		defer srv.Close()
+	}
+	if execStreamManager != nil {
+		defer execStreamManager.Shutdown()
+		// Don't start queued streams once shutting down.
+		stop := context.AfterFunc(ctx, execStreamManager.Drain)
+		defer stop()
+	}
+	if workerStreamManager != nil {
+		defer workerStreamManager.Shutdown()
+	}
+
+	switch {
+	case listening:
+		if maxStreams > 0 {
+			// Stop listening once the streams have been handled.
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithCancel(ctx)
+			defer cancel()
+			streamManager = &ndog.LimitStreamManager{
+				StreamManager: streamManager,
+				Max:           maxStreams,
+				Done:          cancel,
+			}
+		}
+		var err error
+		if len(listenSchemes) == 1 {
+			listenCfg.URL = cmd.ListenURLs[0]
+			err = cmd.listen(ctx, listenSchemes[0], ndog.ListenConfig{
+				Config:        listenCfg,
+				StreamManager: streamManager,
+			})
+		} else {
+			// Stop all listeners if one of them fails.
+			p := pool.New().WithErrors().WithContext(ctx).WithFirstError().WithCancelOnError()
+			for i, scheme := range listenSchemes {
+				cfg := listenCfg
+				cfg.URL = cmd.ListenURLs[i]
+				cfg.Options = listenOpts[i]
+				p.Go(func(ctx context.Context) error {
+					return cmd.listen(ctx, scheme, ndog.ListenConfig{
+						Config: cfg,
+						StreamManager: ndog.PrefixStreamManager{
+							StreamManager: streamManager,
+							Prefix:        cfg.URL.String() + "|",
+						},
+					})
+				})
+			}
+			err = p.Wait()
+		}
+		if err == nil && scriptStreamManager != nil {
+			err = scriptStreamManager.Err()
+		}
+		if err == nil && maxStreams > 0 && execStreamManager != nil {
+			execStreamManager.Wait()
+			err = execStreamManager.Err()
+		}
+		return err
 	case connectScheme != nil:
-		stream := streamManager.NewStream(cmd.ConnectURL.String())
+		if scriptStreamManager != nil {
+			// Don't wait for the remote to close the connection once
+			// the script is done.
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithCancel(ctx)
+			defer cancel()
+			scriptStreamManager.OnDone = cancel
+		}
+		if timeoutStreamManager != nil {
+			// Stop waiting on the remote once the stream times out.
+			var cancel context.CancelCauseFunc
+			ctx, cancel = context.WithCancelCause(ctx)
+			defer cancel(nil)
+			timeoutStreamManager.OnTimeout = func(name string, err error) {
+				cancel(err)
+			}
+		}
+		stream, err := streamManager.NewStream(cmd.ConnectURL.String(), ndog.StreamMetadata{
+			Scheme:     cmd.ConnectURL.Scheme,
+			RemoteAddr: cmd.ConnectURL.Host,
+		})
+		if err != nil {
+			return err
+		}
 		defer stream.Close()
-		return connectScheme.Connect(ndog.ConnectConfig{
-			Config: connectCfg,
-			Stream: stream,
+		// Closing the stream on cancellation unblocks schemes which are
+		// waiting to read from it, e.g. when it is interactive.
+		stop := context.AfterFunc(ctx, func() {
+			stream.Close()
 		})
+		defer stop()
+		connect := func(ctx context.Context, stream ndog.Stream) error {
+			return connectScheme.Connect(ctx, ndog.ConnectConfig{
+				Config: connectCfg,
+				Stream: stream,
+			})
+		}
+		if cmd.Reconnect {
+			err = ndog.Reconnect(ctx, stream, &ndog.Backoff{
+				Initial: cmd.ReconnectDelay,
+				Max:     cmd.ReconnectMaxDelay,
+			}, connect)
+		} else {
+			err = connect(ctx, stream)
+		}
+		if cause := context.Cause(ctx); errors.Is(cause, netutil.ErrIdleTimeout) || errors.Is(cause, netutil.ErrTimeout) {
+			err = cause
+		}
+		if err == nil && scriptStreamManager != nil {
+			err = scriptStreamManager.Err()
+		}
+		return err
 	default:
 		return cli.UsageErrorf("at least one of --listen or --connect must be specified")
 	}
 }
 
+// listen runs the listen scheme until ctx is cancelled. Streams which are
+// still open once the grace period has elapsed after cancellation are closed
+// forcibly so that the scheme can return.
+func (cmd Ndog) listen(ctx context.Context, scheme *ndog.Scheme, cfg ndog.ListenConfig) error {
+	graceful := ndog.NewGracefulStreamManager(cfg.StreamManager)
+	cfg.StreamManager = graceful
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+			return
+		}
+		ndog_log.Logf(0, "shutting down")
+		select {
+		case <-time.After(cmd.GracePeriod):
+			n := graceful.CloseAll()
+			ndog_log.Logf(0, "grace period elapsed, closed %d stream(s)", n)
+		case <-done:
+		}
+	}()
+
+	return scheme.Listen(ctx, cfg)
+}
+
+// configExclusiveFlags returns the flags which are set but aren't applied to
+// --config entries, so that they aren't silently ignored.
+func (cmd Ndog) configExclusiveFlags() []string {
+	var flags []string
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"--option", len(cmd.Options) > 0},
+		{"--data", cmd.Data != nil},
+		{"--exec", cmd.Exec != ""},
+		{"--worker", cmd.Worker},
+		{"--envelope", cmd.Envelope},
+		{"--max-streams", cmd.MaxStreams > 0},
+		{"--once", cmd.Once},
+		{"--reconnect", cmd.Reconnect},
+		{"--in-codec", len(cmd.InCodec) > 0},
+		{"--out-codec", len(cmd.OutCodec) > 0},
+		{"--shape", cmd.Shape != ""},
+		{"--shape-send", cmd.ShapeSend != ""},
+		{"--shape-recv", cmd.ShapeRecv != ""},
+		{"--fault", len(cmd.Faults) > 0},
+		{"--stats", cmd.Stats},
+		{"--metrics-listen", cmd.MetricsListen != ""},
+		{"--record", cmd.Record != ""},
+		{"--script", cmd.Script != ""},
+		{"--replay", cmd.Replay != ""},
+	} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+	return flags
+}
+
+// runConfig runs all entries of the --config file until ctx is cancelled or
+// one of them fails. Connectors which finish successfully don't stop the
+// others.
+func (cmd Ndog) runConfig(ctx context.Context) error {
+	f, err := os.Open(cmd.Config)
+	if err != nil {
+		return fmt.Errorf("error opening config file: %w", err)
+	}
+	file, err := ndog.ParseConfigFile(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	format, err := ndog.ParseFormat(cmd.Format)
+	if err != nil {
+		return cli.UsageErrorf("%s", err)
+	}
+	logIOFormat, err := ndog.ParseFormat(cmd.LogIOFormat)
+	if err != nil {
+		return cli.UsageErrorf("%s", err)
+	}
+
+	// Check every entry before starting any of them.
+	for _, entry := range file.Entries {
+		if entry.ListenURL != nil {
+			if scheme, ok := schemes.Lookup(entry.ListenURL.Scheme); !ok || scheme == nil || scheme.Listen == nil {
+				return fmt.Errorf("%s: unknown listen scheme: %s", entry.Name, entry.ListenURL.Scheme)
+			}
+		}
+		if entry.ConnectURL != nil {
+			if scheme, ok := schemes.Lookup(entry.ConnectURL.Scheme); !ok || scheme == nil || scheme.Connect == nil {
+				return fmt.Errorf("%s: unknown connect scheme: %s", entry.Name, entry.ConnectURL.Scheme)
+			}
+		}
+		if entry.Exec != "" {
+			if _, err := shlex.Split(entry.Exec); err != nil {
+				return fmt.Errorf("%s: failed to split exec args: %w", entry.Name, err)
+			}
+		}
+	}
+
+	// Entries handled by STDIN/STDOUT share a stream manager, since only one
+	// of them can consume STDIN.
+	var stdio *ndog.StdIOStreamManager
+	for _, entry := range file.Entries {
+		if entry.ListenURL != nil && entry.ConnectURL != nil || entry.Exec != "" || entry.Data != nil {
+			continue
+		}
+		if stdio == nil {
+			stdio = ndog.NewStdIOStreamManager(nil)
+			stdio.Renderer = ndog.Renderer{
+				Format:     format,
+				Timestamps: cmd.Timestamps,
+			}
+		}
+	}
+
+	p := pool.New().WithErrors().WithContext(ctx).WithFirstError().WithCancelOnError()
+	for _, entry := range file.Entries {
+		p.Go(func(ctx context.Context) error {
+			if err := cmd.runEntry(ctx, entry, stdio, format, logIOFormat); err != nil {
+				return fmt.Errorf("%s: %w", entry.Name, err)
+			}
+			return nil
+		})
+	}
+	return p.Wait()
+}
+
+func (cmd Ndog) runEntry(ctx context.Context, entry ndog.ConfigEntry, stdio *ndog.StdIOStreamManager, format, logIOFormat ndog.Format) error {
+	logger := ndog_log.With("entry", entry.Name)
+	logger.Logf(1, "starting entry: %s", entry.Name)
+
+	cfg := ndog.Config{
+		Options: entry.Options,
+		TLS:     entry.TLS,
+		Net:     entry.Net,
+	}
+	var connectScheme *ndog.Scheme
+	if entry.ConnectURL != nil {
+		connectScheme, _ = schemes.Lookup(entry.ConnectURL.Scheme)
+	}
+
+	var streamManager ndog.StreamManager
+	switch {
+	case entry.ListenURL != nil && entry.ConnectURL != nil:
+		connectCfg := cfg
+		connectCfg.URL = entry.ConnectURL
+		streamManager = ndog.ProxyStreamManager{
+			ConnectConfig: connectCfg,
+			Connect:       connectScheme.Connect,
+		}
+	case entry.Exec != "":
+		args, _ := shlex.Split(entry.Exec)
+		execStreamManager := ndog.NewExecStreamManager(args)
+		defer execStreamManager.Shutdown()
+		streamManager = execStreamManager
+	case entry.Data != nil:
+		stdioStreamManager := ndog.NewStdIOStreamManager([]byte(*entry.Data))
+		stdioStreamManager.Renderer = ndog.Renderer{
+			Format:     format,
+			Timestamps: cmd.Timestamps,
+		}
+		streamManager = stdioStreamManager
+	default:
+		streamManager = stdio
+	}
+	if cmd.LogIO {
+		logStreamManager := ndog.NewLogStreamManager(streamManager)
+		logStreamManager.Renderer = ndog.Renderer{
+			Format:     logIOFormat,
+			Timestamps: cmd.Timestamps,
+		}
+		streamManager = logStreamManager
+	}
+	var timeoutStreamManager *ndog.TimeoutStreamManager
+	if entry.Net.IdleTimeout > 0 || entry.Net.Timeout > 0 {
+		timeoutStreamManager = &ndog.TimeoutStreamManager{
+			StreamManager: streamManager,
+			Idle:          entry.Net.IdleTimeout,
+			Total:         entry.Net.Timeout,
+		}
+		streamManager = timeoutStreamManager
+	}
+
+	if entry.ListenURL != nil {
+		listenScheme, _ := schemes.Lookup(entry.ListenURL.Scheme)
+		cfg.URL = entry.ListenURL
+		return cmd.listen(ctx, listenScheme, ndog.ListenConfig{
+			Config:        cfg,
+			StreamManager: streamManager,
+		})
+	}
+
+	cfg.URL = entry.ConnectURL
+	if timeoutStreamManager != nil {
+		// Stop waiting on the remote once the stream times out.
+		var cancel context.CancelCauseFunc
+		ctx, cancel = context.WithCancelCause(ctx)
+		defer cancel(nil)
+		timeoutStreamManager.OnTimeout = func(name string, err error) {
+			cancel(err)
+		}
+	}
+	stream, err := streamManager.NewStream(entry.ConnectURL.String(), ndog.StreamMetadata{
+		Scheme:     entry.ConnectURL.Scheme,
+		RemoteAddr: entry.ConnectURL.Host,
+	})
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	stop := context.AfterFunc(ctx, func() {
+		stream.Close()
+	})
+	defer stop()
+	err = connectScheme.Connect(ctx, ndog.ConnectConfig{
+		Config: cfg,
+		Stream: stream,
+	})
+	if cause := context.Cause(ctx); errors.Is(cause, netutil.ErrIdleTimeout) || errors.Is(cause, netutil.ErrTimeout) {
+		err = cause
+	}
+	if err == nil {
+		logger.Logf(1, "entry done: %s", entry.Name)
+	}
+	return err
+}
+
+// scan probes every port of every host in the --connect URL and writes the
+// results to stdout.
+func (cmd Ndog) scan(ctx context.Context, opts map[string]string) error {
+	format, err := ndog.ParseScanFormat(cmd.ScanFormat)
+	if err != nil {
+		return cli.UsageErrorf("%s", err)
+	}
+	name, targets, err := ndog.ParseScanURL(cmd.Connect)
+	if err != nil {
+		return cli.UsageErrorf("%s", err)
+	}
+	scheme, ok := schemes.Lookup(name)
+	if !ok || scheme == nil || scheme.Probe == nil {
+		return fmt.Errorf("scheme does not support scanning: %s", name)
+	}
+
+	cfg := ndog.Config{
+		Options: opts,
+		TLS:     cmd.TLS,
+		Net:     cmd.Net,
+	}
+	if cfg.Net.ConnectTimeout <= 0 {
+		cfg.Net.ConnectTimeout = 2 * time.Second
+	}
+	ndog_log.With("scheme", name).Logf(1, "scanning %d port(s)", len(targets))
+	results, err := ndog.Scan(ctx, name, scheme.Probe, cfg, targets, cmd.ScanWorkers)
+	if results == nil {
+		return err
+	}
+
+	if format == ndog.ScanFormatJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		for _, result := range results {
+			if err := enc.Encode(result); err != nil {
+				return err
+			}
+		}
+		return err
+	}
+	// Like nc -z, only list ports which may be open unless verbose.
+	if !cmd.Verbose {
+		results = slices.DeleteFunc(results, func(result ndog.ScanResult) bool {
+			return result.State != ndog.PortOpen && result.State != ndog.PortOpenFiltered
+		})
+		if len(results) == 0 {
+			return err
+		}
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tPORT\tSTATE\tERROR")
+	for _, result := range results {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", result.Host, result.Port, result.State, result.Error)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return err
+}
+
 func listSchemes() error {
 	list := make([]string, len(schemes.Registry))
 	i := 0
@@ -196,6 +975,9 @@ func listSchemes() error {
 		if scheme.Connect != nil {
 			supports = append(supports, "connect")
 		}
+		if scheme.Probe != nil {
+			supports = append(supports, "scan")
+		}
 
 		fmt.Fprintf(w, name)
 		if len(supports) > 0 {